@@ -0,0 +1,81 @@
+package repokeeper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Расширения файлов сервиса в каталоге кеша.
+const (
+	CacheFileExt          = ".cache"
+	TranscodeCacheFileExt = ".transcode_cache"
+	LockFileExt           = ".lock"
+)
+
+// ErrCacheLocked возвращается, если кеш репозитория используется другим экземпляром сервиса.
+var ErrCacheLocked = errors.New("cache is used by another keeper")
+
+// DefaultCacheDir возвращает каталог кеша по умолчанию:
+// $XDG_STATE_HOME/repokeeper или ~/.local/state/repokeeper.
+func DefaultCacheDir() (string, error) {
+	state := os.Getenv("XDG_STATE_HOME")
+	if !filepath.IsAbs(state) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(state, ServiceName), nil
+}
+
+// CacheBaseName возвращает имя файлов кеша (без расширения) для корня репозитория.
+// Имя содержит последний элемент пути корня и хеш полного пути.
+func CacheBaseName(root string) string {
+	root = filepath.Clean(root)
+	sum := sha256.Sum256([]byte(root))
+	name := strings.Trim(filepath.Base(root), string(filepath.Separator)+".")
+	if name == "" {
+		name = "root"
+	}
+	return name + "-" + hex.EncodeToString(sum[:6])
+}
+
+// cacheLock - монопольная блокировка файлов кеша репозитория.
+type cacheLock struct {
+	f *os.File
+}
+
+// lockCache устанавливает блокировку на файл `fn`.
+// Блокировка снимается при завершении процесса, поэтому не требует очистки после сбоя.
+func lockCache(fn string) (*cacheLock, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrCacheLocked, fn)
+		}
+		return nil, err
+	}
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &cacheLock{f: f}, nil
+}
+
+func (l *cacheLock) unlock() error {
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
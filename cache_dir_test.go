@@ -0,0 +1,38 @@
+package repokeeper
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultCacheDir(t *testing.T) {
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+	dir, err := DefaultCacheDir()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(state, ServiceName), dir)
+}
+
+func TestCacheBaseName(t *testing.T) {
+	name := CacheBaseName("/mnt/music")
+	assert.Regexp(t, `^music-[0-9a-f]{12}$`, name)
+	assert.Equal(t, name, CacheBaseName("/mnt/music/"))
+	assert.NotEqual(t, name, CacheBaseName("/media/music"))
+	assert.Regexp(t, `^root-`, CacheBaseName("/"))
+}
+
+func TestCacheLock(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "repo"+LockFileExt)
+	lock, err := lockCache(fn)
+	require.NoError(t, err)
+	_, err = lockCache(fn)
+	assert.ErrorIs(t, err, ErrCacheLocked)
+	require.NoError(t, lock.unlock())
+
+	lock, err = lockCache(fn)
+	require.NoError(t, err)
+	assert.NoError(t, lock.unlock())
+}
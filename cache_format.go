@@ -0,0 +1,228 @@
+package repokeeper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CacheFormatVersion - текущая версия формата файла кеша аудио каталогов.
+// Версия 0 соответствует файлу без заголовка (JSON-словарь узлов), начиная с версии 2
+// содержимое кеша сопровождается контрольной суммой, с версии 3 пути узлов хранятся
+// относительно корня репозитория, с версии 4 для Album Entry сохраняется список
+// аудиофайлов, с версии 5 - идентификатор Album Entry, с версии 6 - состояние
+// Album Entry, с версии 7 - частичные хеши аудиофайлов.
+const CacheFormatVersion = 7
+
+// Параметры сохранения контрольных точек кеша во время работы сервиса.
+const (
+	CheckpointInterval = 5 * time.Minute
+	CheckpointChanges  = 100
+)
+
+// ErrCacheMismatch возвращается при загрузке кеша, сформированного для другого корня
+// репозитория, другого набора форматов или в неподдерживаемой (более новой) версии
+// формата кеша. Такой кеш должен быть сформирован заново. Версия сервиса сохраняется
+// в заголовке кеша только для диагностики и не проверяется.
+var ErrCacheMismatch = errors.New("cache does not match repository settings")
+
+// ErrCacheCorrupt возвращается при загрузке поврежденного файла кеша.
+var ErrCacheCorrupt = errors.New("cache file is corrupt")
+
+// cacheEnvelope - содержимое файла кеша с заголовком.
+// `Checksum` содержит SHA-256 от JSON-представления узлов кеша `RawCache`.
+type cacheEnvelope struct {
+	Version        int                   `json:"version"`
+	Root           string                `json:"root"`
+	Extensions     []string              `json:"extensions"`
+	CreatedAt      time.Time             `json:"created_at"`
+	ServiceVersion string                `json:"service_version"`
+	Checksum       string                `json:"checksum,omitempty"`
+	RawCache       json.RawMessage       `json:"cache"`
+	Cache          map[string]*CacheElem `json:"-"`
+}
+
+// cacheMigrations[i] переводит содержимое кеша из версии i в версию i+1.
+var cacheMigrations = []func(ent *Entries, env *cacheEnvelope) error{
+	migrateCacheV0,
+	// в версии 2 добавлена только контрольная сумма
+	func(ent *Entries, env *cacheEnvelope) error { return nil },
+	migrateCacheV2,
+	// список аудиофайлов заполняется при очередном сканировании репозитория
+	func(ent *Entries, env *cacheEnvelope) error { return nil },
+	// идентификаторы Album Entry назначаются при очередном сканировании репозитория
+	func(ent *Entries, env *cacheEnvelope) error { return nil },
+	// состояние Album Entry заполняется командами сервиса
+	func(ent *Entries, env *cacheEnvelope) error { return nil },
+	// частичные хеши вычисляются при очередном сканировании репозитория
+	func(ent *Entries, env *cacheEnvelope) error { return nil },
+}
+
+// encode формирует содержимое файла кеша с контрольной суммой.
+// Пути узлов `Cache` преобразуются в относительные к `Root`.
+func (env *cacheEnvelope) encode() ([]byte, error) {
+	cache, err := relativeCache(env.Root, env.Cache)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(cache)
+	if err != nil {
+		return nil, err
+	}
+	env.RawCache = raw
+	env.Checksum = cacheChecksum(raw)
+	return json.Marshal(env)
+}
+
+// decodeCacheEnvelope разбирает файл кеша любой поддерживаемой версии.
+// Ошибки разбора и несовпадение контрольной суммы возвращаются как ErrCacheCorrupt.
+func decodeCacheEnvelope(data []byte) (*cacheEnvelope, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	env := &cacheEnvelope{}
+	// в кеше версии 0 значения верхнего уровня - объекты, а не число
+	if err := json.Unmarshal(data, &probe); err != nil || probe.Version == 0 {
+		if err := json.Unmarshal(data, &env.Cache); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCacheCorrupt, err)
+		}
+		return env, nil
+	}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCacheCorrupt, err)
+	}
+	if env.Version >= 2 && env.Checksum != cacheChecksum(env.RawCache) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCacheCorrupt)
+	}
+	if err := json.Unmarshal(env.RawCache, &env.Cache); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCacheCorrupt, err)
+	}
+	return env, nil
+}
+
+func cacheChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// upgrade выполняет миграцию кеша до текущей версии и проверяет его соответствие
+// параметрам `ent`.
+func (env *cacheEnvelope) upgrade(ent *Entries) error {
+	if env.Version > CacheFormatVersion {
+		return fmt.Errorf("%w: unsupported cache version %d", ErrCacheMismatch, env.Version)
+	}
+	for ; env.Version < CacheFormatVersion; env.Version++ {
+		if err := cacheMigrations[env.Version](ent, env); err != nil {
+			return err
+		}
+	}
+	if env.Root != ent.Root {
+		return fmt.Errorf("%w: cache root %s", ErrCacheMismatch, env.Root)
+	}
+	if strings.Join(env.Extensions, " ") != strings.Join(ent.formats.Extensions(), " ") {
+		return fmt.Errorf("%w: cache extensions %v", ErrCacheMismatch, env.Extensions)
+	}
+	return nil
+}
+
+// migrateCacheV0 добавляет заголовок к кешу без заголовка.
+// Принадлежность кеша корню репозитория проверяется по путям узлов, набор форматов
+// считается совпадающим; тип узлов восстанавливается по содержимому каталогов.
+func migrateCacheV0(ent *Entries, env *cacheEnvelope) error {
+	for path := range env.Cache {
+		if rel, err := filepath.Rel(ent.Root, path); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("%w: %s is out of root", ErrCacheMismatch, path)
+		}
+	}
+	env.Root = ent.Root
+	env.Extensions = ent.formats.Extensions()
+	ent.restoreKinds(env.Cache)
+	return nil
+}
+
+// migrateCacheV2 преобразует пути узлов в относительные к корню репозитория.
+func migrateCacheV2(ent *Entries, env *cacheEnvelope) (err error) {
+	env.Cache, err = relativeCache(env.Root, env.Cache)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCacheMismatch, err)
+	}
+	return nil
+}
+
+// relativeCache возвращает копию узлов кеша с путями относительно `root`.
+func relativeCache(root string, cache map[string]*CacheElem) (map[string]*CacheElem, error) {
+	return mapCachePaths(cache, func(path string) (string, error) {
+		return relativePath(root, path)
+	})
+}
+
+// absoluteCache возвращает копию узлов кеша с путями, дополненными корнем `root`.
+func absoluteCache(root string, cache map[string]*CacheElem) map[string]*CacheElem {
+	ret, _ := mapCachePaths(cache, func(path string) (string, error) {
+		return absolutePath(root, path), nil
+	})
+	return ret
+}
+
+func relativePath(root, path string) (string, error) {
+	ret, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	if ret == ".." || strings.HasPrefix(ret, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is out of root %s", path, root)
+	}
+	return ret, nil
+}
+
+func absolutePath(root, path string) string {
+	return filepath.Join(root, path)
+}
+
+func mapCachePaths(cache map[string]*CacheElem,
+	conv func(path string) (string, error)) (map[string]*CacheElem, error) {
+	ret := make(map[string]*CacheElem, len(cache))
+	for path, elem := range cache {
+		key, err := conv(path)
+		if err != nil {
+			return nil, err
+		}
+		if ret[key], err = mapElemPaths(elem, conv); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// mapElemPaths возвращает копию узла с путями, преобразованными `conv`.
+func mapElemPaths(elem *CacheElem, conv func(path string) (string, error)) (*CacheElem, error) {
+	c := *elem
+	c.Children = nil
+	for _, child := range elem.Children {
+		path, err := conv(child)
+		if err != nil {
+			return nil, err
+		}
+		c.Children = append(c.Children, path)
+	}
+	c.Aliases = nil
+	for _, alias := range elem.Aliases {
+		path, err := conv(alias)
+		if err != nil {
+			return nil, err
+		}
+		c.Aliases = append(c.Aliases, path)
+	}
+	if elem.Modification.NewName != "" {
+		var err error
+		if c.Modification.NewName, err = conv(elem.Modification.NewName); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
@@ -0,0 +1,465 @@
+package repokeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltCacheFileExt - расширение файла кеша во встроенной базе данных.
+const BoltCacheFileExt = ".db"
+
+// boltCacheVersion - версия структуры базы данных кеша.
+// С версии 2 база содержит индекс идентификаторов каталогов, с версии 3 ключи индекса
+// начинаются с inode для поиска каталогов по inode без учета устройства.
+const boltCacheVersion = 3
+
+var (
+	boltMetaBucket  = []byte("meta")
+	boltNodesBucket = []byte("nodes")
+	boltIDsBucket   = []byte("ids")
+)
+
+// NodeStore предоставляет доступ на чтение к узлам кеша аудио каталогов.
+// Пути узлов - полные (с корнем репозитория).
+type NodeStore interface {
+	// Get возвращает узел кеша или ErrNodeNotFound при его отсутствии.
+	Get(path string) (*CacheElem, error)
+	// ForEach вызывает `fn` для всех узлов кеша.
+	ForEach(fn func(path string, elem *CacheElem) error) error
+	// FindID возвращает путь каталога с идентификатором `id` или пустую строку.
+	// Узлы без сохраненного устройства сопоставляются только по inode. Если каталог
+	// с тем же устройством не найден, возвращается единственный каталог с тем же inode
+	// и типом `kind` (например, после перемонтирования диска с другим номером устройства).
+	FindID(id FileID, kind NodeKind) (string, error)
+}
+
+// CacheBackend сохраняет кеш аудио каталогов между сессиями сервиса.
+type CacheBackend interface {
+	// Snapshot возвращает сохраненное в предыдущей сессии состояние кеша, которое
+	// не меняется при последующих сохранениях. Снимок освобождается closeSnapshot
+	// до закрытия хранилища. Ошибки соответствуют Entries.LoadFrom.
+	Snapshot() (NodeStore, error)
+	// Save сохраняет изменения кеша.
+	Save(ent *Entries) error
+	// Path возвращает путь к файлу кеша.
+	Path() string
+	Close() error
+}
+
+// jsonBackend хранит кеш в JSON-файле, перезаписываемом целиком.
+type jsonBackend struct {
+	fn      string
+	root    string
+	formats *FormatRegistry
+}
+
+// NewJSONBackend создает хранилище кеша в JSON-файле `fn`.
+func NewJSONBackend(fn, root string, formats *FormatRegistry) CacheBackend {
+	return &jsonBackend{fn: fn, root: root, formats: formats}
+}
+
+func (b *jsonBackend) Snapshot() (NodeStore, error) {
+	old := NewEntries(b.root, b.formats)
+	if err := old.LoadFrom(b.fn); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+func (b *jsonBackend) Save(ent *Entries) error {
+	return ent.SaveTo(b.fn)
+}
+
+func (b *jsonBackend) Path() string {
+	return b.fn
+}
+
+func (b *jsonBackend) Close() error {
+	return nil
+}
+
+// boltBackend хранит узлы кеша во встроенной базе данных (B+-дерево) по отдельным
+// ключам. Первое сохранение в сессии сверяет базу со всем кешем и записывает только
+// отличающиеся узлы, последующие - только измененные с предыдущего сохранения.
+// Рабочий кеш сессии (Entries) при этом целиком хранится в памяти, база данных
+// сокращает объем записи при сохранении и не требует загрузки предыдущего состояния
+// в память для сравнения (см. boltSnapshot).
+type boltBackend struct {
+	db      *bolt.DB
+	fn      string
+	root    string
+	formats *FormatRegistry
+	synced  bool
+}
+
+// OpenBoltBackend открывает (создает) хранилище кеша во встроенной базе данных `fn`.
+func OpenBoltBackend(fn, root string, formats *FormatRegistry) (CacheBackend, error) {
+	db, err := bolt.Open(fn, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{db: db, fn: fn, root: root, formats: formats}, nil
+}
+
+// boltMeta - заголовок базы данных кеша.
+type boltMeta struct {
+	Version        int       `json:"version"`
+	Root           string    `json:"root"`
+	Extensions     []string  `json:"extensions"`
+	CreatedAt      time.Time `json:"created_at"`
+	ServiceVersion string    `json:"service_version"`
+}
+
+func (b *boltBackend) Snapshot() (_ NodeStore, err error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	bucket := tx.Bucket(boltMetaBucket)
+	if bucket == nil || tx.Bucket(boltNodesBucket) == nil {
+		return nil, fmt.Errorf("%s: %w", b.fn, os.ErrNotExist)
+	}
+	var meta boltMeta
+	if err := json.Unmarshal(bucket.Get([]byte("header")), &meta); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCacheCorrupt, err)
+	}
+	switch {
+	case meta.Version < 1 || meta.Version > boltCacheVersion:
+		return nil, fmt.Errorf("%w: unsupported cache version %d", ErrCacheMismatch, meta.Version)
+	case meta.Root != b.root:
+		return nil, fmt.Errorf("%w: cache root %s", ErrCacheMismatch, meta.Root)
+	case strings.Join(meta.Extensions, " ") != strings.Join(b.formats.Extensions(), " "):
+		return nil, fmt.Errorf("%w: cache extensions %v", ErrCacheMismatch, meta.Extensions)
+	}
+	return &boltSnapshot{tx: tx, root: b.root, indexed: meta.Version >= 3}, nil
+}
+
+func (b *boltBackend) Save(ent *Entries) error {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if !b.synced {
+			return b.sync(tx, ent)
+		}
+		for path := range ent.dirty {
+			elem, ok := ent.Cache[path]
+			if !ok {
+				if err := deleteBoltNode(tx, ent.Root, path); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := putBoltNode(tx, ent.Root, path, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.synced = true
+	ent.resetChanges()
+	return nil
+}
+
+// sync приводит содержимое базы данных в соответствие с узлами `ent`: записывает
+// отличающиеся узлы и удаляет отсутствующие в `ent`. Индекс идентификаторов базы
+// данных предыдущих версий строится заново.
+func (b *boltBackend) sync(tx *bolt.Tx, ent *Entries) error {
+	if ent.createdAt.IsZero() {
+		ent.createdAt = time.Now().UTC()
+	}
+	meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+	if err != nil {
+		return err
+	}
+	var prev boltMeta
+	reindex := json.Unmarshal(meta.Get([]byte("header")), &prev) != nil ||
+		prev.Version < boltCacheVersion
+	if reindex && tx.Bucket(boltIDsBucket) != nil {
+		if err := tx.DeleteBucket(boltIDsBucket); err != nil {
+			return err
+		}
+	}
+	header, err := json.Marshal(&boltMeta{
+		Version:        boltCacheVersion,
+		Root:           ent.Root,
+		Extensions:     ent.formats.Extensions(),
+		CreatedAt:      ent.createdAt,
+		ServiceVersion: ServiceVersion})
+	if err != nil {
+		return err
+	}
+	if err := meta.Put([]byte("header"), header); err != nil {
+		return err
+	}
+	nodes, err := tx.CreateBucketIfNotExists(boltNodesBucket)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(boltIDsBucket); err != nil {
+		return err
+	}
+	var stale [][]byte
+	err = nodes.ForEach(func(k, _ []byte) error {
+		if _, ok := ent.Cache[absolutePath(ent.Root, string(k))]; !ok {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := unindexBoltNode(tx, key); err != nil {
+			return err
+		}
+		if err := nodes.Delete(key); err != nil {
+			return err
+		}
+	}
+	for path, elem := range ent.Cache {
+		if !reindex {
+			if same, err := boltNodeEqual(nodes, ent.Root, path, elem); err != nil {
+				return err
+			} else if same {
+				continue
+			}
+		}
+		if err := putBoltNode(tx, ent.Root, path, elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltNodeEqual проверяет, совпадает ли сохраненный в базе данных узел `path` с `elem`.
+func boltNodeEqual(nodes *bolt.Bucket, root, path string, elem *CacheElem) (bool, error) {
+	conv := func(path string) (string, error) {
+		return relativePath(root, path)
+	}
+	key, err := conv(path)
+	if err != nil {
+		return false, err
+	}
+	stored := nodes.Get([]byte(key))
+	if stored == nil {
+		return false, nil
+	}
+	if elem, err = mapElemPaths(elem, conv); err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(elem)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(stored, data), nil
+}
+
+// putBoltNode сохраняет узел и обновляет индекс идентификаторов.
+func putBoltNode(tx *bolt.Tx, root, path string, elem *CacheElem) error {
+	conv := func(path string) (string, error) {
+		return relativePath(root, path)
+	}
+	key, err := conv(path)
+	if err != nil {
+		return err
+	}
+	if err := unindexBoltNode(tx, []byte(key)); err != nil {
+		return err
+	}
+	if elem, err = mapElemPaths(elem, conv); err != nil {
+		return err
+	}
+	data, err := json.Marshal(elem)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltNodesBucket).Put([]byte(key), data); err != nil {
+		return err
+	}
+	return tx.Bucket(boltIDsBucket).Put(boltIDKey(elem.ID()), []byte(key))
+}
+
+// deleteBoltNode удаляет узел и его идентификатор из индекса.
+func deleteBoltNode(tx *bolt.Tx, root, path string) error {
+	key, err := relativePath(root, path)
+	if err != nil {
+		return err
+	}
+	if err := unindexBoltNode(tx, []byte(key)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltNodesBucket).Delete([]byte(key))
+}
+
+// unindexBoltNode удаляет из индекса идентификатор ранее сохраненного узла `key`,
+// если идентификатор не был переназначен другому узлу.
+func unindexBoltNode(tx *bolt.Tx, key []byte) error {
+	data := tx.Bucket(boltNodesBucket).Get(key)
+	if data == nil {
+		return nil
+	}
+	var elem CacheElem
+	if err := json.Unmarshal(data, &elem); err != nil {
+		return fmt.Errorf("%w: %v", ErrCacheCorrupt, err)
+	}
+	ids := tx.Bucket(boltIDsBucket)
+	idKey := boltIDKey(elem.ID())
+	if string(ids.Get(idKey)) != string(key) {
+		return nil
+	}
+	return ids.Delete(idKey)
+}
+
+// boltIDKey возвращает ключ индекса идентификаторов: inode, затем устройство.
+func boltIDKey(id FileID) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, id.Inode)
+	binary.BigEndian.PutUint64(key[8:], id.Device)
+	return key
+}
+
+func (b *boltBackend) Path() string {
+	return b.fn
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+// boltSnapshot читает узлы кеша из базы данных в транзакции чтения без загрузки всего
+// дерева в память. Транзакция фиксирует состояние базы данных на момент создания снимка
+// и удерживается до вызова Close; сохранения, увеличивающие файл базы данных, ожидают
+// ее завершения.
+// Транзакции bbolt не допускают параллельного использования, поэтому обращения
+// к снимку (например, из горутин сканирования) выполняются последовательно;
+// `fn` в ForEach не должна обращаться к снимку.
+// Для баз данных версии 1 поиск по идентификатору выполняется полным перебором узлов.
+type boltSnapshot struct {
+	mu      sync.Mutex
+	tx      *bolt.Tx
+	root    string
+	indexed bool
+}
+
+func (s *boltSnapshot) Get(path string) (*CacheElem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(path)
+}
+
+func (s *boltSnapshot) get(path string) (*CacheElem, error) {
+	key, err := relativePath(s.root, path)
+	if err != nil {
+		// путь вне корня репозитория в кеше отсутствует
+		return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, path)
+	}
+	data := s.tx.Bucket(boltNodesBucket).Get([]byte(key))
+	if data == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, path)
+	}
+	return s.decode(data)
+}
+
+func (s *boltSnapshot) ForEach(fn func(path string, elem *CacheElem) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forEach(fn)
+}
+
+func (s *boltSnapshot) forEach(fn func(path string, elem *CacheElem) error) error {
+	return s.tx.Bucket(boltNodesBucket).ForEach(func(k, data []byte) error {
+		elem, err := s.decode(data)
+		if err != nil {
+			return err
+		}
+		return fn(absolutePath(s.root, string(k)), elem)
+	})
+}
+
+func (s *boltSnapshot) FindID(id FileID, kind NodeKind) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candidates := make(map[string]*CacheElem)
+	if !s.indexed {
+		err := s.forEach(func(path string, elem *CacheElem) error {
+			if elem.Inode == id.Inode {
+				candidates[path] = elem
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		return matchID(id, kind, candidates), nil
+	}
+	prefix := boltIDKey(FileID{Inode: id.Inode})[:8]
+	c := s.tx.Bucket(boltIDsBucket).Cursor()
+	for k, key := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, key = c.Next() {
+		path := absolutePath(s.root, string(key))
+		elem, err := s.get(path)
+		if errors.Is(err, ErrNodeNotFound) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		candidates[path] = elem
+	}
+	return matchID(id, kind, candidates), nil
+}
+
+// Close завершает транзакцию чтения снимка.
+func (s *boltSnapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tx.Rollback()
+}
+
+// decode разбирает узел и возвращает его с полными путями.
+func (s *boltSnapshot) decode(data []byte) (*CacheElem, error) {
+	var elem CacheElem
+	if err := json.Unmarshal(data, &elem); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCacheCorrupt, err)
+	}
+	return mapElemPaths(&elem, func(path string) (string, error) {
+		return absolutePath(s.root, path), nil
+	})
+}
+
+// closeSnapshot освобождает снимок кеша `store`, полученный CacheBackend.Snapshot.
+func closeSnapshot(store NodeStore) error {
+	if c, ok := store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// entriesFromStore загружает все узлы хранилища в новый объект Entries.
+func entriesFromStore(store NodeStore, root string, formats *FormatRegistry) (*Entries, error) {
+	if ent, ok := store.(*Entries); ok {
+		return ent, nil
+	}
+	ent := NewEntries(root, formats)
+	err := store.ForEach(func(path string, elem *CacheElem) error {
+		ent.Cache[path] = elem
+		return nil
+	})
+	return ent, err
+}
@@ -0,0 +1,169 @@
+package repokeeper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltBackend(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/album1", "a/album2", "b/album3"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	fn := filepath.Join(t.TempDir(), "cache"+BoltCacheFileExt)
+	cache, err := OpenBoltBackend(fn, root, DefaultFormats())
+	require.NoError(t, err)
+	_, err = cache.Snapshot()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	ent := NewEntries(root, DefaultFormats())
+	require.NoError(t, ent.AddAlbumEntry(filepath.Join(root, "a/album1")))
+	require.NoError(t, ent.AddAlbumEntry(filepath.Join(root, "a/album2")))
+	require.NoError(t, cache.Save(ent))
+	assert.Zero(t, ent.Changes())
+
+	// инкрементальное сохранение изменений
+	require.NoError(t, ent.AddAlbumEntry(filepath.Join(root, "b/album3")))
+	ent.Delete(filepath.Join(root, "a/album2"))
+	require.NoError(t, cache.Save(ent))
+	require.NoError(t, cache.Close())
+
+	cache, err = OpenBoltBackend(fn, root, DefaultFormats())
+	require.NoError(t, err)
+	defer cache.Close()
+	snapshot, err := cache.Snapshot()
+	require.NoError(t, err)
+	elem, err := snapshot.Get(filepath.Join(root, "b/album3"))
+	require.NoError(t, err)
+	require.NotNil(t, elem)
+	assert.Equal(t, AlbumEntryNode, elem.Kind)
+	elem, err = snapshot.Get(filepath.Join(root, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(root, "a/album1")}, elem.Children)
+	_, err = snapshot.Get(filepath.Join(root, "a/album2"))
+	assert.ErrorIs(t, err, ErrNodeNotFound)
+	// индекс идентификаторов не содержит удаленных узлов
+	id, err := FileIdentity(filepath.Join(root, "a/album2"))
+	require.NoError(t, err)
+	path, err := snapshot.FindID(id, AlbumEntryNode)
+	require.NoError(t, err)
+	assert.Empty(t, path)
+	// поиск по inode после изменения номера устройства
+	id, err = FileIdentity(filepath.Join(root, "a/album1"))
+	require.NoError(t, err)
+	id.Device++
+	path, err = snapshot.FindID(id, AlbumEntryNode)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "a/album1"), path)
+	path, err = snapshot.FindID(id, IntermediateNode)
+	require.NoError(t, err)
+	assert.Empty(t, path)
+
+	changes, err := ent.Compare(snapshot)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// переименование между сессиями
+	require.NoError(t, os.Rename(filepath.Join(root, "b"), filepath.Join(root, "c")))
+	current := NewEntries(root, DefaultFormats())
+	require.NoError(t, current.AddAlbumEntry(filepath.Join(root, "a/album1")))
+	require.NoError(t, current.AddAlbumEntry(filepath.Join(root, "c/album3")))
+	changes, err = current.Compare(snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, RenamedFsChange, changes[filepath.Join(root, "b")].Change)
+	assert.Equal(t, filepath.Join(root, "c"), changes[filepath.Join(root, "b")].NewName)
+
+	// снимок не меняется при сохранении кеша новой сессии, первое сохранение
+	// удаляет отсутствующие в кеше узлы
+	saved := make(chan error)
+	go func() { saved <- cache.Save(current) }()
+	_, err = snapshot.Get(filepath.Join(root, "b/album3"))
+	assert.NoError(t, err)
+	_, err = snapshot.Get(filepath.Join(root, "c/album3"))
+	assert.ErrorIs(t, err, ErrNodeNotFound)
+	require.NoError(t, closeSnapshot(snapshot))
+	require.NoError(t, <-saved)
+	snapshot, err = cache.Snapshot()
+	require.NoError(t, err)
+	_, err = snapshot.Get(filepath.Join(root, "b/album3"))
+	assert.ErrorIs(t, err, ErrNodeNotFound)
+	elem, err = snapshot.Get(filepath.Join(root, "c/album3"))
+	require.NoError(t, err)
+	assert.Equal(t, AlbumEntryNode, elem.Kind)
+	changes, err = current.Compare(snapshot)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	require.NoError(t, closeSnapshot(snapshot))
+
+	other, err := OpenBoltBackend(filepath.Join(t.TempDir(), "other"), root, DefaultFormats())
+	require.NoError(t, err)
+	require.NoError(t, other.Save(ent))
+	require.NoError(t, other.Close())
+	other, err = OpenBoltBackend(other.Path(), filepath.Join(root, "a"), DefaultFormats())
+	require.NoError(t, err)
+	defer other.Close()
+	_, err = other.Snapshot()
+	assert.ErrorIs(t, err, ErrCacheMismatch)
+}
+
+func TestRepoKeeperBoltCacheSessions(t *testing.T) {
+	root, cacheDir := t.TempDir(), t.TempDir()
+	writeTestTracks(t, filepath.Join(root, "album1"), "01.flac")
+	writeTestTracks(t, filepath.Join(root, "album2"), "01.flac")
+	session := func() []string {
+		rk := NewWithRoots([]RootConfig{{Name: DefaultRootName, Dir: root}},
+			WithCacheDir(cacheDir), WithBoltCache())
+		var events []string
+		rk.emit = func(contentType string, data []byte) error {
+			events = append(events, string(data))
+			return nil
+		}
+		rk.applyChangesBetweenSessions()
+		for _, root := range rk.roots {
+			rk.closeRoot(root)
+		}
+		require.NoError(t, rk.w.Close())
+		return events
+	}
+	events := session()
+	assert.Empty(t, events)
+
+	// изменения между сессиями определяются по снимку базы данных
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "album2")))
+	events = session()
+	require.Len(t, events, 1)
+	assert.Equal(t, "dir deleted: default:album2", strings.Split(events[0], ";")[0])
+	events = session()
+	assert.Empty(t, events)
+}
+
+func TestEntriesScanBoltPrevious(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 64; i++ {
+		writeTestTracks(t, filepath.Join(root, fmt.Sprintf("album%02d", i)), "01.flac", "02.flac")
+	}
+	old := NewEntries(root, DefaultFormats())
+	require.NoError(t, old.Scan(context.Background(), root, ScanOptions{}))
+	cache, err := OpenBoltBackend(filepath.Join(t.TempDir(), "cache"+BoltCacheFileExt), root, DefaultFormats())
+	require.NoError(t, err)
+	defer cache.Close()
+	require.NoError(t, cache.Save(old))
+	snapshot, err := cache.Snapshot()
+	require.NoError(t, err)
+
+	// параллельное чтение снимка горутинами сканирования
+	ent := NewEntries(root, DefaultFormats())
+	require.NoError(t, ent.Scan(context.Background(), root, ScanOptions{Workers: 8, Previous: snapshot}))
+	require.NoError(t, closeSnapshot(snapshot))
+	assert.Len(t, ent.AlbumEntries(), 64)
+	changes, err := ent.Compare(old)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
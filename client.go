@@ -6,19 +6,31 @@ import (
 
 	"github.com/gofrs/uuid"
 
+	md "github.com/ytsiuryn/ds-audiomd"
 	srv "github.com/ytsiuryn/ds-microservice"
 )
 
 // AudioRepoRequest описывает формат запроса к менеджеру БД для аудио метаданных.
 type AudioRepoRequest struct {
-	Cmd  string `json:"cmd"`
-	Path string `json:"path,omitempty"`
+	Cmd       string      `json:"cmd"`
+	Path      string      `json:"path,omitempty"`
+	Target    string      `json:"target,omitempty"`
+	Job       string      `json:"job,omitempty"`
+	WriteTags bool        `json:"write_tags,omitempty"`
+	Release   *md.Release `json:"release,omitempty"`
 }
 
 // AudioRepoResponse описывает формат запроса к менеджеру БД для аудио метаданных.
+// `EntryID` содержит идентификатор Album Entry, к которому относится запрос.
+// `Leftover` содержит исходный каталог, не удаленный после перемещения Album Entry.
 type AudioRepoResponse struct {
 	*AudioRepoRequest
-	Error *srv.ErrorResponse `json:"error,omitempty"`
+	EntryID      string              `json:"entry_id,omitempty"`
+	Leftover     string              `json:"leftover,omitempty"`
+	RipQuality   *RipQualityReport   `json:"rip_quality,omitempty"`
+	Completeness *CompletenessReport `json:"completeness,omitempty"`
+	Entry        *EntryInfo          `json:"entry,omitempty"`
+	Error        *srv.ErrorResponse  `json:"error,omitempty"`
 }
 
 // Unwrap проверяется возвращает ли ответ описание ошибки и, если она есть,
@@ -52,6 +64,66 @@ func CreateEntryRequest(cmd, path string) (string, []byte, error) {
 	return correlationID.String(), data, nil
 }
 
+// CreateCompletenessRequest формирует данные запроса на проверку полноты альбома.
+// При пустом `release` используется описание релиза из каталога альбома (ReleaseSidecarFile).
+func CreateCompletenessRequest(path string, release *md.Release) (string, []byte, error) {
+	correlationID, _ := uuid.NewV4()
+	req := AudioRepoRequest{Cmd: "completeness", Path: path, Release: release}
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return "", nil, err
+	}
+	return correlationID.String(), data, nil
+}
+
+// CreateRelocateRequest формирует данные запроса на перенос кеша с прежнего корневого
+// каталога `oldDir` на текущий каталог корня репозитория `root`. Пустое имя корня
+// допускается для хранителя с единственным корнем.
+func CreateRelocateRequest(oldDir, root string) (string, []byte, error) {
+	correlationID, _ := uuid.NewV4()
+	req := AudioRepoRequest{Cmd: "relocate", Path: oldDir, Target: root}
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return "", nil, err
+	}
+	return correlationID.String(), data, nil
+}
+
+// CreateMoveRequest формирует данные запроса на перемещение каталога альбома `path`
+// в корень репозитория `root`.
+func CreateMoveRequest(path, root string) (string, []byte, error) {
+	correlationID, _ := uuid.NewV4()
+	req := AudioRepoRequest{Cmd: "move", Path: path, Target: root}
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return "", nil, err
+	}
+	return correlationID.String(), data, nil
+}
+
+// CreateLoudnessRequest формирует данные запроса на фоновое измерение громкости.
+// Пустой `path` означает обработку всех каталогов альбомов репозитория.
+func CreateLoudnessRequest(path string, writeTags bool) (string, []byte, error) {
+	correlationID, _ := uuid.NewV4()
+	req := AudioRepoRequest{Cmd: "loudness", Path: path, WriteTags: writeTags}
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return "", nil, err
+	}
+	return correlationID.String(), data, nil
+}
+
+// CreateCancelJobRequest формирует данные запроса на отмену фоновой задачи.
+func CreateCancelJobRequest(job string) (string, []byte, error) {
+	correlationID, _ := uuid.NewV4()
+	req := AudioRepoRequest{Cmd: "cancel_job", Job: job}
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return "", nil, err
+	}
+	return correlationID.String(), data, nil
+}
+
 // ParseRepoAnswer разбирает ответ по репозиторию.
 func ParseRepoAnswer(data []byte) (*AudioRepoRequest, error) {
 	req := AudioRepoRequest{}
@@ -60,3 +132,12 @@ func ParseRepoAnswer(data []byte) (*AudioRepoRequest, error) {
 	}
 	return &req, nil
 }
+
+// ParseRepoResponse разбирает полный ответ сервиса, включая результаты команд.
+func ParseRepoResponse(data []byte) (*AudioRepoResponse, error) {
+	resp := AudioRepoResponse{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,220 @@
+package repokeeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+// ReleaseSidecarFile - имя файла с JSON-описанием релиза (md.Release) в каталоге альбома.
+const ReleaseSidecarFile = "release.json"
+
+var (
+	discDirRe       = regexp.MustCompile(`(?i)^(?:cd|disc|disk|диск)\s*[-_.]?\s*(\d+)`)
+	discTrackFileRe = regexp.MustCompile(`^(\d{1,2})[-.](\d{1,3})\b`)
+	trackFileRe     = regexp.MustCompile(`^(\d{1,3})\b`)
+	trackPosRe      = regexp.MustCompile(`^(?:\d+[-.])?(\d+)$`)
+)
+
+// CompletenessReport описывает соответствие файлов каталога альбома списку треков релиза.
+// Позиции треков указываются в формате "диск-трек".
+// `Missing` - треки релиза без файлов, `Extra` - файлы без трека в релизе,
+// `Duplicates` - треки, которым соответствует несколько файлов,
+// `Gaps` - пропуски в нумерации файлов, `DiscMismatches` - файлы с номером диска,
+// отсутствующего в релизе.
+type CompletenessReport struct {
+	Path           string              `json:"path"`
+	Missing        []string            `json:"missing,omitempty"`
+	Extra          []string            `json:"extra,omitempty"`
+	Duplicates     map[string][]string `json:"duplicates,omitempty"`
+	Gaps           []string            `json:"gaps,omitempty"`
+	DiscMismatches []string            `json:"disc_mismatches,omitempty"`
+	Complete       bool                `json:"complete"`
+}
+
+type trackKey struct {
+	disc, track int
+}
+
+func (k trackKey) String() string {
+	return fmt.Sprintf("%d-%d", k.disc, k.track)
+}
+
+// LoadReleaseSidecar читает описание релиза из каталога альбома.
+func LoadReleaseSidecar(dir string) (*md.Release, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ReleaseSidecarFile))
+	if err != nil {
+		return nil, err
+	}
+	release := md.NewRelease()
+	if err := json.Unmarshal(data, release); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// ReleaseID возвращает идентификатор релиза во внешней БД в виде "<БД>:<идентификатор>".
+// Предпочтение отдается MusicBrainz, затем Discogs. Для релиза без идентификаторов
+// возвращает пустую строку.
+func ReleaseID(release *md.Release) string {
+	if release == nil || release.ReleaseStub == nil || len(release.IDs) == 0 {
+		return ""
+	}
+	for _, db := range []string{"musicbrainz", "discogs"} {
+		if id := release.IDs[db]; id != "" {
+			return db + ":" + id
+		}
+	}
+	dbs := make([]string, 0, len(release.IDs))
+	for db, id := range release.IDs {
+		if id != "" {
+			dbs = append(dbs, db)
+		}
+	}
+	if len(dbs) == 0 {
+		return ""
+	}
+	sort.Strings(dbs)
+	return dbs[0] + ":" + release.IDs[dbs[0]]
+}
+
+// CheckCompleteness проверяет наличие файлов для всех треков релиза в каталоге альбома.
+// Файлы сопоставляются с треками по имени файла из метаданных трека, а при его
+// отсутствии - по номеру диска (из имени подкаталога или префикса "1-01") и номеру трека.
+// Файлы, исключенные правилами `ignore`, не учитываются.
+func CheckCompleteness(dir string, release *md.Release, formats *FormatRegistry,
+	ignore *IgnoreRules) (*CompletenessReport, error) {
+	files, err := entryAudioFiles(dir, formats, ignore)
+	if err != nil {
+		return nil, err
+	}
+	report := &CompletenessReport{Path: dir, Duplicates: make(map[string][]string)}
+
+	expected := make(map[trackKey]bool)
+	byName := make(map[string]trackKey)
+	discs := make(map[int]bool)
+	seq := make(map[int]int)
+	for _, tr := range release.Tracks {
+		// для позиций вида "A1", "B2" (винил) номер трека определяется порядком в релизе
+		disc := md.DiscNumberByTrackPos(tr.Position)
+		seq[disc]++
+		key := trackKey{disc: disc, track: seq[disc]}
+		if m := trackPosRe.FindStringSubmatch(tr.Position); m != nil {
+			key.track, _ = strconv.Atoi(m[1])
+		}
+		expected[key] = true
+		discs[disc] = true
+		if tr.FileInfo != nil && tr.FileInfo.FileName != "" {
+			byName[filepath.Base(tr.FileInfo.FileName)] = key
+		}
+	}
+	multiDisc := len(discs) > 1
+
+	found := make(map[trackKey][]string)
+	numbered := make(map[int]map[int]bool)
+	for _, fn := range files {
+		key, ok := byName[filepath.Base(fn)]
+		if !ok {
+			if key, ok = fileTrackKey(fn, multiDisc); !ok {
+				report.Extra = append(report.Extra, fn)
+				continue
+			}
+		}
+		if numbered[key.disc] == nil {
+			numbered[key.disc] = make(map[int]bool)
+		}
+		numbered[key.disc][key.track] = true
+		if !discs[key.disc] {
+			report.DiscMismatches = append(report.DiscMismatches, fn)
+			continue
+		}
+		if !expected[key] {
+			report.Extra = append(report.Extra, fn)
+			continue
+		}
+		found[key] = append(found[key], fn)
+	}
+
+	for key := range expected {
+		switch matched := found[key]; {
+		case len(matched) == 0:
+			report.Missing = append(report.Missing, key.String())
+		case len(matched) > 1:
+			report.Duplicates[key.String()] = matched
+		}
+	}
+	for disc, nums := range numbered {
+		var last int
+		for n := range nums {
+			if n > last {
+				last = n
+			}
+		}
+		for n := 1; n < last; n++ {
+			if !nums[n] {
+				report.Gaps = append(report.Gaps, trackKey{disc: disc, track: n}.String())
+			}
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+	sort.Strings(report.Gaps)
+	sort.Strings(report.DiscMismatches)
+	if len(report.Duplicates) == 0 {
+		report.Duplicates = nil
+	}
+	report.Complete = len(report.Missing) == 0 && len(report.Extra) == 0 &&
+		len(report.Duplicates) == 0 && len(report.Gaps) == 0 && len(report.DiscMismatches) == 0
+	return report, nil
+}
+
+// fileTrackKey определяет номер диска и трека по пути к файлу относительно каталога альбома.
+func fileTrackKey(fn string, multiDisc bool) (trackKey, bool) {
+	key := trackKey{disc: 1}
+	if m := discDirRe.FindStringSubmatch(filepath.Base(filepath.Dir(fn))); m != nil {
+		key.disc, _ = strconv.Atoi(m[1])
+	}
+	name := filepath.Base(fn)
+	if m := discTrackFileRe.FindStringSubmatch(name); m != nil && (multiDisc || len(m[2]) >= 2) {
+		key.disc, _ = strconv.Atoi(m[1])
+		key.track, _ = strconv.Atoi(m[2])
+		return key, true
+	}
+	if m := trackFileRe.FindStringSubmatch(name); m != nil {
+		key.track, _ = strconv.Atoi(m[1])
+		// нумерация вида "101", "212" для многодисковых изданий
+		if multiDisc && len(m[1]) == 3 && key.disc == 1 {
+			key.disc, key.track = key.track/100, key.track%100
+		}
+		return key, true
+	}
+	return key, false
+}
+
+// entryAudioFiles возвращает относительные пути аудиофайлов каталога альбома
+// (по расширению без учета регистра).
+func entryAudioFiles(dir string, formats *FormatRegistry, ignore *IgnoreRules) (files []string, err error) {
+	err = ignore.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || formats.ByExtension(path) == nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	sort.Strings(files)
+	return
+}
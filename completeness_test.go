@@ -0,0 +1,79 @@
+package repokeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+func testRelease(positions ...string) *md.Release {
+	release := md.NewRelease()
+	for _, pos := range positions {
+		track := md.NewTrack()
+		track.Position = pos
+		release.Tracks = append(release.Tracks, track)
+	}
+	return release
+}
+
+func touchFiles(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		fn := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fn), 0755))
+		require.NoError(t, ioutil.WriteFile(fn, nil, 0644))
+	}
+}
+
+func TestCheckCompleteness(t *testing.T) {
+	dir := t.TempDir()
+	touchFiles(t, dir, "01 - a.flac", "02 - b.flac", "03 - c.flac", "cover.jpg")
+	report, err := CheckCompleteness(dir, testRelease("1", "2", "3"), DefaultFormats(), nil)
+	require.NoError(t, err)
+	assert.True(t, report.Complete)
+
+	report, err = CheckCompleteness(dir, testRelease("1", "2", "3", "4"), DefaultFormats(), nil)
+	require.NoError(t, err)
+	assert.False(t, report.Complete)
+	assert.Equal(t, []string{"1-4"}, report.Missing)
+
+	touchFiles(t, dir, "05 - e.flac", "03 - c (copy).flac")
+	report, err = CheckCompleteness(dir, testRelease("1", "2", "3", "4", "5"), DefaultFormats(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1-4"}, report.Missing)
+	assert.Equal(t, []string{"1-4"}, report.Gaps)
+	assert.Len(t, report.Duplicates["1-3"], 2)
+}
+
+func TestCheckCompletenessMultiDisc(t *testing.T) {
+	dir := t.TempDir()
+	touchFiles(t, dir, "CD1/01.flac", "CD1/02.flac", "CD2/01.flac", "CD3/01.flac")
+	report, err := CheckCompleteness(dir, testRelease("1-1", "1-2", "2-1"), DefaultFormats(), nil)
+	require.NoError(t, err)
+	assert.False(t, report.Complete)
+	assert.Empty(t, report.Missing)
+	assert.Equal(t, []string{filepath.Join("CD3", "01.flac")}, report.DiscMismatches)
+
+	dir = t.TempDir()
+	touchFiles(t, dir, "1-01 a.flac", "1-02 b.flac", "2-01 c.flac", "notes.flac")
+	report, err = CheckCompleteness(dir, testRelease("1-1", "1-2", "2-1"), DefaultFormats(), nil)
+	require.NoError(t, err)
+	assert.Empty(t, report.Missing)
+	assert.Equal(t, []string{"notes.flac"}, report.Extra)
+}
+
+func TestReleaseID(t *testing.T) {
+	release := testRelease("1")
+	assert.Empty(t, ReleaseID(release))
+	release.IDs["tidal"] = "7"
+	release.IDs["deezer"] = "5"
+	assert.Equal(t, "deezer:5", ReleaseID(release))
+	release.IDs["discogs"] = "3"
+	assert.Equal(t, "discogs:3", ReleaseID(release))
+	release.IDs["musicbrainz"] = "1"
+	assert.Equal(t, "musicbrainz:1", ReleaseID(release))
+}
@@ -0,0 +1,106 @@
+package repokeeper
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Файлы-маркеры каталогов репозитория: каталог с AlbumMarkerFile является Album Entry
+// независимо от содержимого, каталог с SkipMarkerFile не является Album Entry ни при
+// каких условиях (его подкаталоги просматриваются). SkipMarkerFile имеет приоритет.
+const (
+	AlbumMarkerFile = ".album"
+	SkipMarkerFile  = ".repo-skip"
+)
+
+// DetectionRules задает правила распознавания Album Entry.
+// Каталог без файлов-маркеров считается Album Entry при наличии не менее `MinTracks`
+// аудиофайлов (не менее одного, если не задано). Подкаталоги с именами по шаблонам
+// `SkipDirs` (filepath.Match без учета регистра), например каталоги с сэмплами или
+// дополнительными материалами альбома, не являются Album Entry и не просматриваются,
+// но, в отличие от IgnoreRules, не исключаются из обработки командами.
+type DetectionRules struct {
+	MinTracks int
+	SkipDirs  []string
+}
+
+// DefaultDetectionRules - правила распознавания Album Entry хранителя по умолчанию.
+// Подкаталоги по умолчанию не пропускаются.
+var DefaultDetectionRules = DetectionRules{MinTracks: 1}
+
+// ExtrasSkipDirs - шаблоны SkipDirs для каталогов с сэмплами и дополнительными
+// материалами альбомов, подключаемые явно через WithDetectionRules.
+var ExtrasSkipDirs = []string{"sample", "samples", "extras"}
+
+func (r *DetectionRules) minTracks() int {
+	if r.MinTracks < 1 {
+		return 1
+	}
+	return r.MinTracks
+}
+
+// skipDir проверяет соответствие имени каталога `dir` шаблонам SkipDirs.
+func (r *DetectionRules) skipDir(dir string) bool {
+	name := strings.ToLower(filepath.Base(dir))
+	for _, pattern := range r.SkipDirs {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dirMarker возвращает имя файла-маркера из содержимого каталога или пустую строку.
+func dirMarker(files []fs.DirEntry) string {
+	var ret string
+	for _, f := range files {
+		switch f.Name() {
+		case SkipMarkerFile:
+			return SkipMarkerFile
+		case AlbumMarkerFile:
+			ret = AlbumMarkerFile
+		}
+	}
+	return ret
+}
+
+// IsAlbumDir проверяет, является ли каталог `dir` Album Entry по правилам Detection,
+// в том числе с учетом имен его родительских каталогов внутри корня.
+func (ent *Entries) IsAlbumDir(dir string) (bool, error) {
+	for d := dir; len(d) > ent.rootLen; d = filepath.Dir(d) {
+		if ent.Detection.skipDir(d) {
+			return false, nil
+		}
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	switch dirMarker(files) {
+	case SkipMarkerFile:
+		return false, nil
+	case AlbumMarkerFile:
+		return true, nil
+	}
+	tracks := 0
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if f.IsDir() || f.Type()&fs.ModeSymlink != 0 && ent.Symlinks != FollowSymlinks {
+			continue
+		}
+		if f.Type()&fs.ModeSymlink != 0 {
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+		}
+		if ent.Ignore.match(path, false) || !ent.isSupportedAudio(path) {
+			continue
+		}
+		if tracks++; tracks >= ent.Detection.minTracks() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,105 @@
+package repokeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestTracks(t *testing.T, dir string, names ...string) {
+	flac, err := ioutil.ReadFile("testdata/repo/flac/flac/test.flac")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	for _, name := range names {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), flac, 0644))
+	}
+}
+
+func TestEntriesDetectionRules(t *testing.T) {
+	root := t.TempDir()
+	writeTestTracks(t, filepath.Join(root, "single"), "01.flac")
+	writeTestTracks(t, filepath.Join(root, "album"), "01.flac", "02.flac")
+	writeTestTracks(t, filepath.Join(root, "release", "Sample"), "01.flac", "02.flac")
+	writeTestTracks(t, filepath.Join(root, "skipped"), "01.flac", "02.flac")
+	writeTestTracks(t, filepath.Join(root, "skipped", "cd1"), "01.flac", "02.flac")
+	writeTestTracks(t, filepath.Join(root, "marked"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "skipped", SkipMarkerFile), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "marked", AlbumMarkerFile), nil, 0644))
+
+	ent := NewEntries(root, DefaultFormats())
+	ent.Detection = DetectionRules{MinTracks: 2, SkipDirs: []string{"sample*"}}
+	require.NoError(t, ent.Calculate(root))
+	assert.Equal(t, []string{
+		filepath.Join(root, "album"),
+		filepath.Join(root, "marked"),
+		filepath.Join(root, "skipped", "cd1")}, ent.AlbumEntries())
+
+	for dir, expected := range map[string]bool{
+		"single":         false,
+		"album":          true,
+		"release/Sample": false,
+		"skipped":        false,
+		"marked":         true,
+	} {
+		album, err := ent.IsAlbumDir(filepath.Join(root, dir))
+		require.NoError(t, err)
+		assert.Equal(t, expected, album, dir)
+	}
+}
+
+func TestRepoKeeperDetectEntry(t *testing.T) {
+	root := t.TempDir()
+	rk := newTestKeeper(t, root)
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		events = append(events, string(data))
+		return nil
+	}
+	dir := filepath.Join(root, "album")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	rk.applyChangesBetweenSessions()
+
+	// каталог с маркером распознается после завершения копирования аудиофайлов
+	marker := filepath.Join(dir, AlbumMarkerFile)
+	require.NoError(t, ioutil.WriteFile(marker, nil, 0644))
+	writeTestTracks(t, dir, "01.flac")
+	rk.onFsEvent(fsnotify.Event{Name: marker, Op: fsnotify.Create})
+	rk.onFsEvent(fsnotify.Event{Name: filepath.Join(dir, "01.flac"), Op: fsnotify.Create})
+	assert.Empty(t, events)
+	rk.settlePending(time.Now().Add(rk.settleDelay))
+	elem, err := rk.roots[0].entries.Get(dir)
+	require.NoError(t, err)
+	assert.Len(t, elem.Files, 1)
+	created := "dir created: default:album; tracks=1; id=" + elem.EntryID
+	assert.Equal(t, []string{created}, events)
+	rk.settleDelay = 0
+
+	skip := filepath.Join(dir, SkipMarkerFile)
+	require.NoError(t, ioutil.WriteFile(skip, nil, 0644))
+	rk.onFsEvent(fsnotify.Event{Name: skip, Op: fsnotify.Create})
+	assert.Equal(t, []string{created, "dir deleted: default:album; id=" + elem.EntryID}, events)
+	assert.False(t, rk.roots[0].entries.IsAlbumEntry(dir))
+
+	// удаление маркера SkipMarkerFile
+	events = nil
+	require.NoError(t, os.Remove(skip))
+	rk.onFsEvent(fsnotify.Event{Name: skip, Op: fsnotify.Remove})
+	assert.True(t, rk.roots[0].entries.IsAlbumEntry(dir))
+	require.Len(t, events, 1)
+	assert.Contains(t, events[0], "dir created: default:album; tracks=1; id=")
+
+	// каталог только с маркером
+	events = nil
+	marked := filepath.Join(root, "marked")
+	require.NoError(t, os.Mkdir(marked, 0755))
+	marker = filepath.Join(marked, AlbumMarkerFile)
+	require.NoError(t, ioutil.WriteFile(marker, nil, 0644))
+	rk.onFsEvent(fsnotify.Event{Name: marker, Op: fsnotify.Create})
+	assert.Equal(t, []string{"dir created: default:marked; id=" + rk.entryID(marked)}, events)
+}
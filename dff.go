@@ -0,0 +1,145 @@
+package repokeeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+// dffHeaderSize - размер заголовка FRM8 файла DSDIFF вместе с типом формы.
+const dffHeaderSize = 16
+
+// walkDFFChunks перебирает блоки DSDIFF (64-битный размер) в данных `r`, начиная
+// с `offset`, пока `fn` возвращает true.
+func walkDFFChunks(r io.ReaderAt, offset, end int64,
+	fn func(id string, chunk *io.SectionReader) (bool, error)) error {
+	for offset+12 <= end {
+		var hdr [12]byte
+		if _, err := r.ReadAt(hdr[:], offset); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint64(hdr[4:]))
+		if size < 0 {
+			return errors.New("invalid DSDIFF chunk")
+		}
+		if ok, err := fn(string(hdr[:4]), io.NewSectionReader(r, offset+12, size)); !ok || err != nil {
+			return err
+		}
+		offset += 12 + size + size&1
+	}
+	return nil
+}
+
+// walkDFFFile перебирает блоки верхнего уровня файла DSDIFF.
+func walkDFFFile(path string, fn func(id string, chunk *io.SectionReader) (bool, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return walkDFFChunks(f, dffHeaderSize, fi.Size(), fn)
+}
+
+// readDFFProperties читает блок PROP и размер звуковых данных файла DSDIFF.
+// Для сжатых файлов (DST) длительность вычисляется по числу кадров.
+func readDFFProperties(path string) (*md.AudioInfo, error) {
+	ai := &md.AudioInfo{SampleSize: 1}
+	var samples int64
+	err := walkDFFFile(path, func(id string, chunk *io.SectionReader) (bool, error) {
+		switch id {
+		case "PROP":
+			return true, walkDFFChunks(chunk, 4, chunk.Size(), func(id string, prop *io.SectionReader) (bool, error) {
+				var buf [4]byte
+				switch id {
+				case "FS  ":
+					if _, err := prop.ReadAt(buf[:], 0); err != nil {
+						return false, err
+					}
+					ai.Samplerate = int(binary.BigEndian.Uint32(buf[:]))
+				case "CHNL":
+					if _, err := prop.ReadAt(buf[:2], 0); err != nil {
+						return false, err
+					}
+					ai.Channels = int(binary.BigEndian.Uint16(buf[:]))
+				}
+				return true, nil
+			})
+		case "DSD ":
+			if ai.Channels > 0 {
+				samples = chunk.Size() * 8 / int64(ai.Channels)
+			}
+			return false, nil
+		case "DST ":
+			return false, walkDFFChunks(chunk, 0, chunk.Size(), func(id string, frte *io.SectionReader) (bool, error) {
+				if id != "FRTE" {
+					return true, nil
+				}
+				var buf [6]byte
+				if _, err := frte.ReadAt(buf[:], 0); err != nil {
+					return false, err
+				}
+				if rate := int64(binary.BigEndian.Uint16(buf[4:])); rate > 0 {
+					samples = int64(binary.BigEndian.Uint32(buf[:])) * int64(ai.Samplerate) / rate
+				}
+				return false, nil
+			})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ai.Samplerate == 0 || ai.Channels == 0 {
+		return nil, errors.New("DSDIFF PROP chunk is missing")
+	}
+	return ai, setAvgBitrate(ai, path, samples)
+}
+
+// readDFFTags читает исполнителя и название из блока DIIN и тег ID3v2 из
+// нестандартного блока "ID3 " файла DSDIFF.
+func readDFFTags(path string) (map[string]string, error) {
+	tags := make(map[string]string)
+	err := walkDFFFile(path, func(id string, chunk *io.SectionReader) (bool, error) {
+		switch id {
+		case "ID3 ":
+			_, err := readID3v2Tags(chunk, 0, tags)
+			return err == nil, err
+		case "DIIN":
+			return true, walkDFFChunks(chunk, 0, chunk.Size(), func(id string, info *io.SectionReader) (bool, error) {
+				key := map[string]string{"DIAR": "ARTIST", "DITI": "TITLE"}[id]
+				if key == "" || info.Size() < 4 {
+					return true, nil
+				}
+				data := make([]byte, info.Size())
+				if _, err := info.ReadAt(data, 0); err != nil {
+					return false, err
+				}
+				// длина текста и текст
+				n := int(binary.BigEndian.Uint32(data))
+				if n > len(data)-4 {
+					n = len(data) - 4
+				}
+				if value := strings.TrimSpace(string(data[4 : 4+n])); value != "" {
+					addTag(tags, key, value)
+				}
+				return true, nil
+			})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
@@ -1,14 +1,21 @@
 package repokeeper
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/ytsiuryn/go-collection"
 )
 
@@ -20,139 +27,509 @@ const (
 	CreatedFsChange FsChange = iota + 1
 	RenamedFsChange
 	DeletedFsChange
+	ModifiedFsChange
+	MovedFsChange
+)
+
+// relocateSamples - число каталогов, проверяемых при переносе кеша на новый корень.
+const relocateSamples = 16
+
+// ErrNodeNotFound возвращается при обращении к отсутствующему в кеше каталогу.
+var ErrNodeNotFound = errors.New("cache node not found")
+
+// ErrRelocationMismatch возвращается, если новый корневой каталог не соответствует кешу.
+var ErrRelocationMismatch = errors.New("repository root does not match cache")
+
+// NodeKind - тип каталогового узла в кеше.
+type NodeKind uint8
+
+// Типы каталоговых узлов. Нулевое значение соответствует кешу старого формата,
+// в котором тип узла не сохранялся.
+const (
+	RootNode NodeKind = iota + 1
+	IntermediateNode
+	AlbumEntryNode
 )
 
 // DirModification описывает изменение конкретного каталога.
+// `Kind` содержит тип узла, к которому относится изменение.
+// `Tracks` содержит изменения файлов треков Album Entry (для переименованного или
+// модифицированного каталога), `EntryID` - идентификатор Album Entry.
+// Для Album Entry, перемещенного с заменой каталога ФС и опознанного по содержимому
+// (MovedFsChange), `Confidence` содержит степень совпадения списков аудиофайлов,
+// а `EntryID` - идентификатор удаленного Album Entry.
 type DirModification struct {
-	Change  FsChange `json:"change,omitempty"`
-	NewName string   `json:"new_name"`
+	Change     FsChange            `json:"change,omitempty"`
+	NewName    string              `json:"new_name"`
+	Kind       NodeKind            `json:"kind,omitempty"`
+	Tracks     []TrackModification `json:"tracks,omitempty"`
+	EntryID    string              `json:"entry_id,omitempty"`
+	Confidence float64             `json:"confidence,omitempty"`
 }
 
 // CacheElem описывает каталоговый узел для Album Entry и его родительских каталогов
 // в кеше сервиса.
-// `Inode` содержит числовой идентификатор каталога в ФС.
+// `Inode` и `Device` содержат числовой идентификатор каталога и устройства в ФС.
+// `Kind` содержит тип узла: корень репозитория, промежуточный каталог или Album Entry.
 // `Modification` содержит последнее обнаруженное изменение. Значение снимается только,
 // когда сообщение об изменении было успешно передано подписчику.
 // `Children` содержит дочерние пути каталогов, которые ведут к Album Entry.
+// `Files` содержит список аудиофайлов Album Entry.
+// `Aliases` содержит другие пути к тому же каталогу (символические ссылки, точки
+// bind-монтирования).
+// `EntryID` содержит UUID Album Entry, назначаемый при его обнаружении и сохраняемый
+// при переименовании и перемещении каталога, `State` - состояние Album Entry.
 type CacheElem struct {
 	Inode        uint64          `json:"inode"`
+	Device       uint64          `json:"device,omitempty"`
+	Kind         NodeKind        `json:"kind,omitempty"`
 	Modification DirModification `json:"modification,omitempty"`
-	isAlbumEntry bool
-	Children     []string `json:"children,omitempty"`
+	Children     []string        `json:"children,omitempty"`
+	Files        []TrackFile     `json:"files,omitempty"`
+	Aliases      []string        `json:"aliases,omitempty"`
+	EntryID      string          `json:"entry_id,omitempty"`
+	State        *EntryState     `json:"state,omitempty"`
+}
+
+// EntryState описывает состояние Album Entry, сохраняемое в кеше и, при включенном
+// хранении в расширенных атрибутах, в атрибутах каталога.
+// `Normalized` - признак нормализованного каталога, `VerifiedAt` - время последней
+// проверки альбома на соответствие релизу, `ReleaseID` - идентификатор релиза
+// в online БД в виде "<БД>:<идентификатор>".
+type EntryState struct {
+	Normalized bool      `json:"normalized,omitempty"`
+	VerifiedAt time.Time `json:"verified_at"`
+	ReleaseID  string    `json:"release_id,omitempty"`
+}
+
+// ID возвращает идентификатор каталога в ФС.
+func (elem *CacheElem) ID() FileID {
+	return FileID{Device: elem.Device, Inode: elem.Inode}
+}
+
+func (elem *CacheElem) clone() *CacheElem {
+	c := *elem
+	c.Children = append([]string(nil), elem.Children...)
+	c.Aliases = append([]string(nil), elem.Aliases...)
+	c.Files = append([]TrackFile(nil), elem.Files...)
+	if elem.State != nil {
+		state := *elem.State
+		c.State = &state
+	}
+	return &c
+}
+
+// FileID идентифицирует файловый объект в пределах всех смонтированных ФС.
+// Нулевое значение `Device` соответствует кешу, в котором устройство не сохранялось.
+type FileID struct {
+	Device uint64
+	Inode  uint64
+}
+
+// EntryInfo описывает каталог репозитория в ответе на команду entry_info.
+// `Path` содержит основной путь каталога, даже если запрошен один из его псевдонимов,
+// `State` - состояние Album Entry.
+type EntryInfo struct {
+	Path    string      `json:"path"`
+	Kind    NodeKind    `json:"kind"`
+	Aliases []string    `json:"aliases,omitempty"`
+	Files   []TrackFile `json:"files,omitempty"`
+	State   *EntryState `json:"state,omitempty"`
 }
 
 // Entries хранит состояние объекта кеша аудио каталогов.
 // В `Cache` хранит только информацию об Album Entry и их родительских каталогах.
+// Аудиофайлы распознаются по содержимому форматами из реестра `formats`.
+// `TrackHashes` включает вычисление хешей содержимого файлов треков, `Ignore` задает
+// правила исключения файлов и каталогов из сканирования, `Symlinks` - обработку
+// символических ссылок, `Detection` - правила распознавания Album Entry.
+// `Xattrs` включает хранение идентификаторов и состояния Album Entry в расширенных
+// атрибутах каталогов (при поддержке ФС).
+// Методы Entries безопасны для одновременного использования из нескольких горутин,
+// непосредственное обращение к `Cache` допустимо только при отсутствии такого доступа.
 type Entries struct {
-	Root       string                `json:"root"`
-	Cache      map[string]*CacheElem `json:"cache"`
-	Extensions []string              `json:"extensions"`
-	rootLen    int
+	Root        string                `json:"root"`
+	Cache       map[string]*CacheElem `json:"cache"`
+	TrackHashes bool                  `json:"-"`
+	Ignore      *IgnoreRules          `json:"-"`
+	Symlinks    SymlinkPolicy         `json:"-"`
+	Detection   DetectionRules        `json:"-"`
+	Xattrs      bool                  `json:"-"`
+	mu          sync.RWMutex
+	formats     *FormatRegistry
+	rootLen     int
+	createdAt   time.Time
+	changes     int
+	dirty       map[string]bool
+	byInode     map[uint64][]string
+	byEntryID   map[string]string
 }
 
 // NewEntries создает объект для формирования кеша аудио каталогов.
-func NewEntries(root string, extensions []string) *Entries {
+func NewEntries(root string, formats *FormatRegistry) *Entries {
+	root = filepath.Clean(root)
 	return &Entries{
-		Root:       root,
-		Cache:      make(map[string]*CacheElem),
-		Extensions: extensions,
-		rootLen:    len(root)}
+		Root:    root,
+		Cache:   make(map[string]*CacheElem),
+		formats: formats,
+		rootLen: len(root)}
 }
 
 // Calculate пересчитывает кеш аудио каталогов.
-func (ent *Entries) Calculate(dir string) (err error) {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return
-	}
-	for _, info := range files {
-		if info.IsDir() {
-			if err = ent.Calculate(filepath.Join(dir, info.Name())); err != nil {
-				return
-			}
-		} else {
-			if ent.isSupportedAudio(info.Name()) {
-				err = ent.AddAlbumEntry(dir)
-				break
-			}
-		}
-	}
-	return
+func (ent *Entries) Calculate(dir string) error {
+	return ent.Scan(context.Background(), dir, ScanOptions{})
 }
 
 // Add рекурсивно добавляет аудио каталог и всех его родителей в кеш дерева.
 func (ent *Entries) Add(dir string) (*CacheElem, error) {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	return ent.add(dir)
+}
+
+func (ent *Entries) add(dir string) (*CacheElem, error) {
 	if ret, ok := ent.Cache[dir]; ok {
 		return ret, nil
 	}
-	inode, err := Inode(dir)
+	id, err := FileIdentity(dir)
 	if err != nil {
 		return nil, err
 	}
-	ent.Cache[dir] = &CacheElem{Inode: inode}
+	elem := &CacheElem{Inode: id.Inode, Device: id.Device, Kind: IntermediateNode}
+	if dir == ent.Root {
+		elem.Kind = RootNode
+	}
+	ent.Cache[dir] = elem
+	ent.touch(dir)
 	parent := filepath.Dir(dir)
 	for ; len(parent) >= ent.rootLen; parent = filepath.Dir(dir) {
 		if _, ok := ent.Cache[parent]; !ok {
-			if _, err := ent.Add(parent); err != nil {
+			if _, err := ent.add(parent); err != nil {
 				return nil, err
 			}
 		}
 		if !collection.ContainsStr(dir, ent.Cache[parent].Children) {
 			ent.Cache[parent].Children = append(ent.Cache[parent].Children, dir)
+			ent.touch(parent)
 		}
 		dir = parent
 	}
-	return ent.Cache[dir], nil
+	return elem, nil
 }
 
 // AddAlbumEntry рекурсивно добавляет аудио каталог и всех его родителей в кеш дерева
 // и устанавливает признак каталога как Album Entry.
+// Список аудиофайлов уже добавленного Album Entry обновляется.
+// Новому Album Entry назначаются идентификатор и состояние из расширенных атрибутов
+// каталога или, при их отсутствии, новый UUID.
 func (ent *Entries) AddAlbumEntry(audioDir string) error {
-	elem, err := ent.Add(audioDir)
+	return ent.addAlbumDir(audioDir, ent.files(audioDir), true)
+}
+
+// UpdateAlbumEntry добавляет или обновляет Album Entry, как AddAlbumEntry, но
+// не вычисляет хеши новых и измененных аудиофайлов (см. HashTracks).
+func (ent *Entries) UpdateAlbumEntry(audioDir string) error {
+	return ent.addAlbumDir(audioDir, ent.files(audioDir), false)
+}
+
+// files возвращает копию списка аудиофайлов каталога `dir` в кеше.
+func (ent *Entries) files(dir string) []TrackFile {
+	if elem, err := ent.Get(dir); err == nil {
+		return elem.Files
+	}
+	return nil
+}
+
+// addAlbumDir добавляет Album Entry со списком аудиофайлов, неизмененные файлы
+// которого берутся из списка `prev` (см. readInventory).
+func (ent *Entries) addAlbumDir(audioDir string, prev []TrackFile, hash bool) error {
+	files, err := ent.readInventory(audioDir, prev, hash)
 	if err != nil {
 		return err
 	}
-	elem.isAlbumEntry = true
+	return ent.setAlbumFiles(audioDir, files)
+}
+
+// setAlbumFiles добавляет Album Entry с готовым списком аудиофайлов `files`.
+func (ent *Entries) setAlbumFiles(audioDir string, files []TrackFile) error {
+	var stored string
+	var state *EntryState
+	if ent.Xattrs {
+		stored, state = readEntryXattrs(audioDir)
+	}
+	id, generated, err := ent.addAlbumEntry(audioDir, files, stored, state)
+	if err != nil {
+		return err
+	}
+	if generated && ent.Xattrs {
+		writeEntryXattrs(audioDir, id, nil)
+	}
 	return nil
 }
 
+func (ent *Entries) addAlbumEntry(audioDir string, files []TrackFile,
+	stored string, state *EntryState) (id string, generated bool, err error) {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	elem, err := ent.add(audioDir)
+	if err != nil {
+		return "", false, err
+	}
+	if elem.Kind != AlbumEntryNode || !reflect.DeepEqual(elem.Files, files) {
+		elem.Kind = AlbumEntryNode
+		elem.Files = files
+		ent.touch(audioDir)
+	}
+	if elem.EntryID == "" {
+		if stored != "" && ent.entryIDOwner(stored, audioDir) != "" {
+			// расширенные атрибуты скопированы вместе с каталогом (cp -a, rsync -X)
+			stored = ""
+		}
+		if elem.EntryID = stored; stored == "" {
+			elem.EntryID, generated = newEntryID(), true
+		}
+		elem.State = state
+		ent.indexEntryID(elem.EntryID, audioDir)
+		ent.touch(audioDir)
+	}
+	return elem.EntryID, generated, nil
+}
+
+// SetEntryID заменяет идентификатор и состояние Album Entry `dir`, например при его
+// перемещении между корнями репозитория. Пустое состояние не изменяется.
+// Другой существующий Album Entry с тем же идентификатором (копия каталога)
+// получает новый идентификатор.
+func (ent *Entries) SetEntryID(dir, id string, state *EntryState) {
+	ent.mu.Lock()
+	elem, ok := ent.Cache[dir]
+	var copyDir, copyID string
+	if ok {
+		if copyDir = ent.entryIDOwner(id, dir); copyDir != "" {
+			copyID = newEntryID()
+			ent.Cache[copyDir].EntryID = copyID
+			ent.indexEntryID(copyID, copyDir)
+			ent.touch(copyDir)
+		}
+		elem.EntryID = id
+		if state != nil {
+			elem.State = state
+		}
+		ent.indexEntryID(id, dir)
+		ent.touch(dir)
+	}
+	ent.mu.Unlock()
+	if ok && ent.Xattrs {
+		writeEntryXattrs(dir, id, state)
+		if copyDir != "" {
+			writeEntryXattrs(copyDir, copyID, nil)
+		}
+	}
+}
+
+// entryIDOwner возвращает путь другого, существующего на диске Album Entry
+// с идентификатором `id` или пустую строку, если каталог-владелец идентификатора
+// удален или перемещен. Индекс идентификаторов строится при первом поиске.
+func (ent *Entries) entryIDOwner(id, dir string) string {
+	if ent.byEntryID == nil {
+		ent.byEntryID = make(map[string]string)
+		for path, elem := range ent.Cache {
+			if elem.EntryID != "" {
+				ent.byEntryID[elem.EntryID] = path
+			}
+		}
+	}
+	path, ok := ent.byEntryID[id]
+	if !ok || path == dir {
+		return ""
+	}
+	if elem, ok := ent.Cache[path]; !ok || elem.EntryID != id {
+		delete(ent.byEntryID, id)
+		return ""
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func (ent *Entries) indexEntryID(id, dir string) {
+	if ent.byEntryID != nil {
+		ent.byEntryID[id] = dir
+	}
+}
+
+// UpdateEntryState изменяет состояние Album Entry `dir` функцией `update`.
+func (ent *Entries) UpdateEntryState(dir string, update func(state *EntryState)) error {
+	ent.mu.Lock()
+	elem, ok := ent.Cache[dir]
+	if !ok || elem.Kind != AlbumEntryNode {
+		ent.mu.Unlock()
+		return fmt.Errorf("album entry not found: %s", dir)
+	}
+	state := EntryState{}
+	if elem.State != nil {
+		state = *elem.State
+	}
+	update(&state)
+	elem.State = &state
+	ent.touch(dir)
+	ent.mu.Unlock()
+	if ent.Xattrs {
+		writeEntryXattrs(dir, "", &state)
+	}
+	return nil
+}
+
+// InheritEntryIDs переносит идентификаторы и состояние Album Entry из предыдущего
+// снимка кеша `old`: они наследуются от Album Entry того же каталога ФС (в том числе
+// переименованного) или, если каталог был заменен, от Album Entry с тем же путем.
+// Состояние, прочитанное из расширенных атрибутов каталога, не заменяется.
+func (ent *Entries) InheritEntryIDs(old NodeStore) error {
+	for _, path := range ent.AlbumEntries() {
+		elem, err := ent.Get(path)
+		if err != nil {
+			continue
+		}
+		prev, err := findAlbumEntry(old, elem.ID(), path)
+		if err != nil {
+			return err
+		}
+		if prev == nil || prev.EntryID == "" {
+			continue
+		}
+		var state *EntryState
+		if elem.State == nil {
+			state = prev.State
+		}
+		if prev.EntryID != elem.EntryID || state != nil {
+			ent.SetEntryID(path, prev.EntryID, state)
+		}
+	}
+	return nil
+}
+
+// findAlbumEntry ищет в `store` Album Entry с идентификатором `id` или путем `path`.
+func findAlbumEntry(store NodeStore, id FileID, path string) (*CacheElem, error) {
+	prevPath, err := store.FindID(id, AlbumEntryNode)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{prevPath, path} {
+		if p == "" {
+			continue
+		}
+		elem, err := store.Get(p)
+		if errors.Is(err, ErrNodeNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if elem.Kind == AlbumEntryNode {
+			return elem, nil
+		}
+	}
+	return nil, nil
+}
+
+func newEntryID() string {
+	id, _ := uuid.NewV4()
+	return id.String()
+}
+
 // Rename переименовывает каталог.
 // Изменения также вносятся в список дочерних каталогов родительского каталога для данного.
-func (ent *Entries) Rename(oldDir, newDir string) {
-	elem := ent.Cache[oldDir]
+// Для отсутствующего в кеше каталога возвращает ErrNodeNotFound.
+func (ent *Entries) Rename(oldDir, newDir string) error {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	elem, ok := ent.Cache[oldDir]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNodeNotFound, oldDir)
+	}
 	elem.Modification.Change = RenamedFsChange
 	elem.Modification.NewName = newDir
 	ent.renameChildren(oldDir, newDir)
+	ent.relocateAliases(oldDir, newDir)
+	ent.byEntryID = nil
 	parent := filepath.Dir(oldDir)
-	if _, ok := ent.Cache[parent]; !ok {
-		return
+	parentEntryInfo, ok := ent.Cache[parent]
+	if !ok {
+		return nil
 	}
-	parentEntryInfo := ent.Cache[parent]
+	ent.touch(parent)
 	for i := 0; i < len(parentEntryInfo.Children); i++ {
 		if parentEntryInfo.Children[i] == oldDir {
 			parentEntryInfo.Children[i] = newDir
 		}
 	}
+	return nil
 }
 
+// renameChildren переносит узел `oldDir` и его дочерние узлы под путь `newDir`.
+// Отсутствующие в кеше дочерние каталоги пропускаются.
 func (ent *Entries) renameChildren(oldDir, newDir string) {
-	ent.Cache[newDir] = ent.Cache[oldDir]
-	for i := 0; i < len(ent.Cache[newDir].Children); i++ {
-		childName := filepath.Base(ent.Cache[newDir].Children[i])
-		newChildPath := filepath.Join(newDir, childName)
-		ent.renameChildren(ent.Cache[newDir].Children[i], newChildPath)
-		ent.Cache[newDir].Children[i] = filepath.Join(newDir, childName)
+	elem, ok := ent.Cache[oldDir]
+	if !ok {
+		return
 	}
 	delete(ent.Cache, oldDir)
+	ent.Cache[newDir] = elem
+	ent.touch(oldDir, newDir)
+	for i, child := range elem.Children {
+		newChildPath := filepath.Join(newDir, filepath.Base(child))
+		ent.renameChildren(child, newChildPath)
+		elem.Children[i] = newChildPath
+	}
 }
 
 // Delete рекурсивно удаляет каталог.
 // Имя каталога также удаляется в дочернем списке родительского каталога для данного.
+// Родительские каталоги, которые после удаления не ведут ни к одному Album Entry,
+// также удаляются.
 func (ent *Entries) Delete(dir string) {
-	elem := ent.Cache[dir]
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	if _, ok := ent.Cache[dir]; !ok {
+		return
+	}
+	ent.delete(dir)
+	ent.prune(filepath.Dir(dir))
+	ent.relocateAliases(dir, "")
+}
+
+// relocateAliases переносит псевдонимы, расположенные в дереве каталога `oldDir`,
+// под путь `newDir`. При пустом `newDir` такие псевдонимы удаляются.
+func (ent *Entries) relocateAliases(oldDir, newDir string) {
+	for path, elem := range ent.Cache {
+		var aliases []string
+		changed := false
+		for _, alias := range elem.Aliases {
+			if !isSubdir(oldDir, alias) {
+				aliases = append(aliases, alias)
+				continue
+			}
+			changed = true
+			if newDir != "" {
+				aliases = append(aliases, newDir+alias[len(oldDir):])
+			}
+		}
+		if changed {
+			sort.Strings(aliases)
+			elem.Aliases = aliases
+			ent.touch(path)
+		}
+	}
+}
+
+func (ent *Entries) delete(dir string) {
+	elem, ok := ent.Cache[dir]
+	if !ok {
+		return
+	}
 	elem.Modification.Change = DeletedFsChange
-	for _, dirName := range ent.Cache[dir].Children {
-		ent.Delete(filepath.Join(dir, dirName))
+	ent.touch(dir)
+	for _, child := range elem.Children {
+		ent.delete(child)
 	}
 	delete(ent.Cache, dir)
 
@@ -160,6 +537,7 @@ func (ent *Entries) Delete(dir string) {
 	if _, ok := ent.Cache[parent]; !ok {
 		return
 	}
+	ent.touch(parent)
 	for i := 0; i < len(ent.Cache[parent].Children); i++ {
 		if ent.Cache[parent].Children[i] == dir {
 			ent.Cache[parent].Children = append(
@@ -170,85 +548,482 @@ func (ent *Entries) Delete(dir string) {
 	}
 }
 
-// ClearChanges очищает сведения об изменении каталога.
+// prune удаляет каталог `dir` и его родительские каталоги, пока они являются
+// промежуточными каталогами без дочерних каталогов. Корень репозитория не удаляется.
+func (ent *Entries) prune(dir string) {
+	for ; len(dir) > ent.rootLen; dir = filepath.Dir(dir) {
+		elem, ok := ent.Cache[dir]
+		if !ok || elem.Kind != IntermediateNode || len(elem.Children) > 0 {
+			return
+		}
+		ent.delete(dir)
+	}
+}
+
+// AddAlias добавляет путь `alias` как псевдоним каталога `dir`, если каталог есть в кеше.
+func (ent *Entries) AddAlias(dir, alias string) {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	elem, ok := ent.Cache[dir]
+	if !ok || collection.ContainsStr(alias, elem.Aliases) {
+		return
+	}
+	elem.Aliases = append(elem.Aliases, alias)
+	sort.Strings(elem.Aliases)
+	ent.touch(dir)
+}
+
+// ClearChanges очищает сведения об изменении каталога. Для отсутствующего в кеше
+// каталога ничего не делает.
 func (ent *Entries) ClearChanges(dir string) {
-	elem := ent.Cache[dir]
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	elem, ok := ent.Cache[dir]
+	if !ok {
+		return
+	}
 	elem.Modification.Change = 0
 	elem.Modification.NewName = ""
+	ent.touch(dir)
 }
 
 // Compare сравнивает два набора кеша.
 // Параметр `old` представляет из себя предыдущий снимок данных.
 // Дополнительно в `old` выбираются вхождения с явно обозначенными изменениями и
 // объединяются с результатами.
-func (ent *Entries) Compare(old *Entries) map[string]DirModification {
+// Удаленные и созданные Album Entry, не сопоставленные по идентификаторам каталогов ФС
+// и Album Entry, сопоставляются по содержимому (MovedFsChange).
+func (ent *Entries) Compare(old NodeStore) (map[string]DirModification, error) {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
 	m := make(map[string]DirModification)
+	// новые Album Entry по идентификаторам для сопоставления с удаленными
+	created := make(map[string]string)
+	// несопоставленные удаленные и новые Album Entry для сравнения по содержимому
+	deletedEntries := make(map[string]*CacheElem)
+	createdEntries := make(map[string]*CacheElem)
 	for path, entryInfo := range ent.Cache {
-		if _, ok := old.Cache[path]; !ok {
-			var renamed bool
-			for oldPath, oldEntryInfo := range old.Cache {
-				if oldEntryInfo.Inode == entryInfo.Inode {
-					m[oldPath] = DirModification{
-						Change:  RenamedFsChange,
-						NewName: path}
-					renamed = true
-					break
-				}
+		oldElem, err := old.Get(path)
+		if err != nil && !errors.Is(err, ErrNodeNotFound) {
+			return nil, err
+		}
+		if oldElem != nil {
+			if tracks := compareElemTracks(oldElem, entryInfo); len(tracks) > 0 {
+				m[path] = DirModification{
+					Change:  ModifiedFsChange,
+					Kind:    entryInfo.Kind,
+					Tracks:  tracks,
+					EntryID: entryInfo.EntryID}
+			}
+			continue
+		}
+		oldPath, err := old.FindID(entryInfo.ID(), entryInfo.Kind)
+		if err != nil {
+			return nil, err
+		}
+		if oldPath != "" {
+			if oldElem, err = old.Get(oldPath); err != nil {
+				return nil, err
 			}
-			if !renamed {
-				m[path] = DirModification{Change: CreatedFsChange}
+			m[oldPath] = DirModification{
+				Change:  RenamedFsChange,
+				NewName: path,
+				Kind:    entryInfo.Kind,
+				Tracks:  compareElemTracks(oldElem, entryInfo),
+				EntryID: entryInfo.EntryID}
+		} else {
+			m[path] = DirModification{
+				Change: CreatedFsChange, Kind: entryInfo.Kind, EntryID: entryInfo.EntryID}
+			if entryInfo.Kind == AlbumEntryNode {
+				if entryInfo.EntryID != "" {
+					created[entryInfo.EntryID] = path
+				}
+				createdEntries[path] = entryInfo
 			}
 		}
 	}
-	for oldPath, elem := range old.Cache {
+	err := old.ForEach(func(oldPath string, elem *CacheElem) error {
 		if _, ok := ent.Cache[oldPath]; !ok {
-			if _, ok := m[oldPath]; !ok {
-				m[oldPath] = DirModification{Change: DeletedFsChange}
+			if _, ok := m[oldPath]; ok {
+				return nil
+			}
+			if path, ok := created[elem.EntryID]; ok && elem.Kind == AlbumEntryNode {
+				// каталог с другим inode, опознанный по идентификатору (копия каталога
+				// с расширенными атрибутами)
+				delete(created, elem.EntryID)
+				delete(createdEntries, path)
+				delete(m, path)
+				m[oldPath] = DirModification{
+					Change:  RenamedFsChange,
+					NewName: path,
+					Kind:    AlbumEntryNode,
+					Tracks:  compareElemTracks(elem, ent.Cache[path]),
+					EntryID: elem.EntryID}
+			} else {
+				m[oldPath] = DirModification{
+					Change: DeletedFsChange, Kind: elem.Kind, EntryID: elem.EntryID}
+				if elem.Kind == AlbumEntryNode {
+					deletedEntries[oldPath] = elem
+				}
 			}
 		} else {
 			if elem.Modification.Change != 0 {
 				if _, ok := m[oldPath]; !ok {
-					m[oldPath] = DirModification{Change: elem.Modification.Change}
+					m[oldPath] = DirModification{
+						Change:  elem.Modification.Change,
+						Kind:    ent.Cache[oldPath].Kind,
+						EntryID: ent.Cache[oldPath].EntryID}
 				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return m
+	for _, moved := range matchMovedEntries(deletedEntries, createdEntries) {
+		delete(m, moved.newPath)
+		elem := deletedEntries[moved.oldPath]
+		m[moved.oldPath] = DirModification{
+			Change:     MovedFsChange,
+			NewName:    moved.newPath,
+			Kind:       AlbumEntryNode,
+			Tracks:     compareMovedTracks(elem, ent.Cache[moved.newPath]),
+			EntryID:    elem.EntryID,
+			Confidence: moved.confidence}
+	}
+	return m, nil
+}
+
+// compareElemTracks сравнивает списки файлов треков Album Entry. Для узлов кеша,
+// сохраненного без списка файлов, изменения не определяются.
+func compareElemTracks(old, cur *CacheElem) []TrackModification {
+	if cur.Kind != AlbumEntryNode || old.Files == nil {
+		return nil
+	}
+	return CompareTracks(old.Files, cur.Files)
+}
+
+// Get возвращает копию узла кеша или ErrNodeNotFound при его отсутствии.
+func (ent *Entries) Get(path string) (*CacheElem, error) {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
+	if elem, ok := ent.Cache[path]; ok {
+		return elem.clone(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, path)
+}
+
+// ForEach вызывает `fn` для копий всех узлов кеша. `fn` не должна вызывать
+// изменяющие кеш методы.
+func (ent *Entries) ForEach(fn func(path string, elem *CacheElem) error) error {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
+	for path, elem := range ent.Cache {
+		if err := fn(path, elem.clone()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindID возвращает путь каталога с идентификатором `id` или пустую строку (см. NodeStore).
+// Индекс inode строится при первом поиске после изменения кеша.
+func (ent *Entries) FindID(id FileID, kind NodeKind) (string, error) {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	if ent.byInode == nil {
+		ent.byInode = make(map[uint64][]string, len(ent.Cache))
+		for path, elem := range ent.Cache {
+			ent.byInode[elem.Inode] = append(ent.byInode[elem.Inode], path)
+		}
+	}
+	candidates := make(map[string]*CacheElem)
+	for _, path := range ent.byInode[id.Inode] {
+		candidates[path] = ent.Cache[path]
+	}
+	return matchID(id, kind, candidates), nil
+}
+
+// matchID выбирает среди узлов `candidates` с inode `id` узел с тем же устройством,
+// затем узел без сохраненного устройства, затем единственный узел типа `kind`.
+func matchID(id FileID, kind NodeKind, candidates map[string]*CacheElem) string {
+	var legacy, other string
+	others := 0
+	for path, elem := range candidates {
+		switch {
+		case elem.Device == id.Device:
+			return path
+		case elem.Device == 0:
+			legacy = path
+		case elem.Kind == kind:
+			other = path
+			others++
+		}
+	}
+	if legacy != "" || others != 1 {
+		return legacy
+	}
+	return other
 }
 
 // LoadFrom заполняет кеш из JSON.
-// Попутно формируется внутренний кеш iNode для каталогов.
+// Кеш предыдущих версий формата преобразуется к текущей. Если кеш сформирован для
+// другого корня или набора форматов, возвращается ошибка ErrCacheMismatch, а текущее
+// содержимое кеша не изменяется.
 func (ent *Entries) LoadFrom(fn string) error {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
 	data, err := ioutil.ReadFile(fn)
 	if err != nil {
 		return err
 	}
-	if err = json.Unmarshal(data, &ent.Cache); err != nil {
+	env, err := decodeCacheEnvelope(data)
+	if err != nil {
+		return err
+	}
+	if err = env.upgrade(ent); err != nil {
 		return err
 	}
+	ent.Cache = absoluteCache(ent.Root, env.Cache)
+	ent.createdAt = env.CreatedAt
+	ent.byInode, ent.byEntryID = nil, nil
 	return nil
 }
 
-// SaveTo сохраняет кеш в указанном файле.
+// restoreKinds определяет тип узлов, для которых он не был сохранен.
+// Каталог считается Album Entry, если содержит аудиофайлы. Для отсутствующих на диске
+// каталогов Album Entry считаются узлы без дочерних каталогов.
+func (ent *Entries) restoreKinds(cache map[string]*CacheElem) {
+	for path, elem := range cache {
+		if elem.Kind != 0 {
+			continue
+		}
+		switch hasAudio, err := ent.containsAudio(path); {
+		case path == ent.Root:
+			elem.Kind = RootNode
+		case err == nil && hasAudio, err != nil && len(elem.Children) == 0:
+			elem.Kind = AlbumEntryNode
+		default:
+			elem.Kind = IntermediateNode
+		}
+	}
+}
+
+func (ent *Entries) containsAudio(dir string) (bool, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range files {
+		if !info.IsDir() && ent.isSupportedAudio(filepath.Join(dir, info.Name())) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SaveTo атомарно сохраняет кеш в указанном файле в текущей версии формата.
 func (ent *Entries) SaveTo(fn string) error {
-	data, err := json.Marshal(ent.Cache)
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	if ent.createdAt.IsZero() {
+		ent.createdAt = time.Now().UTC()
+	}
+	env := &cacheEnvelope{
+		Version:        CacheFormatVersion,
+		Root:           ent.Root,
+		Extensions:     ent.formats.Extensions(),
+		CreatedAt:      ent.createdAt,
+		ServiceVersion: ServiceVersion,
+		Cache:          ent.Cache}
+	data, err := env.encode()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(fn, data, 0644)
+	if err = writeFileAtomic(fn, data, 0644); err != nil {
+		return err
+	}
+	ent.resetChanges()
+	return nil
+}
+
+// Relocate переносит кеш на новый корневой каталог `newRoot` (например, после
+// перемонтирования диска). Перенос проверяется сравнением inode для выборки каталогов:
+// большинство найденных на новом месте каталогов должно совпасть с сохраненными в кеше.
+func (ent *Entries) Relocate(newRoot string) error {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	newRoot = filepath.Clean(newRoot)
+	paths := make([]string, 0, len(ent.Cache))
+	for path := range ent.Cache {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	step := len(paths)/relocateSamples + 1
+	var checked, matched int
+	devices := make(map[uint64]uint64)
+	for i := 0; i < len(paths); i += step {
+		rel, err := filepath.Rel(ent.Root, paths[i])
+		if err != nil {
+			return err
+		}
+		id, err := FileIdentity(filepath.Join(newRoot, rel))
+		if err != nil {
+			// каталог мог быть удален или переименован после сохранения кеша
+			continue
+		}
+		checked++
+		if elem := ent.Cache[paths[i]]; id.Inode == elem.Inode {
+			devices[elem.Device] = id.Device
+			matched++
+		}
+	}
+	if matched*2 <= checked || checked == 0 {
+		return fmt.Errorf("%w: %s (%d of %d sampled dirs matched)",
+			ErrRelocationMismatch, newRoot, matched, checked)
+	}
+	cache, err := relativeCache(ent.Root, ent.Cache)
+	if err != nil {
+		return err
+	}
+	ent.Root, ent.rootLen = newRoot, len(newRoot)
+	ent.Cache = absoluteCache(newRoot, cache)
+	ent.byEntryID = nil
+	for path, elem := range ent.Cache {
+		// после перемонтирования номер устройства может измениться
+		if dev, ok := devices[elem.Device]; ok {
+			elem.Device = dev
+		}
+		ent.touch(path)
+	}
+	return nil
+}
+
+// Changes возвращает число изменений кеша после последнего сохранения.
+func (ent *Entries) Changes() int {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
+	return ent.changes
+}
+
+// touch отмечает узлы кеша как измененные после последнего сохранения.
+func (ent *Entries) touch(paths ...string) {
+	if ent.dirty == nil {
+		ent.dirty = make(map[string]bool)
+	}
+	for _, path := range paths {
+		ent.dirty[path] = true
+	}
+	ent.changes++
+	ent.byInode = nil
+}
+
+func (ent *Entries) resetChanges() {
+	ent.changes = 0
+	ent.dirty = nil
 }
 
 // IsAlbumEntry проверяет является ли каталог аудиокаталогом.
 func (ent *Entries) IsAlbumEntry(dir string) bool {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
 	elem, ok := ent.Cache[dir]
 	if !ok {
 		return false
 	}
-	return elem.isAlbumEntry
+	return elem.Kind == AlbumEntryNode
+}
+
+// Info возвращает сведения о каталоге `path` или nil, если каталога нет в кеше.
+// Путь может содержать псевдоним каталога или одного из его родителей.
+func (ent *Entries) Info(path string) *EntryInfo {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
+	path = filepath.Clean(path)
+	elem, ok := ent.Cache[path]
+	if !ok {
+		if path, ok = ent.resolveAlias(path); !ok {
+			return nil
+		}
+		elem = ent.Cache[path]
+	}
+	return &EntryInfo{
+		Path:    path,
+		Kind:    elem.Kind,
+		Aliases: append([]string(nil), elem.Aliases...),
+		Files:   append([]TrackFile(nil), elem.Files...),
+		State:   elem.clone().State}
+}
+
+// resolveAlias возвращает основной путь каталога кеша, доступного по пути `path`
+// через псевдонимы (возможно, вложенные).
+func (ent *Entries) resolveAlias(path string) (string, bool) {
+	seen := make(map[string]bool)
+	for !seen[path] {
+		seen[path] = true
+		path = ent.replaceAlias(path)
+		if _, ok := ent.Cache[path]; ok {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// replaceAlias заменяет псевдоним в начале пути `path` основным путем каталога.
+func (ent *Entries) replaceAlias(path string) string {
+	for dir, elem := range ent.Cache {
+		for _, alias := range elem.Aliases {
+			if path == alias || strings.HasPrefix(path, alias+string(filepath.Separator)) {
+				return dir + path[len(alias):]
+			}
+		}
+	}
+	return path
+}
+
+// Contains проверяет наличие каталога в кеше.
+func (ent *Entries) Contains(dir string) bool {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
+	_, ok := ent.Cache[dir]
+	return ok
+}
+
+// AlbumEntries возвращает отсортированный список путей Album Entry.
+func (ent *Entries) AlbumEntries() []string {
+	ent.mu.RLock()
+	defer ent.mu.RUnlock()
+	var ret []string
+	for path, elem := range ent.Cache {
+		if elem.Kind == AlbumEntryNode {
+			ret = append(ret, path)
+		}
+	}
+	sort.Strings(ret)
+	return ret
 }
 
 func (ent *Entries) isSupportedAudio(fn string) bool {
-	return collection.ContainsStr(filepath.Ext(fn), ent.Extensions)
+	return ent.formats.IsAudio(fn)
+}
+
+// FileIdentity возвращает идентификатор файлового объекта `path`.
+func FileIdentity(path string) (FileID, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileID{}, err
+	}
+	return FileIDByInfo(info)
+}
+
+// FileIDByInfo определяет идентификатор файлового объекта по данным fs.FileInfo.
+func FileIDByInfo(info fs.FileInfo) (FileID, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, errors.New("Not a syscall.Stat_t")
+	}
+	return FileID{Device: uint64(stat.Dev), Inode: stat.Ino}, nil
 }
 
 // Inode возвращает числовое значение каталога в файловой системе.
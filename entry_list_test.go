@@ -1,33 +1,59 @@
 package repokeeper
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-var testExtensions = []string{".flac", ".dsf", ".mp3", ".wv"}
-
 func TestEntriesCalculate(t *testing.T) {
-	ent := NewEntries("testdata/repo", testExtensions)
+	ent := NewEntries("testdata/repo", DefaultFormats())
 	require.NoError(t, ent.Calculate("testdata/repo"))
 	// data, _ := json.Marshal(ent.Cache)
 	// fmt.Println(string(data))
 	assert.NotContains(t, ent.Cache, "non-audio")
+	assert.True(t, ent.IsAlbumEntry("testdata/repo/flac/flac"))
+	assert.True(t, ent.IsAlbumEntry("testdata/repo/wv/wv/wv"))
 }
 
 func TestEntriesLoad(t *testing.T) {
-	ent := NewEntries("testdata/repo", testExtensions)
+	ent := NewEntries("testdata/repo", DefaultFormats())
 	require.NoError(t, ent.LoadFrom("testdata/cache"))
 	assert.Len(t, ent.Cache, 8)
+	// кеш старого формата: тип узлов восстанавливается по содержимому каталогов
+	assert.Equal(t, RootNode, ent.Cache["testdata/repo"].Kind)
+	assert.Equal(t, IntermediateNode, ent.Cache["testdata/repo/wv/wv"].Kind)
+	assert.True(t, ent.IsAlbumEntry("testdata/repo/wv/wv/wv"))
+	assert.True(t, ent.IsAlbumEntry("testdata/repo/mp3"))
+}
+
+func TestEntriesSaveLoad(t *testing.T) {
+	ent := NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, ent.Calculate("testdata/repo"))
+	fn := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, ent.SaveTo(fn))
+
+	loaded := NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, loaded.LoadFrom(fn))
+	for path, elem := range ent.Cache {
+		require.Contains(t, loaded.Cache, path)
+		assert.Equal(t, elem.Kind, loaded.Cache[path].Kind, path)
+	}
+	assert.True(t, loaded.IsAlbumEntry("testdata/repo/flac/flac"))
+	assert.False(t, loaded.IsAlbumEntry("testdata/repo/flac"))
 }
 
 func TestEntriesCompare(t *testing.T) {
 	var old, ent *Entries
-	old = NewEntries("testdata/repo", testExtensions)
-	ent = NewEntries("testdata/repo", testExtensions)
+	old = NewEntries("testdata/repo", DefaultFormats())
+	ent = NewEntries("testdata/repo", DefaultFormats())
 	require.NoError(t, old.LoadFrom("testdata/cache"))
 	for k, v := range old.Cache {
 		ent.Cache[k] = v
@@ -43,9 +69,228 @@ func TestEntriesCompare(t *testing.T) {
 	ent.Rename("testdata/repo/wv/wv", "testdata/repo/wv/wv2")
 	assert.Len(t, ent.Cache, 8)
 
-	changes := ent.Compare(old)
+	changes, err := ent.Compare(old)
+	require.NoError(t, err)
 	assert.Equal(t, changes["testdata/repo/other_mp3"].Change, CreatedFsChange)
+	assert.Equal(t, changes["testdata/repo/other_mp3"].Kind, AlbumEntryNode)
 	assert.Equal(t, changes["testdata/repo/flac"].Change, DeletedFsChange)
 	assert.Equal(t, changes["testdata/repo/wv/wv"].Change, RenamedFsChange)
 	assert.Equal(t, changes["testdata/repo/wv/wv"].NewName, "testdata/repo/wv/wv2")
 }
+
+func TestEntriesDelete(t *testing.T) {
+	ent := NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, ent.Calculate("testdata/repo"))
+
+	// промежуточные каталоги без других Album Entry удаляются
+	ent.Delete("testdata/repo/wv/wv/wv")
+	assert.NotContains(t, ent.Cache, "testdata/repo/wv/wv/wv")
+	assert.NotContains(t, ent.Cache, "testdata/repo/wv/wv")
+	assert.NotContains(t, ent.Cache, "testdata/repo/wv")
+	assert.NotContains(t, ent.Cache["testdata/repo"].Children, "testdata/repo/wv")
+	assert.True(t, ent.IsAlbumEntry("testdata/repo/flac/flac"))
+
+	// рекурсивное удаление вложенных каталогов
+	ent.Delete("testdata/repo/dsf")
+	assert.NotContains(t, ent.Cache, "testdata/repo/dsf")
+	assert.NotContains(t, ent.Cache, "testdata/repo/dsf/dsf")
+	assert.Contains(t, ent.Cache, "testdata/repo")
+	assert.Equal(t, []string{"testdata/repo/flac/flac", "testdata/repo/mp3"}, ent.AlbumEntries())
+
+	// каталог с другими Album Entry сохраняется
+	root := t.TempDir()
+	for _, dir := range []string{"a/b/album1", "a/album2"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	ent = NewEntries(root, DefaultFormats())
+	require.NoError(t, ent.AddAlbumEntry(filepath.Join(root, "a/b/album1")))
+	require.NoError(t, ent.AddAlbumEntry(filepath.Join(root, "a/album2")))
+	ent.Delete(filepath.Join(root, "a/b/album1"))
+	assert.NotContains(t, ent.Cache, filepath.Join(root, "a/b"))
+	assert.Equal(t, []string{filepath.Join(root, "a/album2")}, ent.Cache[filepath.Join(root, "a")].Children)
+	ent.Delete(filepath.Join(root, "a/album2"))
+	assert.Equal(t, []string{root}, cacheKeys(ent))
+}
+
+func cacheKeys(ent *Entries) []string {
+	var ret []string
+	for path := range ent.Cache {
+		ret = append(ret, path)
+	}
+	return ret
+}
+
+func TestEntriesFindID(t *testing.T) {
+	ent := NewEntries("/repo", DefaultFormats())
+	ent.Cache["/repo/a"] = &CacheElem{Inode: 10, Device: 1, Kind: AlbumEntryNode}
+	ent.Cache["/repo/b"] = &CacheElem{Inode: 10, Device: 2, Kind: AlbumEntryNode}
+	ent.Cache["/repo/c"] = &CacheElem{Inode: 20}
+	ent.Cache["/repo/e"] = &CacheElem{Inode: 30, Device: 1, Kind: AlbumEntryNode}
+	ent.Cache["/repo/f"] = &CacheElem{Inode: 30, Device: 2, Kind: IntermediateNode}
+
+	path, err := ent.FindID(FileID{Device: 2, Inode: 10}, AlbumEntryNode)
+	require.NoError(t, err)
+	assert.Equal(t, "/repo/b", path)
+	// неоднозначное сопоставление только по inode
+	path, _ = ent.FindID(FileID{Device: 3, Inode: 10}, AlbumEntryNode)
+	assert.Empty(t, path)
+	// узел кеша без сохраненного устройства
+	path, _ = ent.FindID(FileID{Device: 3, Inode: 20}, AlbumEntryNode)
+	assert.Equal(t, "/repo/c", path)
+	// номер устройства изменился, inode и тип узла совпадают
+	path, _ = ent.FindID(FileID{Device: 3, Inode: 30}, AlbumEntryNode)
+	assert.Equal(t, "/repo/e", path)
+	path, _ = ent.FindID(FileID{Device: 3, Inode: 30}, RootNode)
+	assert.Empty(t, path)
+
+	// индекс перестраивается после изменения кеша
+	require.NoError(t, ent.Rename("/repo/b", "/repo/d"))
+	path, _ = ent.FindID(FileID{Device: 2, Inode: 10}, AlbumEntryNode)
+	assert.Equal(t, "/repo/d", path)
+}
+
+func TestEntriesMissingNode(t *testing.T) {
+	ent := NewEntries("/repo", DefaultFormats())
+	ent.Cache["/repo"] = &CacheElem{Inode: 1, Kind: RootNode, Children: []string{"/repo/a"}}
+	ent.Cache["/repo/a"] = &CacheElem{Inode: 2, Kind: IntermediateNode,
+		Children: []string{"/repo/a/lost", "/repo/a/album"}}
+	ent.Cache["/repo/a/album"] = &CacheElem{Inode: 3, Kind: AlbumEntryNode}
+
+	assert.ErrorIs(t, ent.Rename("/repo/none", "/repo/other"), ErrNodeNotFound)
+	ent.ClearChanges("/repo/none")
+	// дочерний каталог, отсутствующий в кеше, пропускается
+	require.NoError(t, ent.Rename("/repo/a", "/repo/b"))
+	assert.ElementsMatch(t, []string{"/repo", "/repo/b", "/repo/b/album"}, cacheKeys(ent))
+
+	// ForEach передает копии узлов
+	require.NoError(t, ent.ForEach(func(path string, elem *CacheElem) error {
+		elem.Kind = 0
+		elem.Children = nil
+		return nil
+	}))
+	assert.Equal(t, AlbumEntryNode, ent.Cache["/repo/b/album"].Kind)
+	assert.Len(t, ent.Cache["/repo/b"].Children, 2)
+}
+
+func TestEntriesLoadMismatch(t *testing.T) {
+	ent := NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, ent.Calculate("testdata/repo"))
+	fn := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, ent.SaveTo(fn))
+
+	other := NewEntries("testdata/other", DefaultFormats())
+	assert.ErrorIs(t, other.LoadFrom(fn), ErrCacheMismatch)
+	assert.Empty(t, other.Cache)
+
+	formats, err := FormatsByExtensions([]string{".flac"})
+	require.NoError(t, err)
+	other = NewEntries("testdata/repo", formats)
+	assert.ErrorIs(t, other.LoadFrom(fn), ErrCacheMismatch)
+
+	// кеш старого формата для другого корня
+	other = NewEntries("testdata/other", DefaultFormats())
+	assert.ErrorIs(t, other.LoadFrom("testdata/cache"), ErrCacheMismatch)
+}
+
+func TestEntriesLoadCorrupt(t *testing.T) {
+	ent := NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, ent.Calculate("testdata/repo"))
+	assert.NotZero(t, ent.Changes())
+	fn := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, ent.SaveTo(fn))
+	assert.Zero(t, ent.Changes())
+
+	data, err := ioutil.ReadFile(fn)
+	require.NoError(t, err)
+	// изменение содержимого узлов без пересчета контрольной суммы
+	corrupted := bytes.Replace(data, []byte(`"kind":3`), []byte(`"kind":2`), 1)
+	require.NotEqual(t, data, corrupted)
+	require.NoError(t, ioutil.WriteFile(fn, corrupted, 0644))
+	loaded := NewEntries("testdata/repo", DefaultFormats())
+	assert.ErrorIs(t, loaded.LoadFrom(fn), ErrCacheCorrupt)
+
+	// частично записанный файл
+	require.NoError(t, ioutil.WriteFile(fn, data[:len(data)/2], 0644))
+	assert.ErrorIs(t, loaded.LoadFrom(fn), ErrCacheCorrupt)
+}
+
+func TestEntriesRelocate(t *testing.T) {
+	ent := NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, ent.Calculate("testdata/repo"))
+	fn := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, ent.SaveTo(fn))
+	data, err := ioutil.ReadFile(fn)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"flac/flac":`)
+	assert.NotContains(t, string(data), `testdata/repo/flac`)
+
+	// тот же репозиторий, доступный по другому пути
+	abs, err := filepath.Abs("testdata/repo")
+	require.NoError(t, err)
+	moved := filepath.Join(t.TempDir(), "music")
+	require.NoError(t, os.Symlink(abs, moved))
+	loaded := NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, loaded.LoadFrom(fn))
+	require.NoError(t, loaded.Relocate(moved))
+	assert.Equal(t, moved, loaded.Root)
+	assert.True(t, loaded.IsAlbumEntry(filepath.Join(moved, "flac/flac")))
+	assert.Contains(t, loaded.Cache[moved].Children, filepath.Join(moved, "flac"))
+	assert.Len(t, loaded.Cache, len(ent.Cache))
+
+	// каталог с той же структурой, но другими каталогами
+	other := t.TempDir()
+	for path := range ent.Cache {
+		rel, err := filepath.Rel("testdata/repo", path)
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Join(other, rel), 0755))
+	}
+	loaded = NewEntries("testdata/repo", DefaultFormats())
+	require.NoError(t, loaded.LoadFrom(fn))
+	assert.ErrorIs(t, loaded.Relocate(other), ErrRelocationMismatch)
+	assert.Equal(t, "testdata/repo", loaded.Root)
+}
+
+func TestEntriesConcurrentAccess(t *testing.T) {
+	root := t.TempDir()
+	ent := NewEntries(root, DefaultFormats())
+	fn := filepath.Join(t.TempDir(), "cache")
+	const n = 50
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			dir := filepath.Join(root, "artist", fmt.Sprintf("album%d", i))
+			if !assert.NoError(t, os.MkdirAll(dir, 0755)) {
+				return
+			}
+			assert.NoError(t, ent.AddAlbumEntry(dir))
+			if i%2 == 0 {
+				ent.Rename(dir, dir+"_renamed")
+			}
+			ent.ClearChanges(filepath.Join(root, "artist"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		old := NewEntries(root, DefaultFormats())
+		for i := 0; i < n; i++ {
+			_, err := ent.Compare(old)
+			assert.NoError(t, err)
+			for _, path := range ent.AlbumEntries() {
+				ent.IsAlbumEntry(path)
+			}
+			id, err := FileIdentity(root)
+			assert.NoError(t, err)
+			_, err = ent.FindID(id, AlbumEntryNode)
+			assert.NoError(t, err)
+			assert.NoError(t, ent.SaveTo(fn))
+		}
+	}()
+	wg.Wait()
+
+	assert.Len(t, ent.AlbumEntries(), n)
+	assert.True(t, ent.IsAlbumEntry(filepath.Join(root, "artist", "album0_renamed")))
+	assert.True(t, ent.IsAlbumEntry(filepath.Join(root, "artist", "album1")))
+}
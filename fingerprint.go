@@ -0,0 +1,218 @@
+package repokeeper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// fingerprintChunk - размер начального и конечного фрагментов файла трека,
+// по которым вычисляется TrackFile.PartialHash.
+const fingerprintChunk = 64 * 1024
+
+// MinMoveConfidence - минимальная степень совпадения списков аудиофайлов удаленного
+// и созданного Album Entry, при которой они считаются одним перемещенным каталогом.
+const MinMoveConfidence = 0.6
+
+// Вклад трека в степень совпадения: совпадение имени, размера и хеша содержимого,
+// совпадение размера и хеша у переименованного файла, совпадение только имени
+// и размера (хеши отсутствуют в кеше старого формата).
+const (
+	trackMatchFull    = 1.0
+	trackMatchContent = 0.9
+	trackMatchName    = 0.7
+)
+
+// partialHash возвращает SHA-256 начального и конечного фрагментов файла размером
+// fingerprintChunk. Для небольших файлов хешируется все содержимое.
+func partialHash(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if size <= 2*fingerprintChunk {
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	if _, err := io.CopyN(h, f, fingerprintChunk); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(-fingerprintChunk, io.SeekEnd); err != nil {
+		return "", err
+	}
+	if _, err := io.CopyN(h, f, fingerprintChunk); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentKey возвращает ключ содержимого трека: полный хеш, если он есть в обоих
+// сравниваемых списках, иначе частичный.
+func contentKey(track *TrackFile, fullHashes bool) string {
+	if fullHashes {
+		return track.Hash
+	}
+	return track.PartialHash
+}
+
+// FingerprintMatch возвращает степень совпадения (от 0 до 1) списков аудиофайлов
+// `old` и `cur` по именам, размерам и хешам содержимого файлов.
+func FingerprintMatch(old, cur []TrackFile) float64 {
+	if len(old) == 0 || len(cur) == 0 {
+		return 0
+	}
+	fullHashes := hasFullHashes(old) && hasFullHashes(cur)
+	byName := make(map[string]*TrackFile, len(cur))
+	byContent := make(map[string][]*TrackFile)
+	for i := range cur {
+		track := &cur[i]
+		byName[track.Name] = track
+		if key := contentKey(track, fullHashes); key != "" {
+			byContent[key] = append(byContent[key], track)
+		}
+	}
+	// сначала сопоставляются файлы с одинаковыми именами, затем оставшиеся по содержимому
+	used := make(map[*TrackFile]bool)
+	var rest []*TrackFile
+	var score float64
+	for i := range old {
+		track := &old[i]
+		key := contentKey(track, fullHashes)
+		match, ok := byName[track.Name]
+		switch {
+		case !ok || match.Size != track.Size:
+			rest = append(rest, track)
+		case key == "" || contentKey(match, fullHashes) == "":
+			used[match] = true
+			score += trackMatchName
+		case key == contentKey(match, fullHashes):
+			used[match] = true
+			score += trackMatchFull
+		default:
+			rest = append(rest, track)
+		}
+	}
+	for _, track := range rest {
+		for _, match := range byContent[contentKey(track, fullHashes)] {
+			if !used[match] && match.Size == track.Size {
+				used[match] = true
+				score += trackMatchContent
+				break
+			}
+		}
+	}
+	n := len(old)
+	if len(cur) > n {
+		n = len(cur)
+	}
+	return math.Round(score/float64(n)*100) / 100
+}
+
+// trackKeys возвращает ключи трека для отбора пар Album Entry, которые могут совпасть
+// по FingerprintMatch: имя и размер (для кеша старого формата без хешей) и частичный
+// хеш и размер.
+func trackKeys(track *TrackFile) []string {
+	size := strconv.FormatInt(track.Size, 10)
+	keys := []string{"name:" + size + ":" + track.Name}
+	if track.PartialHash != "" {
+		keys = append(keys, "hash:"+size+":"+track.PartialHash)
+	}
+	return keys
+}
+
+func hasFullHashes(tracks []TrackFile) bool {
+	for i := range tracks {
+		if tracks[i].Hash == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// movedEntry описывает пару удаленного и созданного Album Entry, сопоставленных
+// по содержимому.
+type movedEntry struct {
+	oldPath, newPath string
+	confidence       float64
+}
+
+// matchMovedEntries сопоставляет удаленные Album Entry `deleted` с созданными `created`
+// по содержимому. Каждый Album Entry входит не более чем в одну пару, пары с большей
+// степенью совпадения выбираются первыми.
+// Сравниваются только пары, у которых есть хотя бы один трек с общим ключом
+// (см. trackKeys), поэтому время сопоставления линейно по числу треков, кроме
+// каталогов с одинаковыми файлами.
+func matchMovedEntries(deleted, created map[string]*CacheElem) []movedEntry {
+	index := make(map[string][]string)
+	for newPath, elem := range created {
+		for i := range elem.Files {
+			for _, key := range trackKeys(&elem.Files[i]) {
+				index[key] = append(index[key], newPath)
+			}
+		}
+	}
+	var candidates []movedEntry
+	for oldPath, oldElem := range deleted {
+		compared := make(map[string]bool)
+		for i := range oldElem.Files {
+			for _, key := range trackKeys(&oldElem.Files[i]) {
+				for _, newPath := range index[key] {
+					if compared[newPath] {
+						continue
+					}
+					compared[newPath] = true
+					elem := created[newPath]
+					if confidence := FingerprintMatch(oldElem.Files, elem.Files); confidence >= MinMoveConfidence {
+						candidates = append(candidates, movedEntry{oldPath, newPath, confidence})
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.confidence != b.confidence {
+			return a.confidence > b.confidence
+		}
+		if a.oldPath != b.oldPath {
+			return a.oldPath < b.oldPath
+		}
+		return a.newPath < b.newPath
+	})
+	var ret []movedEntry
+	oldMatched, newMatched := make(map[string]bool), make(map[string]bool)
+	for _, c := range candidates {
+		if !oldMatched[c.oldPath] && !newMatched[c.newPath] {
+			oldMatched[c.oldPath], newMatched[c.newPath] = true, true
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// compareMovedTracks сравнивает списки файлов треков Album Entry, перемещенного
+// с заменой каталога ФС. Замена файлов (другой inode) при этом не учитывается.
+func compareMovedTracks(old, cur *CacheElem) []TrackModification {
+	if old.Files == nil {
+		return nil
+	}
+	inodes := make(map[string]uint64, len(cur.Files))
+	for _, track := range cur.Files {
+		inodes[track.Name] = track.Inode
+	}
+	files := append([]TrackFile(nil), old.Files...)
+	for i := range files {
+		if inode, ok := inodes[files[i].Name]; ok {
+			files[i].Inode = inode
+		}
+	}
+	return CompareTracks(files, cur.Files)
+}
@@ -0,0 +1,119 @@
+package repokeeper
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintMatch(t *testing.T) {
+	old := []TrackFile{
+		{Name: "01.flac", Size: 10, PartialHash: "a"},
+		{Name: "02.flac", Size: 20, PartialHash: "b"},
+		{Name: "03.flac", Size: 30, PartialHash: "c"},
+		{Name: "04.flac", Size: 40, PartialHash: "d"},
+	}
+	assert.Equal(t, 1.0, FingerprintMatch(old, old))
+	assert.Zero(t, FingerprintMatch(old, nil))
+
+	cur := []TrackFile{
+		{Name: "01.flac", Size: 10, PartialHash: "a"},
+		{Name: "02 - b.flac", Size: 20, PartialHash: "b"},
+		{Name: "03.flac", Size: 30, PartialHash: "x"},
+		{Name: "04.flac", Size: 40},
+	}
+	// полное совпадение, переименованный файл, другое содержимое, кеш без хеша
+	assert.Equal(t, 0.65, FingerprintMatch(old, cur))
+	assert.Equal(t, 0.25, FingerprintMatch(old[:1], cur))
+}
+
+func TestMatchMovedEntries(t *testing.T) {
+	tracks := func(names ...string) []TrackFile {
+		var ret []TrackFile
+		for i, name := range names {
+			ret = append(ret, TrackFile{Name: name, Size: int64(10 * (i + 1)), PartialHash: name})
+		}
+		return ret
+	}
+	deleted := map[string]*CacheElem{
+		"/repo/a": {Files: tracks("a1", "a2")},
+		"/repo/b": {Files: []TrackFile{{Name: "01.flac", Size: 10}, {Name: "02.flac", Size: 20}}},
+		"/repo/c": {Files: tracks("c1")},
+	}
+	created := map[string]*CacheElem{
+		"/repo/x": {Files: tracks("a1", "a2")},
+		// кеш без хешей: совпадение по именам и размерам
+		"/repo/y": {Files: []TrackFile{
+			{Name: "01.flac", Size: 10, PartialHash: "h1"}, {Name: "02.flac", Size: 20, PartialHash: "h2"}}},
+		"/repo/z": {Files: tracks("z1")},
+	}
+	moved := matchMovedEntries(deleted, created)
+	sort.Slice(moved, func(i, j int) bool { return moved[i].oldPath < moved[j].oldPath })
+	assert.Equal(t, []movedEntry{
+		{"/repo/a", "/repo/x", 1},
+		{"/repo/b", "/repo/y", trackMatchName},
+	}, moved)
+}
+
+func TestEntriesCompareMoved(t *testing.T) {
+	root := t.TempDir()
+	writeTestTracks(t, filepath.Join(root, "a", "album"), "01.flac", "02.flac", "03.flac")
+	old := NewEntries(root, DefaultFormats())
+	require.NoError(t, old.Calculate(root))
+
+	// каталог скопирован в другое место (новые inode), исходный удален
+	moved := filepath.Join(root, "b", "album")
+	require.NoError(t, copyDir(filepath.Join(root, "a", "album"), moved))
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "a")))
+	require.NoError(t, os.Truncate(filepath.Join(moved, "02.flac"), 100))
+
+	cur := NewEntries(root, DefaultFormats())
+	require.NoError(t, cur.Calculate(root))
+	require.NoError(t, cur.InheritEntryIDs(old))
+	changes, err := cur.Compare(old)
+	require.NoError(t, err)
+	assert.Equal(t, DirModification{
+		Change:     MovedFsChange,
+		NewName:    moved,
+		Kind:       AlbumEntryNode,
+		Tracks:     []TrackModification{{Change: ModifiedTrackChange, Name: "02.flac"}},
+		EntryID:    old.Cache[filepath.Join(root, "a", "album")].EntryID,
+		Confidence: 0.67}, changes[filepath.Join(root, "a", "album")])
+	assert.NotContains(t, changes, moved)
+}
+
+func TestRepoKeeperMovedEvent(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "album")
+	writeTestTracks(t, album, "01.flac")
+	rk := newTestKeeper(t, root)
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		events = append(events, string(data))
+		return nil
+	}
+	rk.applyChangesBetweenSessions()
+	id := rk.entryID(album)
+	require.NoError(t, rk.roots[0].entries.UpdateEntryState(album, func(state *EntryState) {
+		state.Normalized = true
+	}))
+	require.NoError(t, rk.roots[0].save())
+	old, err := rk.roots[0].cache.Snapshot()
+	require.NoError(t, err)
+
+	restored := filepath.Join(root, "restored")
+	require.NoError(t, copyDir(album, restored))
+	require.NoError(t, os.RemoveAll(album))
+	ent := NewEntries(root, DefaultFormats())
+	require.NoError(t, ent.Calculate(root))
+	rk.roots[0].entries = ent
+	require.NoError(t, rk.emitChanges(rk.roots[0], old))
+	assert.Equal(t, []string{
+		"dir moved: default:album -> default:restored; confidence=1.00; id=" + id}, events)
+	assert.Equal(t, id, rk.entryID(restored))
+	assert.True(t, ent.Info(restored).State.Normalized)
+}
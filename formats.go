@@ -0,0 +1,748 @@
+package repokeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+// Флаги и уровень сжатия заголовка Monkey's Audio до версии 3.98.
+const (
+	apeFlag8Bit             = 1
+	apeFlag24Bit            = 8
+	apeCompressionExtraHigh = 4000
+)
+
+// sniffHeaderSize - объем начальных данных файла (после тега ID3v2), по которому
+// определяется формат.
+const sniffHeaderSize = 64
+
+// Ошибки реестра форматов.
+var (
+	ErrUnknownFormat       = errors.New("unknown audio format")
+	ErrUnsupportedFormatOp = errors.New("operation is not supported for audio format")
+)
+
+// AudioFormat описывает обработчик формата аудиофайлов.
+// `Extensions` содержит расширения в нижнем регистре с ведущей точкой.
+// `Sniff` проверяет сигнатуру формата по начальным байтам файла (тег ID3v2 в начале
+// файла предварительно пропускается).
+// `ReadTags` и `ReadProperties` могут отсутствовать, если чтение не поддерживается
+// (все встроенные форматы поддерживают оба вида чтения).
+type AudioFormat struct {
+	Name           string
+	Extensions     []string
+	Sniff          func(header []byte) bool
+	ReadTags       func(path string) (map[string]string, error)
+	ReadProperties func(path string) (*md.AudioInfo, error)
+}
+
+// FormatRegistry хранит набор поддерживаемых форматов аудиофайлов.
+type FormatRegistry struct {
+	formats []*AudioFormat
+	byExt   map[string]*AudioFormat
+}
+
+// NewFormatRegistry создает реестр с указанными форматами.
+func NewFormatRegistry(formats ...*AudioFormat) *FormatRegistry {
+	r := &FormatRegistry{byExt: make(map[string]*AudioFormat)}
+	for _, f := range formats {
+		r.Register(f)
+	}
+	return r
+}
+
+// DefaultFormats возвращает реестр со всеми встроенными форматами.
+func DefaultFormats() *FormatRegistry {
+	return NewFormatRegistry(builtinFormats()...)
+}
+
+// FormatsByExtensions возвращает реестр встроенных форматов, отобранных по расширениям
+// (без учета регистра). В реестр входят только перечисленные расширения формата.
+// Для пустого списка возвращаются все встроенные форматы.
+func FormatsByExtensions(extensions []string) (*FormatRegistry, error) {
+	all := DefaultFormats()
+	if len(extensions) == 0 {
+		return all, nil
+	}
+	r := NewFormatRegistry()
+	for _, ext := range extensions {
+		f := all.ByExtension("file" + ext)
+		if f == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, ext)
+		}
+		ext = strings.ToLower(ext)
+		if reg := r.byName(f.Name); reg != nil {
+			reg.Extensions = append(reg.Extensions, ext)
+			r.byExt[ext] = reg
+			continue
+		}
+		selected := *f
+		selected.Extensions = []string{ext}
+		r.Register(&selected)
+	}
+	return r, nil
+}
+
+// Register добавляет формат в реестр. Расширения ранее зарегистрированных форматов
+// замещаются.
+func (r *FormatRegistry) Register(f *AudioFormat) {
+	r.formats = append(r.formats, f)
+	for _, ext := range f.Extensions {
+		r.byExt[strings.ToLower(ext)] = f
+	}
+}
+
+// Formats возвращает зарегистрированные форматы.
+func (r *FormatRegistry) Formats() []*AudioFormat {
+	return r.formats
+}
+
+// Extensions возвращает отсортированный список зарегистрированных расширений.
+func (r *FormatRegistry) Extensions() []string {
+	ret := make([]string, 0, len(r.byExt))
+	for ext := range r.byExt {
+		ret = append(ret, ext)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ByExtension возвращает формат по расширению файла (без учета регистра) или nil.
+func (r *FormatRegistry) ByExtension(path string) *AudioFormat {
+	return r.byExt[strings.ToLower(filepath.Ext(path))]
+}
+
+// Detect определяет формат файла по содержимому. Содержимое проверяется только
+// у файлов с зарегистрированным расширением, первым - формат этого расширения.
+// Возвращает nil, если формат не распознан.
+func (r *FormatRegistry) Detect(path string) (*AudioFormat, error) {
+	if r.ByExtension(path) == nil {
+		return nil, nil
+	}
+	header, err := readSniffHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	if f := r.ByExtension(path); f != nil && f.Sniff(header) {
+		return f, nil
+	}
+	for _, f := range r.formats {
+		if f.Sniff(header) {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// IsAudio проверяет, является ли файл аудиофайлом одного из зарегистрированных форматов.
+func (r *FormatRegistry) IsAudio(path string) bool {
+	f, err := r.Detect(path)
+	return err == nil && f != nil
+}
+
+// ReadTags читает теги аудиофайла.
+func (r *FormatRegistry) ReadTags(path string) (map[string]string, error) {
+	f, err := r.detectKnown(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.ReadTags == nil {
+		return nil, fmt.Errorf("%w: %s tags reading", ErrUnsupportedFormatOp, f.Name)
+	}
+	return f.ReadTags(path)
+}
+
+// ReadProperties читает технические характеристики аудиопотока.
+func (r *FormatRegistry) ReadProperties(path string) (*md.AudioInfo, error) {
+	f, err := r.detectKnown(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.ReadProperties == nil {
+		return nil, fmt.Errorf("%w: %s properties reading", ErrUnsupportedFormatOp, f.Name)
+	}
+	return f.ReadProperties(path)
+}
+
+func (r *FormatRegistry) detectKnown(path string) (*AudioFormat, error) {
+	f, err := r.Detect(path)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, path)
+	}
+	return f, nil
+}
+
+func (r *FormatRegistry) byName(name string) *AudioFormat {
+	for _, f := range r.formats {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func builtinFormats() []*AudioFormat {
+	return []*AudioFormat{
+		{Name: "FLAC", Extensions: []string{".flac"}, Sniff: sniffMagic(0, "fLaC"),
+			ReadTags: readFlacTags, ReadProperties: readFlacProperties},
+		{Name: "MP3", Extensions: []string{".mp3"}, Sniff: sniffMP3,
+			ReadTags: readMP3Tags, ReadProperties: readMP3Properties},
+		{Name: "DSF", Extensions: []string{".dsf"}, Sniff: sniffMagic(0, "DSD "),
+			ReadTags: readDSFTags, ReadProperties: readDSFProperties},
+		{Name: "DFF", Extensions: []string{".dff"},
+			Sniff:    sniffAll(sniffMagic(0, "FRM8"), sniffMagic(12, "DSD ")),
+			ReadTags: readDFFTags, ReadProperties: readDFFProperties},
+		{Name: "WavPack", Extensions: []string{".wv"}, Sniff: sniffMagic(0, "wvpk"),
+			ReadTags: readAPETags, ReadProperties: readWavPackProperties},
+		{Name: "APE", Extensions: []string{".ape"}, Sniff: sniffMagic(0, "MAC "),
+			ReadTags: readAPETags, ReadProperties: readAPEProperties},
+		{Name: "M4A", Extensions: []string{".m4a", ".m4b"}, Sniff: sniffM4A,
+			ReadTags: readMP4Tags, ReadProperties: readMP4Properties},
+		{Name: "Ogg Vorbis", Extensions: []string{".ogg", ".oga"},
+			Sniff:    sniffAll(sniffMagic(0, "OggS"), sniffMagic(28, "\x01vorbis")),
+			ReadTags: readOggTags, ReadProperties: readOggProperties},
+		{Name: "Opus", Extensions: []string{".opus"},
+			Sniff:    sniffAll(sniffMagic(0, "OggS"), sniffMagic(28, "OpusHead")),
+			ReadTags: readOggTags, ReadProperties: readOggProperties},
+		{Name: "WAV", Extensions: []string{".wav"},
+			Sniff:    sniffAll(sniffMagic(0, "RIFF"), sniffMagic(8, "WAVE")),
+			ReadTags: readWAVTags, ReadProperties: readWAVProperties},
+		{Name: "AIFF", Extensions: []string{".aiff", ".aif", ".aifc"},
+			Sniff: sniffAll(sniffMagic(0, "FORM"),
+				func(h []byte) bool { return sniffMagic(8, "AIFF")(h) || sniffMagic(8, "AIFC")(h) }),
+			ReadTags: readAIFFTags, ReadProperties: readAIFFProperties},
+	}
+}
+
+// readSniffHeader читает начальные байты файла, пропуская тег ID3v2.
+func readSniffHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, sniffHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	header = header[:n]
+	if size := id3v2Size(header); size > 0 {
+		header = make([]byte, sniffHeaderSize)
+		n, err = f.ReadAt(header, size)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		header = header[:n]
+	}
+	return header, nil
+}
+
+// id3v2Size возвращает полный размер тега ID3v2 в начале данных или 0.
+func id3v2Size(header []byte) int64 {
+	if len(header) < 10 || string(header[:3]) != "ID3" {
+		return 0
+	}
+	var size int64
+	for _, b := range header[6:10] {
+		if b&0x80 != 0 {
+			return 0
+		}
+		size = size<<7 | int64(b)
+	}
+	size += 10
+	if header[5]&0x10 != 0 { // footer present
+		size += 10
+	}
+	return size
+}
+
+func sniffMagic(offset int, magic string) func([]byte) bool {
+	return func(header []byte) bool {
+		return len(header) >= offset+len(magic) &&
+			string(header[offset:offset+len(magic)]) == magic
+	}
+}
+
+func sniffAll(sniffers ...func([]byte) bool) func([]byte) bool {
+	return func(header []byte) bool {
+		for _, sniff := range sniffers {
+			if !sniff(header) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+var m4aBrands = []string{"M4A ", "M4B ", "M4P ", "mp41", "mp42", "isom", "iso2"}
+
+func sniffM4A(header []byte) bool {
+	if !sniffMagic(4, "ftyp")(header) || len(header) < 12 {
+		return false
+	}
+	for _, brand := range m4aBrands {
+		if string(header[8:12]) == brand {
+			return true
+		}
+	}
+	return false
+}
+
+func readFlacTags(path string) (map[string]string, error) {
+	blocks, err := readFlacFileMetaBlocks(path)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, blk := range blocks {
+		if blk.typ == flacBlockVorbisComment {
+			if err := parseVorbisComment(blk.data, tags); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tags, nil
+}
+
+func readFlacProperties(path string) (*md.AudioInfo, error) {
+	blocks, err := readFlacFileMetaBlocks(path)
+	if err != nil {
+		return nil, err
+	}
+	d := blocks[0].data
+	if blocks[0].typ != flacBlockStreamInfo || len(d) < 18 {
+		return nil, errors.New("FLAC STREAMINFO block is missing")
+	}
+	ai := &md.AudioInfo{
+		Samplerate: int(d[10])<<12 | int(d[11])<<4 | int(d[12])>>4,
+		Channels:   int(d[12]>>1&7) + 1,
+		SampleSize: int(d[12]&1)<<4 | int(d[13]>>4) + 1}
+	total := int64(d[13]&0xf)<<32 | int64(binary.BigEndian.Uint32(d[14:18]))
+	return ai, setAvgBitrate(ai, path, total)
+}
+
+func readFlacFileMetaBlocks(path string) ([]*flacMetaBlock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	blocks, _, err := readFlacMetaBlocks(f)
+	return blocks, err
+}
+
+// parseVorbisComment добавляет в `tags` значения комментария Vorbis.
+// Имена тегов приводятся к верхнему регистру, повторяющиеся значения объединяются через ";".
+func parseVorbisComment(data []byte, tags map[string]string) error {
+	r := bytes.NewReader(data)
+	if _, err := readVorbisString(r); err != nil {
+		return err
+	}
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		s, err := readVorbisString(r)
+		if err != nil {
+			return err
+		}
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		addTag(tags, strings.ToUpper(kv[0]), kv[1])
+	}
+	return nil
+}
+
+func addTag(tags map[string]string, key, value string) {
+	if prev, ok := tags[key]; ok {
+		value = prev + ";" + value
+	}
+	tags[key] = value
+}
+
+// readAPETags читает текстовые элементы тега APEv2 в конце файла.
+func readAPETags(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := fi.Size()
+	if end >= id3v1TagSize {
+		buf := make([]byte, 3)
+		if _, err := f.ReadAt(buf, end-id3v1TagSize); err != nil {
+			return nil, err
+		}
+		if string(buf) == "TAG" {
+			end -= id3v1TagSize
+		}
+	}
+	items, _, err := readAPEItems(f, end)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, item := range items {
+		if item.flags&apeItemTypeMask == apeItemUTF8 {
+			tags[strings.ToUpper(item.key)] = string(item.value)
+		}
+	}
+	return tags, nil
+}
+
+func readWavPackProperties(path string) (*md.AudioInfo, error) {
+	hdr, sampleRate, err := readWavPackHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	ai := &md.AudioInfo{
+		Samplerate: sampleRate,
+		Channels:   2,
+		SampleSize: int(hdr.Flags&wvBytesStored+1) * 8}
+	if hdr.Flags&wvMonoFlag != 0 {
+		ai.Channels = 1
+	}
+	total := int64(hdr.TotalSamples)
+	if hdr.TotalSamples == math.MaxUint32 {
+		total = 0
+	}
+	return ai, setAvgBitrate(ai, path, total)
+}
+
+// readDSFProperties читает блок "fmt " файла DSF.
+func readDSFProperties(path string) (*md.AudioInfo, error) {
+	buf, err := readFileRange(path, 0, 80)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 72 || !sniffMagic(28, "fmt ")(buf) {
+		return nil, errors.New("DSF fmt chunk is missing")
+	}
+	ai := &md.AudioInfo{
+		Channels:   int(binary.LittleEndian.Uint32(buf[52:])),
+		Samplerate: int(binary.LittleEndian.Uint32(buf[56:])),
+		SampleSize: int(binary.LittleEndian.Uint32(buf[60:]))}
+	return ai, setAvgBitrate(ai, path, int64(binary.LittleEndian.Uint64(buf[64:])))
+}
+
+// readDSFTags читает тег ID3v2, на который указывает заголовок файла DSF.
+func readDSFTags(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hdr [28]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	if offset := int64(binary.LittleEndian.Uint64(hdr[20:])); offset > 0 {
+		if _, err := readID3v2Tags(f, offset, tags); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// readAPEProperties читает заголовок файла Monkey's Audio. С версии 3.98 заголовку
+// предшествует дескриптор, в более ранних версиях разрядность задается флагами.
+func readAPEProperties(path string) (*md.AudioInfo, error) {
+	buf, err := readFileRange(path, 0, 128)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 6 || !sniffMagic(0, "MAC ")(buf) {
+		return nil, errors.New("APE header is missing")
+	}
+	version := binary.LittleEndian.Uint16(buf[4:])
+	var ai *md.AudioInfo
+	var blocksPerFrame, finalFrameBlocks, totalFrames uint32
+	if version >= 3980 {
+		if len(buf) < 12 {
+			return nil, errors.New("APE descriptor is missing")
+		}
+		descriptorSize := int(binary.LittleEndian.Uint32(buf[8:]))
+		if descriptorSize > len(buf)-24 {
+			return nil, errors.New("APE header is missing")
+		}
+		h := buf[descriptorSize:]
+		blocksPerFrame = binary.LittleEndian.Uint32(h[4:])
+		finalFrameBlocks = binary.LittleEndian.Uint32(h[8:])
+		totalFrames = binary.LittleEndian.Uint32(h[12:])
+		ai = &md.AudioInfo{
+			SampleSize: int(binary.LittleEndian.Uint16(h[16:])),
+			Channels:   int(binary.LittleEndian.Uint16(h[18:])),
+			Samplerate: int(binary.LittleEndian.Uint32(h[20:]))}
+	} else {
+		if len(buf) < 32 {
+			return nil, errors.New("APE header is missing")
+		}
+		compression := binary.LittleEndian.Uint16(buf[6:])
+		flags := binary.LittleEndian.Uint16(buf[8:])
+		ai = &md.AudioInfo{
+			SampleSize: 16,
+			Channels:   int(binary.LittleEndian.Uint16(buf[10:])),
+			Samplerate: int(binary.LittleEndian.Uint32(buf[12:]))}
+		switch {
+		case flags&apeFlag8Bit != 0:
+			ai.SampleSize = 8
+		case flags&apeFlag24Bit != 0:
+			ai.SampleSize = 24
+		}
+		totalFrames = binary.LittleEndian.Uint32(buf[24:])
+		finalFrameBlocks = binary.LittleEndian.Uint32(buf[28:])
+		switch {
+		case version >= 3950:
+			blocksPerFrame = 73728 * 4
+		case version >= 3900, version >= 3800 && compression == apeCompressionExtraHigh:
+			blocksPerFrame = 73728
+		default:
+			blocksPerFrame = 9216
+		}
+	}
+	var samples int64
+	if totalFrames > 0 {
+		samples = int64(totalFrames-1)*int64(blocksPerFrame) + int64(finalFrameBlocks)
+	}
+	return ai, setAvgBitrate(ai, path, samples)
+}
+
+// readWAVProperties читает блок "fmt " файла RIFF WAVE.
+func readWAVProperties(path string) (*md.AudioInfo, error) {
+	var ai *md.AudioInfo
+	err := walkIFFFile(path, 12, binary.LittleEndian, func(id string, chunk *io.SectionReader) (bool, error) {
+		if id != "fmt " || chunk.Size() < 16 {
+			return true, nil
+		}
+		data := make([]byte, 16)
+		if _, err := chunk.ReadAt(data, 0); err != nil {
+			return false, err
+		}
+		ai = &md.AudioInfo{
+			Channels:   int(binary.LittleEndian.Uint16(data[2:])),
+			Samplerate: int(binary.LittleEndian.Uint32(data[4:])),
+			AvgBitrate: int(binary.LittleEndian.Uint32(data[8:])) * 8 / 1000,
+			SampleSize: int(binary.LittleEndian.Uint16(data[14:]))}
+		return false, nil
+	})
+	if err == nil && ai == nil {
+		err = errors.New("WAV fmt chunk is missing")
+	}
+	return ai, err
+}
+
+// wavInfoTags сопоставляет элементы списка LIST/INFO именам тегов Vorbis.
+var wavInfoTags = map[string]string{
+	"INAM": "TITLE",
+	"IART": "ARTIST",
+	"IPRD": "ALBUM",
+	"ICRD": "DATE",
+	"IGNR": "GENRE",
+	"ICMT": "COMMENT",
+	"ITRK": "TRACKNUMBER",
+	"IPRT": "TRACKNUMBER",
+}
+
+// readWAVTags читает теги из списка LIST/INFO и блока "id3 " файла RIFF WAVE.
+func readWAVTags(path string) (map[string]string, error) {
+	tags := make(map[string]string)
+	err := walkIFFFile(path, 12, binary.LittleEndian, func(id string, chunk *io.SectionReader) (bool, error) {
+		switch id {
+		case "id3 ", "ID3 ":
+			_, err := readID3v2Tags(chunk, 0, tags)
+			return err == nil, err
+		case "LIST":
+			var listType [4]byte
+			if _, err := chunk.ReadAt(listType[:], 0); err != nil || string(listType[:]) != "INFO" {
+				return true, nil
+			}
+			err := walkIFFChunks(chunk, 4, binary.LittleEndian, func(id string, item *io.SectionReader) (bool, error) {
+				if key, ok := wavInfoTags[id]; ok {
+					value, err := readIFFString(item)
+					if err != nil {
+						return false, err
+					}
+					if value != "" {
+						addTag(tags, key, value)
+					}
+				}
+				return true, nil
+			})
+			return err == nil, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// readAIFFProperties читает блок "COMM" файла AIFF/AIFC.
+func readAIFFProperties(path string) (*md.AudioInfo, error) {
+	var ai *md.AudioInfo
+	var frames int64
+	err := walkIFFFile(path, 12, binary.BigEndian, func(id string, chunk *io.SectionReader) (bool, error) {
+		if id != "COMM" || chunk.Size() < 18 {
+			return true, nil
+		}
+		data := make([]byte, 18)
+		if _, err := chunk.ReadAt(data, 0); err != nil {
+			return false, err
+		}
+		ai = &md.AudioInfo{
+			Channels:   int(binary.BigEndian.Uint16(data)),
+			SampleSize: int(binary.BigEndian.Uint16(data[6:])),
+			Samplerate: int(extendedToFloat(data[8:18]))}
+		frames = int64(binary.BigEndian.Uint32(data[2:]))
+		return false, nil
+	})
+	if err == nil && ai == nil {
+		err = errors.New("AIFF COMM chunk is missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ai, setAvgBitrate(ai, path, frames)
+}
+
+// aiffTextTags сопоставляет текстовые блоки AIFF именам тегов Vorbis.
+var aiffTextTags = map[string]string{
+	"NAME": "TITLE",
+	"AUTH": "ARTIST",
+	"ANNO": "COMMENT",
+	"(c) ": "COPYRIGHT",
+}
+
+// readAIFFTags читает теги из текстовых блоков и блока "ID3 " файла AIFF/AIFC.
+func readAIFFTags(path string) (map[string]string, error) {
+	tags := make(map[string]string)
+	err := walkIFFFile(path, 12, binary.BigEndian, func(id string, chunk *io.SectionReader) (bool, error) {
+		if id == "ID3 " || id == "id3 " {
+			_, err := readID3v2Tags(chunk, 0, tags)
+			return err == nil, err
+		}
+		if key, ok := aiffTextTags[id]; ok {
+			value, err := readIFFString(chunk)
+			if err != nil {
+				return false, err
+			}
+			if value != "" {
+				addTag(tags, key, value)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// readIFFString читает текстовый блок, завершающийся нулевым символом или концом блока.
+func readIFFString(chunk *io.SectionReader) (string, error) {
+	data := make([]byte, chunk.Size())
+	if _, err := chunk.ReadAt(data, 0); err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// walkIFFFile перебирает блоки файла формата IFF (RIFF, FORM), начиная с `offset`,
+// пока `fn` возвращает true.
+func walkIFFFile(path string, offset int64, order binary.ByteOrder,
+	fn func(id string, chunk *io.SectionReader) (bool, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return walkIFFChunks(f, offset, order, fn)
+}
+
+// walkIFFChunks перебирает блоки IFF в данных `r`, начиная с `offset`, пока `fn`
+// возвращает true.
+func walkIFFChunks(r io.ReaderAt, offset int64, order binary.ByteOrder,
+	fn func(id string, chunk *io.SectionReader) (bool, error)) error {
+	for {
+		var hdr [8]byte
+		if _, err := r.ReadAt(hdr[:], offset); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(order.Uint32(hdr[4:]))
+		if ok, err := fn(string(hdr[:4]), io.NewSectionReader(r, offset+8, size)); !ok || err != nil {
+			return err
+		}
+		offset += 8 + size + size&1
+	}
+}
+
+// extendedToFloat преобразует 80-битное число с плавающей точкой (IEEE 754 extended).
+func extendedToFloat(b []byte) float64 {
+	exp := int(binary.BigEndian.Uint16(b) & 0x7fff)
+	mantissa := binary.BigEndian.Uint64(b[2:])
+	if exp == 0 && mantissa == 0 {
+		return 0
+	}
+	v := math.Ldexp(float64(mantissa), exp-16383-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+func readFileRange(path string, offset int64, size int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// setAvgBitrate вычисляет средний битрейт (кбит/с) по размеру файла и числу отсчетов.
+func setAvgBitrate(ai *md.AudioInfo, path string, samples int64) error {
+	if samples <= 0 || ai.Samplerate <= 0 {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	seconds := float64(samples) / float64(ai.Samplerate)
+	ai.AvgBitrate = int(float64(fi.Size()) * 8 / seconds / 1000)
+	return nil
+}
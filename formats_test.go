@@ -0,0 +1,386 @@
+package repokeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+func TestFormatDetect(t *testing.T) {
+	formats := DefaultFormats()
+	for fn, name := range map[string]string{
+		"testdata/repo/flac/flac/test.flac": "FLAC",
+		"testdata/repo/mp3/test.mp3":        "MP3",
+		"testdata/repo/dsf/dsf/test.dsf":    "DSF",
+		"testdata/repo/wv/wv/wv/test.wv":    "WavPack",
+	} {
+		f, err := formats.Detect(fn)
+		require.NoError(t, err)
+		require.NotNil(t, f, fn)
+		assert.Equal(t, name, f.Name)
+	}
+
+	dir := t.TempDir()
+	data, err := ioutil.ReadFile("testdata/repo/flac/flac/test.flac")
+	require.NoError(t, err)
+	// расширение в верхнем регистре и файл с неверным расширением
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "01.FLAC"), data, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "02.mp3"), data, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "03.flac"), nil, 0644))
+	assert.NotNil(t, formats.ByExtension("01.FLAC"))
+	f, err := formats.Detect(filepath.Join(dir, "01.FLAC"))
+	require.NoError(t, err)
+	assert.Equal(t, "FLAC", f.Name)
+	f, err = formats.Detect(filepath.Join(dir, "02.mp3"))
+	require.NoError(t, err)
+	assert.Equal(t, "FLAC", f.Name)
+	assert.False(t, formats.IsAudio(filepath.Join(dir, "03.flac")))
+
+	// файлы без расширения аудиоформата не проверяются по содержимому
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "04.flac.part"), data, 0644))
+	assert.False(t, formats.IsAudio(filepath.Join(dir, "04.flac.part")))
+	video := append([]byte("\x00\x00\x00\x18ftypisom"), make([]byte, 64)...)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "clip.mp4"), video, 0644))
+	assert.False(t, formats.IsAudio(filepath.Join(dir, "clip.mp4")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "05.m4a"), video, 0644))
+	assert.True(t, formats.IsAudio(filepath.Join(dir, "05.m4a")))
+}
+
+func TestFormatsByExtensions(t *testing.T) {
+	formats, err := FormatsByExtensions([]string{".FLAC", ".wv"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".flac", ".wv"}, formats.Extensions())
+	assert.False(t, formats.IsAudio("testdata/repo/mp3/test.mp3"))
+
+	// в реестр входят только перечисленные расширения формата
+	formats, err = FormatsByExtensions([]string{".m4a", ".AIF"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".aif", ".m4a"}, formats.Extensions())
+	assert.Nil(t, formats.ByExtension("book.m4b"))
+
+	_, err = FormatsByExtensions([]string{".xyz"})
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func TestFormatReadProperties(t *testing.T) {
+	formats := DefaultFormats()
+	ai, err := formats.ReadProperties("testdata/repo/dsf/dsf/test.dsf")
+	require.NoError(t, err)
+	assert.Equal(t, 2822400, ai.Samplerate)
+	assert.Equal(t, 2, ai.Channels)
+
+	fn := filepath.Join(t.TempDir(), "01.flac")
+	require.NoError(t, writeTestFlac(fn, make([]int32, 10*4096)))
+	ai, err = formats.ReadProperties(fn)
+	require.NoError(t, err)
+	assert.Equal(t, testSampleRate, ai.Samplerate)
+	assert.Equal(t, 16, ai.SampleSize)
+
+	require.NoError(t, WriteReplayGainTags(fn, map[string]string{"REPLAYGAIN_TRACK_GAIN": "1.00 dB"}))
+	tags, err := formats.ReadTags(fn)
+	require.NoError(t, err)
+	assert.Equal(t, "1.00 dB", tags["REPLAYGAIN_TRACK_GAIN"])
+
+	ai, err = formats.ReadProperties("testdata/repo/mp3/test.mp3")
+	require.NoError(t, err)
+	assert.Equal(t, 44100, ai.Samplerate)
+	assert.Equal(t, 2, ai.Channels)
+	assert.Equal(t, 128, ai.AvgBitrate)
+	tags, err = formats.ReadTags("testdata/repo/mp3/test.mp3")
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	// блок WavPack без аудиоданных, затем моно блок 24 бит с нестандартной частотой
+	buf := new(bytes.Buffer)
+	buf.WriteString("ID3")
+	for _, hdr := range []wvHeader{
+		{CkSize: wvHeaderSize - 8, Version: 0x410, Flags: 9 << wvSrateLSB},
+		{CkSize: wvHeaderSize, Version: 0x410, TotalSamples: 1000, BlockSamples: 1000,
+			Flags: 2 | wvMonoFlag | wvSrateMask}} {
+		copy(hdr.CkID[:], "wvpk")
+		require.NoError(t, binary.Write(buf, binary.LittleEndian, &hdr))
+	}
+	buf.Write([]byte{wvIDSampleRate | wvIDOddSize, 2, 0x20, 0x4e, 0x00, 0})
+	buf.Write([]byte{0, 0})
+	fn = filepath.Join(t.TempDir(), "01.wv")
+	require.NoError(t, ioutil.WriteFile(fn, buf.Bytes(), 0644))
+	hdr, sampleRate, err := readWavPackHeader(fn)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1000, hdr.TotalSamples)
+	assert.Equal(t, 20000, sampleRate)
+	ai, err = readWavPackProperties(fn)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ai.Channels)
+	assert.Equal(t, 24, ai.SampleSize)
+}
+
+// testID3v2 формирует тег ID3v2.3 из текстовых фреймов в кодировке ISO-8859-1.
+func testID3v2(frames ...string) []byte {
+	body := new(bytes.Buffer)
+	for i := 0; i+1 < len(frames); i += 2 {
+		body.WriteString(frames[i])
+		binary.Write(body, binary.BigEndian, uint32(len(frames[i+1])+1))
+		body.Write([]byte{0, 0, 0})
+		body.WriteString(frames[i+1])
+	}
+	size := body.Len()
+	tag := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(tag, body.Bytes()...)
+}
+
+// testChunk формирует блок IFF с 32-битным размером.
+func testChunk(order binary.ByteOrder, id string, data ...[]byte) []byte {
+	payload := bytes.Join(data, nil)
+	buf := bytes.NewBufferString(id)
+	binary.Write(buf, order, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// testDFFChunk формирует блок DSDIFF с 64-битным размером.
+func testDFFChunk(id string, data ...[]byte) []byte {
+	payload := bytes.Join(data, nil)
+	buf := bytes.NewBufferString(id)
+	binary.Write(buf, binary.BigEndian, uint64(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// testAtom формирует атом MP4.
+func testAtom(typ string, data ...[]byte) []byte {
+	payload := bytes.Join(data, nil)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(8+len(payload)))
+	buf.WriteString(typ)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// testOggPage формирует страницу Ogg с пакетами `packets` (без контрольной суммы).
+func testOggPage(packets ...[]byte) []byte {
+	var segments, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			segments = append(segments, 255)
+		}
+		segments = append(segments, byte(n))
+		body = append(body, p...)
+	}
+	page := append([]byte("OggS"), make([]byte, 22)...)
+	page = append(page, byte(len(segments)))
+	return append(append(page, segments...), body...)
+}
+
+func testVorbisComment(comments ...string) []byte {
+	buf := new(bytes.Buffer)
+	writeVorbisString(buf, "test")
+	binary.Write(buf, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		writeVorbisString(buf, c)
+	}
+	return buf.Bytes()
+}
+
+// testAPETag формирует тег APEv2 без заголовка из текстовых элементов.
+func testAPETag(items ...string) []byte {
+	body := new(bytes.Buffer)
+	for i := 0; i+1 < len(items); i += 2 {
+		binary.Write(body, binary.LittleEndian, uint32(len(items[i+1])))
+		binary.Write(body, binary.LittleEndian, uint32(apeItemUTF8))
+		body.WriteString(items[i] + "\x00" + items[i+1])
+	}
+	footer := apeFooter{Version: 2000, Size: uint32(body.Len() + apeTagFooterSize),
+		Count: uint32(len(items) / 2)}
+	copy(footer.Preamble[:], "APETAGEX")
+	binary.Write(body, binary.LittleEndian, &footer)
+	return body.Bytes()
+}
+
+func u16(order binary.ByteOrder, v uint16) []byte {
+	b := make([]byte, 2)
+	order.PutUint16(b, v)
+	return b
+}
+
+func u32(order binary.ByteOrder, v uint32) []byte {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return b
+}
+
+func TestFormatReaders(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	id3 := testID3v2("TIT2", "Title", "TRCK", "3/10", "TXXX", "REPLAYGAIN_TRACK_GAIN\x00-1.00 dB")
+
+	// MP3: ID3v2, кадр с заголовком Xing (100 кадров) и ID3v1 с названием альбома
+	frame := make([]byte, 417)
+	copy(frame, "\xff\xfb\x90\x64")
+	copy(frame[36:], "Xing\x00\x00\x00\x01\x00\x00\x00\x64")
+	id3v1 := make([]byte, id3v1TagSize)
+	copy(id3v1, "TAGTitle v1")
+	copy(id3v1[63:], "Album")
+	mp3 := bytes.Join([][]byte{id3, frame, id3v1}, nil)
+
+	// DSF: тег ID3v2 после блока данных
+	dsf, err := ioutil.ReadFile("testdata/repo/dsf/dsf/test.dsf")
+	require.NoError(t, err)
+	le.PutUint64(dsf[20:], uint64(len(dsf)))
+	dsf = append(dsf, id3...)
+
+	dff := testDFFChunk("FRM8", []byte("DSD "),
+		testDFFChunk("FVER", u32(be, 0x01050000)),
+		testDFFChunk("PROP", []byte("SND "),
+			testDFFChunk("FS  ", u32(be, 2822400)),
+			testDFFChunk("CHNL", u16(be, 2), []byte("SLFTSRGT"))),
+		testDFFChunk("DSD ", make([]byte, 705600)),
+		testDFFChunk("DIIN",
+			testDFFChunk("DIAR", u32(be, 6), []byte("Artist")),
+			testDFFChunk("DITI", u32(be, 5), []byte("Title"))))
+
+	// APE 3.99: дескриптор и заголовок (2 кадра по 4 отсчета + 2 отсчета)
+	ape := bytes.Join([][]byte{[]byte("MAC "), u16(le, 3990), u16(le, 0), u32(le, 52),
+		make([]byte, 40), u16(le, 2000), u16(le, 0), u32(le, 4), u32(le, 2), u32(le, 2),
+		u16(le, 24), u16(le, 2), u32(le, 96000)}, nil)
+	ape = append(ape, testAPETag("Title", "Title")...)
+
+	// M4A: ALAC 24 бит 96 кГц и теги iTunes
+	data := func(kind uint32, value []byte) []byte {
+		return testAtom("data", u32(be, kind), u32(be, 0), value)
+	}
+	alacEntry := testAtom("alac", make([]byte, 6), u16(be, 1), make([]byte, 8),
+		u16(be, 2), u16(be, 16), u16(be, 0), u16(be, 0), u32(be, 44100<<16),
+		testAtom("alac", make([]byte, 4), u32(be, 4096), []byte{0, 24, 40, 10, 14, 2},
+			u16(be, 255), u32(be, 0), u32(be, 0), u32(be, 96000)))
+	m4a := bytes.Join([][]byte{
+		testAtom("ftyp", []byte("M4A "), u32(be, 0)),
+		testAtom("moov",
+			testAtom("trak", testAtom("mdia",
+				testAtom("mdhd", make([]byte, 12), u32(be, 96000), u32(be, 96000*60), make([]byte, 4)),
+				testAtom("minf", testAtom("stbl", testAtom("stsd", u32(be, 0), u32(be, 1), alacEntry))))),
+			testAtom("udta", testAtom("meta", u32(be, 0),
+				testAtom("hdlr", make([]byte, 25)),
+				testAtom("ilst",
+					testAtom("\xa9nam", data(1, []byte("Title"))),
+					testAtom("trkn", data(0, []byte{0, 0, 0, 3, 0, 10, 0, 0})),
+					testAtom("----", testAtom("mean", u32(be, 0), []byte("com.apple.iTunes")),
+						testAtom("name", u32(be, 0), []byte("replaygain_track_gain")),
+						data(1, []byte("-1.00 dB"))))))),
+		testAtom("mdat")}, nil)
+
+	// Ogg Vorbis и Opus: комментарий занимает несколько сегментов второй страницы
+	long := "DESCRIPTION=" + string(bytes.Repeat([]byte("x"), 600))
+	vorbisID := append([]byte("\x01vorbis"), make([]byte, 23)...)
+	vorbisID[11] = 2
+	le.PutUint32(vorbisID[12:], 48000)
+	ogg := append(testOggPage(vorbisID), testOggPage(append([]byte("\x03vorbis"),
+		testVorbisComment("TITLE=Title", "TRACKNUMBER=3", long)...))...)
+	opusID := append([]byte("OpusHead\x01\x01"), make([]byte, 9)...)
+	opus := append(testOggPage(opusID), testOggPage(append([]byte("OpusTags"),
+		testVorbisComment("TITLE=Title", "TRACKNUMBER=3", long)...))...)
+
+	wav := testChunk(le, "RIFF", []byte("WAVE"),
+		testChunk(le, "fmt ", u16(le, 1), u16(le, 2), u32(le, 48000), u32(le, 48000*4),
+			u16(le, 4), u16(le, 16)),
+		testChunk(le, "LIST", []byte("INFO"), testChunk(le, "INAM", []byte("Title\x00")),
+			testChunk(le, "ITRK", []byte("3\x00"))),
+		testChunk(le, "data", make([]byte, 48000*4)))
+
+	aiff := testChunk(be, "FORM", []byte("AIFF"),
+		testChunk(be, "COMM", u16(be, 1), u32(be, 88200), u16(be, 24),
+			[]byte{0x40, 0x0e, 0xac, 0x44, 0, 0, 0, 0, 0, 0}),
+		testChunk(be, "NAME", []byte("Title")),
+		testChunk(be, "ID3 ", testID3v2("TRCK", "3/10")),
+		testChunk(be, "SSND", make([]byte, 8+88200*3)))
+
+	dir := t.TempDir()
+	formats := DefaultFormats()
+	for _, tc := range []struct {
+		name, format string
+		data         []byte
+		info         md.AudioInfo
+		tags         map[string]string
+	}{
+		{"01.mp3", "MP3", mp3, md.AudioInfo{Samplerate: 44100, Channels: 2},
+			map[string]string{"TITLE": "Title", "TRACKNUMBER": "3/10", "ALBUM": "Album",
+				"REPLAYGAIN_TRACK_GAIN": "-1.00 dB"}},
+		{"01.dsf", "DSF", dsf, md.AudioInfo{Samplerate: 2822400, Channels: 2, SampleSize: 1},
+			map[string]string{"TITLE": "Title", "TRACKNUMBER": "3/10",
+				"REPLAYGAIN_TRACK_GAIN": "-1.00 dB"}},
+		{"01.dff", "DFF", dff, md.AudioInfo{Samplerate: 2822400, Channels: 2, SampleSize: 1},
+			map[string]string{"ARTIST": "Artist", "TITLE": "Title"}},
+		{"01.ape", "APE", ape, md.AudioInfo{Samplerate: 96000, Channels: 2, SampleSize: 24},
+			map[string]string{"TITLE": "Title"}},
+		{"01.m4a", "M4A", m4a, md.AudioInfo{Samplerate: 96000, Channels: 2, SampleSize: 24},
+			map[string]string{"TITLE": "Title", "TRACKNUMBER": "3/10",
+				"REPLAYGAIN_TRACK_GAIN": "-1.00 dB"}},
+		{"01.ogg", "Ogg Vorbis", ogg, md.AudioInfo{Samplerate: 48000, Channels: 2},
+			map[string]string{"TITLE": "Title", "TRACKNUMBER": "3", "DESCRIPTION": long[12:]}},
+		{"01.opus", "Opus", opus, md.AudioInfo{Samplerate: 48000, Channels: 1},
+			map[string]string{"TITLE": "Title", "TRACKNUMBER": "3", "DESCRIPTION": long[12:]}},
+		{"01.wav", "WAV", wav, md.AudioInfo{Samplerate: 48000, Channels: 2, SampleSize: 16,
+			AvgBitrate: 1536}, map[string]string{"TITLE": "Title", "TRACKNUMBER": "3"}},
+		{"01.aiff", "AIFF", aiff, md.AudioInfo{Samplerate: 44100, Channels: 1, SampleSize: 24},
+			map[string]string{"TITLE": "Title", "TRACKNUMBER": "3/10"}},
+	} {
+		fn := filepath.Join(dir, tc.name)
+		require.NoError(t, ioutil.WriteFile(fn, tc.data, 0644))
+		f, err := formats.Detect(fn)
+		require.NoError(t, err)
+		require.NotNil(t, f, tc.name)
+		assert.Equal(t, tc.format, f.Name)
+		ai, err := formats.ReadProperties(fn)
+		require.NoError(t, err, tc.name)
+		if tc.info.AvgBitrate == 0 {
+			ai.AvgBitrate = 0
+		}
+		assert.Equal(t, tc.info, *ai, tc.name)
+		tags, err := formats.ReadTags(fn)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.tags, tags, tc.name)
+	}
+}
+
+func TestReadID3Tags(t *testing.T) {
+	// ID3v2.4: UTF-16 с BOM и несколько значений во фрейме
+	title := []byte{1, 0xff, 0xfe}
+	for _, r := range utf16.Encode([]rune("Тест")) {
+		title = append(title, byte(r), byte(r>>8))
+	}
+	frame := append([]byte("TIT2\x00\x00\x00"), byte(len(title)), 0, 0)
+	genre := []byte("\x03Rock\x00Jazz")
+	frame = append(append(frame, title...), append([]byte("TCON\x00\x00\x00"), byte(len(genre)), 0, 0)...)
+	frame = append(frame, genre...)
+	tag := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, byte(len(frame))}, frame...)
+
+	// ID3v1.1 с номером трека
+	id3v1 := make([]byte, id3v1TagSize)
+	copy(id3v1, "TAGTitle v1")
+	copy(id3v1[33:], "Artist")
+	id3v1[126] = 7
+	data := append(append(tag, make([]byte, 16)...), id3v1...)
+
+	tags := make(map[string]string)
+	size, err := readID3v2Tags(bytes.NewReader(data), 0, tags)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(tag), size)
+	size, err = readID3v1Tags(bytes.NewReader(data), int64(len(data)), tags)
+	require.NoError(t, err)
+	assert.EqualValues(t, id3v1TagSize, size)
+	assert.Equal(t, map[string]string{
+		"TITLE": "Тест", "GENRE": "Rock;Jazz", "ARTIST": "Artist", "TRACKNUMBER": "7"}, tags)
+}
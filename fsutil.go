@@ -0,0 +1,61 @@
+package repokeeper
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// rewriteFile атомарно заменяет содержимое файла данными, записанными `write`.
+func rewriteFile(path string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if err := os.Chmod(tmp.Name(), fi.Mode()); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// фиксация переименования в каталоге
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir сбрасывает на диск записи каталога `path`.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// writeFileAtomic записывает файл через временный файл в том же каталоге.
+func writeFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	return rewriteFile(fn, func(w io.Writer) error {
+		if f, ok := w.(*os.File); ok {
+			if err := f.Chmod(perm); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -6,12 +6,14 @@ require (
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gofrs/uuid v4.0.0+incompatible
 	github.com/kr/pretty v0.3.0 // indirect
+	github.com/mewkiz/flac v1.0.10
 	github.com/sirupsen/logrus v1.8.1
 	github.com/streadway/amqp v1.0.0
 	github.com/stretchr/testify v1.7.0
 	github.com/ytsiuryn/ds-audiomd v0.3.0
 	github.com/ytsiuryn/ds-microservice v0.8.2
 	github.com/ytsiuryn/go-collection v0.0.2
-	golang.org/x/sys v0.0.0-20210817190340-bfb29a6856f2 // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/text v0.7.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
@@ -0,0 +1,53 @@
+package repokeeper
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// trackHashQueue хранит Album Entry, хеши аудиофайлов которых вычисляются в фоне,
+// чтобы не задерживать обработку событий ФС.
+type trackHashQueue struct {
+	mu   sync.Mutex
+	dirs map[string]*repoRoot
+	wake chan struct{}
+}
+
+func newTrackHashQueue() *trackHashQueue {
+	return &trackHashQueue{dirs: make(map[string]*repoRoot), wake: make(chan struct{}, 1)}
+}
+
+// hashTracks ставит Album Entry `dir` корня в очередь вычисления хешей аудиофайлов.
+func (rk *RepoKeeper) hashTracks(root *repoRoot, dir string) {
+	q := rk.hashQueue
+	q.mu.Lock()
+	q.dirs[dir] = root
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// trackHashing вычисляет хеши аудиофайлов Album Entry из очереди до остановки сервиса.
+func (rk *RepoKeeper) trackHashing() {
+	q := rk.hashQueue
+	for {
+		select {
+		case <-rk.ctx.Done():
+			return
+		case <-q.wake:
+		}
+		q.mu.Lock()
+		dirs := q.dirs
+		q.dirs = make(map[string]*repoRoot)
+		q.mu.Unlock()
+		for dir, root := range dirs {
+			err := root.entries.HashTracks(rk.ctx, dir)
+			if err != nil && !errors.Is(err, ErrNodeNotFound) && !errors.Is(err, context.Canceled) {
+				rk.Log.Error(err)
+			}
+		}
+	}
+}
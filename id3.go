@@ -0,0 +1,274 @@
+package repokeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	id3HeaderSize = 10
+	// флаги фреймов ID3v2.3 и ID3v2.4
+	id3v23FrameCompressed = 0x0080
+	id3v23FrameEncrypted  = 0x0040
+	id3v24FrameCompressed = 0x0008
+	id3v24FrameEncrypted  = 0x0004
+	id3v24FrameUnsync     = 0x0002
+	id3v24FrameDataLength = 0x0001
+)
+
+// id3FrameTags сопоставляет текстовые фреймы ID3v2 (в том числе трехсимвольные
+// фреймы версии 2.2) именам тегов Vorbis.
+var id3FrameTags = map[string]string{
+	"TIT2": "TITLE", "TT2": "TITLE",
+	"TPE1": "ARTIST", "TP1": "ARTIST",
+	"TPE2": "ALBUMARTIST", "TP2": "ALBUMARTIST",
+	"TALB": "ALBUM", "TAL": "ALBUM",
+	"TRCK": "TRACKNUMBER", "TRK": "TRACKNUMBER",
+	"TPOS": "DISCNUMBER", "TPA": "DISCNUMBER",
+	"TDRC": "DATE", "TYER": "DATE", "TYE": "DATE",
+	"TCON": "GENRE", "TCO": "GENRE",
+	"TCOM": "COMPOSER", "TCM": "COMPOSER",
+	"TPUB": "LABEL", "TPB": "LABEL",
+}
+
+// readID3v2Tags добавляет в `tags` текстовые фреймы тега ID3v2, расположенного
+// в позиции `offset`. Фреймы TXXX добавляются под именем из их описания, COMM -
+// как COMMENT. Возвращает полный размер тега или 0, если тег отсутствует.
+func readID3v2Tags(r io.ReaderAt, offset int64, tags map[string]string) (int64, error) {
+	header := make([]byte, id3HeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	size := id3v2Size(header)
+	if size == 0 {
+		return 0, nil
+	}
+	version, flags := header[3], header[5]
+	if version < 2 || version > 4 {
+		return size, nil
+	}
+	body := make([]byte, synchsafe(header[6:]))
+	n, err := r.ReadAt(body, offset+id3HeaderSize)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	body = body[:n]
+	if version < 4 && flags&0x80 != 0 {
+		body = id3Resync(body)
+	}
+	if flags&0x40 != 0 && version > 2 {
+		if len(body) < 4 {
+			return 0, errors.New("invalid ID3v2 extended header")
+		}
+		ext := int64(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			ext = synchsafe(body)
+		}
+		if ext > int64(len(body)) {
+			return 0, errors.New("invalid ID3v2 extended header")
+		}
+		body = body[ext:]
+	}
+	idSize, frameHeaderSize := 4, 10
+	if version == 2 {
+		idSize, frameHeaderSize = 3, 6
+	}
+	for len(body) >= frameHeaderSize && body[0] != 0 {
+		id := string(body[:idSize])
+		var frameSize int64
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int64(body[3])<<16 | int64(body[4])<<8 | int64(body[5])
+		case 3:
+			frameSize = int64(binary.BigEndian.Uint32(body[4:]))
+			frameFlags = binary.BigEndian.Uint16(body[8:])
+		default:
+			frameSize = synchsafe(body[4:])
+			frameFlags = binary.BigEndian.Uint16(body[8:])
+		}
+		if frameSize > int64(len(body)-frameHeaderSize) {
+			return 0, errors.New("invalid ID3v2 frame")
+		}
+		data := body[frameHeaderSize : int64(frameHeaderSize)+frameSize]
+		body = body[int64(frameHeaderSize)+frameSize:]
+		switch {
+		case version == 3 && frameFlags&(id3v23FrameCompressed|id3v23FrameEncrypted) != 0,
+			version == 4 && frameFlags&(id3v24FrameCompressed|id3v24FrameEncrypted) != 0:
+			// сжатые и зашифрованные фреймы пропускаются
+			continue
+		case version == 4:
+			if frameFlags&id3v24FrameDataLength != 0 {
+				if len(data) < 4 {
+					continue
+				}
+				data = data[4:]
+			}
+			if frameFlags&id3v24FrameUnsync != 0 {
+				data = id3Resync(data)
+			}
+		}
+		addID3Frame(tags, id, data)
+	}
+	return size, nil
+}
+
+// addID3Frame добавляет в `tags` значение текстового фрейма ID3v2.
+func addID3Frame(tags map[string]string, id string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	enc, data := data[0], data[1:]
+	switch {
+	case id == "TXXX" || id == "TXX":
+		values := id3Strings(enc, data)
+		if len(values) > 1 && values[0] != "" {
+			addTag(tags, strings.ToUpper(values[0]), strings.Join(values[1:], ";"))
+		}
+	case id == "COMM" || id == "COM":
+		if len(data) < 3 {
+			return
+		}
+		// язык, краткое описание и текст комментария
+		values := id3Strings(enc, data[3:])
+		if len(values) > 1 && values[0] == "" {
+			addTag(tags, "COMMENT", strings.Join(values[1:], ";"))
+		}
+	default:
+		if key, ok := id3FrameTags[id]; ok {
+			if values := id3Strings(enc, data); len(values) > 0 {
+				addTag(tags, key, strings.Join(values, ";"))
+			}
+		}
+	}
+}
+
+// id3Strings декодирует строки текстового фрейма, разделенные нулевым символом.
+func id3Strings(enc byte, data []byte) []string {
+	var sep []byte
+	switch enc {
+	case 1, 2:
+		sep = []byte{0, 0}
+	default:
+		sep = []byte{0}
+	}
+	var ret []string
+	for len(data) > 0 {
+		i := 0
+		for ; i+len(sep) <= len(data); i += len(sep) {
+			if bytes.Equal(data[i:i+len(sep)], sep) {
+				break
+			}
+		}
+		if i+len(sep) > len(data) {
+			i = len(data)
+		}
+		ret = append(ret, decodeID3String(enc, data[:i]))
+		if i+len(sep) > len(data) {
+			break
+		}
+		data = data[i+len(sep):]
+	}
+	// завершающий нулевой символ не образует пустого значения
+	for len(ret) > 1 && ret[len(ret)-1] == "" {
+		ret = ret[:len(ret)-1]
+	}
+	return ret
+}
+
+// decodeID3String декодирует строку в кодировке ID3v2: 0 - ISO-8859-1,
+// 1 - UTF-16 с BOM, 2 - UTF-16BE, 3 - UTF-8.
+func decodeID3String(enc byte, data []byte) string {
+	switch enc {
+	case 1, 2:
+		var order binary.ByteOrder = binary.BigEndian
+		if enc == 1 && len(data) >= 2 {
+			if data[0] == 0xff && data[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			if data[0] == 0xff && data[1] == 0xfe || data[0] == 0xfe && data[1] == 0xff {
+				data = data[2:]
+			}
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return string(utf16.Decode(units))
+	case 3:
+		return string(data)
+	}
+	return latin1String(data)
+}
+
+// latin1String декодирует строку в кодировке ISO-8859-1.
+func latin1String(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// id3Resync удаляет байты синхронизации (0x00 после 0xFF).
+func id3Resync(data []byte) []byte {
+	ret := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		ret = append(ret, data[i])
+		if data[i] == 0xff && i+1 < len(data) && data[i+1] == 0 {
+			i++
+		}
+	}
+	return ret
+}
+
+// synchsafe декодирует 28-битное целое число ID3v2 (7 бит в каждом из 4 байтов).
+func synchsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 | int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+// readID3v1Tags добавляет в `tags` отсутствующие в них значения тега ID3v1,
+// расположенного в конце данных размером `size`. Возвращает размер тега или 0.
+func readID3v1Tags(r io.ReaderAt, size int64, tags map[string]string) (int64, error) {
+	if size < id3v1TagSize {
+		return 0, nil
+	}
+	buf := make([]byte, id3v1TagSize)
+	if _, err := r.ReadAt(buf, size-id3v1TagSize); err != nil {
+		return 0, err
+	}
+	if string(buf[:3]) != "TAG" {
+		return 0, nil
+	}
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimSpace(latin1String(b))
+	}
+	values := map[string]string{
+		"TITLE":   field(buf[3:33]),
+		"ARTIST":  field(buf[33:63]),
+		"ALBUM":   field(buf[63:93]),
+		"DATE":    field(buf[93:97]),
+		"COMMENT": field(buf[97:127])}
+	// ID3v1.1: номер трека в последнем байте комментария
+	if buf[125] == 0 && buf[126] != 0 {
+		values["COMMENT"] = field(buf[97:125])
+		values["TRACKNUMBER"] = strconv.Itoa(int(buf[126]))
+	}
+	for key, value := range values {
+		if _, ok := tags[key]; !ok && value != "" {
+			tags[key] = value
+		}
+	}
+	return id3v1TagSize, nil
+}
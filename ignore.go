@@ -0,0 +1,226 @@
+package repokeeper
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// IgnoreFileName - имя файла с правилами исключения в каталогах репозитория.
+// Правила файла действуют на содержимое каталога, в котором он находится.
+const IgnoreFileName = ".repoignore"
+
+// DefaultIgnorePatterns - служебные каталоги ФС и NAS, исключаемые по умолчанию.
+var DefaultIgnorePatterns = []string{
+	"@eaDir/",
+	".Trash-*/",
+	"lost+found/",
+	"$RECYCLE.BIN/",
+	"System Volume Information/",
+}
+
+// IgnoreRules исключает файлы и каталоги репозитория из сканирования, наблюдения
+// и обработки командами.
+// Шаблоны записываются в формате .gitignore: `#` - комментарий, `!` - отмена
+// исключения, `/` в конце - только каталоги, шаблон с `/` в начале или середине
+// сопоставляется с путем относительно каталога правил, иначе - с именем на любом
+// уровне вложенности, `**` - любое число каталогов. Правила вложенных каталогов
+// применяются после общих правил и правил родительских каталогов; исключение
+// каталога исключает все его содержимое.
+// Нулевой указатель на IgnoreRules ничего не исключает.
+type IgnoreRules struct {
+	root   string
+	global []ignorePattern
+	mu     sync.RWMutex
+	dirs   map[string][]ignorePattern
+}
+
+// ignorePattern - разобранный шаблон исключения. `segs` содержит элементы пути
+// шаблона относительно каталога `base`.
+type ignorePattern struct {
+	base    string
+	segs    []string
+	negate  bool
+	dirOnly bool
+}
+
+// NewIgnoreRules создает правила исключения для корня репозитория `root` с общими
+// шаблонами `patterns`.
+func NewIgnoreRules(root string, patterns []string) (*IgnoreRules, error) {
+	root = filepath.Clean(root)
+	r := &IgnoreRules{root: root, dirs: make(map[string][]ignorePattern)}
+	for _, line := range patterns {
+		p, ok, err := parseIgnorePattern(root, line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			r.global = append(r.global, p)
+		}
+	}
+	return r, nil
+}
+
+// parseIgnorePattern разбирает строку шаблона. Возвращает false для пустых строк
+// и комментариев.
+func parseIgnorePattern(base, line string) (p ignorePattern, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	p.base = base
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	p.segs = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	for _, seg := range p.segs {
+		if _, err = filepath.Match(seg, ""); err != nil {
+			return
+		}
+	}
+	return p, true, nil
+}
+
+// Excluded проверяет, исключен ли файл или каталог `path` (с учетом его родительских
+// каталогов).
+func (r *IgnoreRules) Excluded(path string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	rel, err := relativePath(r.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	dir := r.root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		if dir == path {
+			break
+		}
+		if r.match(dir, true) {
+			return true
+		}
+	}
+	return r.match(path, isDir)
+}
+
+// Reload сбрасывает загруженные правила файла IgnoreFileName каталога `dir`.
+func (r *IgnoreRules) Reload(dir string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.dirs, filepath.Clean(dir))
+	r.mu.Unlock()
+}
+
+// Walk обходит дерево каталога `dir` аналогично filepath.Walk, пропуская исключенные
+// файлы и каталоги. Сам каталог `dir` не проверяется.
+func (r *IgnoreRules) Walk(dir string, fn filepath.WalkFunc) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && path != dir && r.match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(path, info, err)
+	})
+}
+
+// match проверяет шаблоны исключения для `path` без учета исключения родительских
+// каталогов.
+func (r *IgnoreRules) match(path string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	rel, err := relativePath(r.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	excluded := matchIgnorePatterns(r.global, path, isDir, false)
+	dir := r.root
+	names := strings.Split(rel, string(filepath.Separator))
+	for _, name := range names[:len(names)-1] {
+		excluded = matchIgnorePatterns(r.dirPatterns(dir), path, isDir, excluded)
+		dir = filepath.Join(dir, name)
+	}
+	return matchIgnorePatterns(r.dirPatterns(dir), path, isDir, excluded)
+}
+
+// matchIgnorePatterns применяет шаблоны к `path`, результат определяется последним
+// совпавшим шаблоном.
+func matchIgnorePatterns(patterns []ignorePattern, path string, isDir, excluded bool) bool {
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(p.base, path)
+		if err != nil {
+			continue
+		}
+		if matchIgnoreSegs(p.segs, strings.Split(filepath.ToSlash(rel), "/")) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+func matchIgnoreSegs(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchIgnoreSegs(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	ok, _ := filepath.Match(pattern[0], path[0])
+	return ok && matchIgnoreSegs(pattern[1:], path[1:])
+}
+
+// dirPatterns возвращает шаблоны файла IgnoreFileName каталога `dir`.
+// Некорректные шаблоны пропускаются.
+func (r *IgnoreRules) dirPatterns(dir string) []ignorePattern {
+	r.mu.RLock()
+	patterns, ok := r.dirs[dir]
+	r.mu.RUnlock()
+	if ok {
+		return patterns
+	}
+	if f, err := os.Open(filepath.Join(dir, IgnoreFileName)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if p, ok, err := parseIgnorePattern(dir, scanner.Text()); ok && err == nil {
+				patterns = append(patterns, p)
+			}
+		}
+		f.Close()
+	}
+	r.mu.Lock()
+	r.dirs[dir] = patterns
+	r.mu.Unlock()
+	return patterns
+}
@@ -0,0 +1,133 @@
+package repokeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "artist/album/extras"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "artist", IgnoreFileName),
+		[]byte("# comment\n\nextras/\n*.tmp\n!keep.tmp\n/album/*.log\n"), 0644))
+	r, err := NewIgnoreRules(root, append(DefaultIgnorePatterns, "_incoming/", "**/sample/**"))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"@eaDir", true, true},
+		{"artist/album/@eaDir", true, true},
+		{"artist/album/@eaDir/x.flac", false, true},
+		{".Trash-1000", true, true},
+		{"_incoming/new/01.flac", false, true},
+		{"artist/_incoming", true, true},
+		{"artist/album/sample/01.flac", false, true},
+		{"artist/album/extras", true, true},
+		{"artist/album/extras/01.flac", false, true},
+		{"extras", true, false},
+		{"artist/album/01.tmp", false, true},
+		{"artist/album/keep.tmp", false, false},
+		{"01.tmp", false, false},
+		{"artist/album/rip.log", false, true},
+		{"artist/album/cd1/rip.log", false, false},
+		{"artist/album/01.flac", false, false},
+	} {
+		assert.Equal(t, tc.excluded, r.Excluded(filepath.Join(root, tc.path), tc.isDir), tc.path)
+	}
+	// шаблон только для каталогов
+	assert.False(t, r.Excluded(filepath.Join(root, "artist/album/_incoming"), false))
+	// пути вне корня не исключаются
+	assert.False(t, r.Excluded("/other/@eaDir", true))
+
+	// изменение файла правил
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "artist", IgnoreFileName), nil, 0644))
+	assert.True(t, r.Excluded(filepath.Join(root, "artist/album/01.tmp"), false))
+	r.Reload(filepath.Join(root, "artist"))
+	assert.False(t, r.Excluded(filepath.Join(root, "artist/album/01.tmp"), false))
+
+	_, err = NewIgnoreRules(root, []string{"[a-"})
+	assert.Error(t, err)
+	var none *IgnoreRules
+	assert.False(t, none.Excluded(filepath.Join(root, "@eaDir"), true))
+}
+
+func TestEntriesScanIgnore(t *testing.T) {
+	flac, err := ioutil.ReadFile("testdata/repo/flac/flac/test.flac")
+	require.NoError(t, err)
+	root := t.TempDir()
+	for _, fn := range []string{
+		"artist/album/01.flac",
+		"artist/album/@eaDir/01.flac",
+		"_incoming/album/01.flac",
+		"artist/skipped/01.flac",
+		"artist/partial/01.flac",
+		"artist/partial/02.flac",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, filepath.Dir(fn)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, fn), flac, 0644))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "artist", IgnoreFileName),
+		[]byte("skipped/\npartial/02.flac\n"), 0644))
+
+	ent := NewEntries(root, DefaultFormats())
+	ent.Ignore, err = NewIgnoreRules(root, append(DefaultIgnorePatterns, "_incoming/"))
+	require.NoError(t, err)
+	require.NoError(t, ent.Calculate(root))
+	assert.Equal(t, []string{
+		filepath.Join(root, "artist/album"),
+		filepath.Join(root, "artist/partial"),
+	}, ent.AlbumEntries())
+	assert.Len(t, ent.Cache[filepath.Join(root, "artist/partial")].Files, 1)
+
+	files, err := entryAudioFiles(filepath.Join(root, "artist"), DefaultFormats(), ent.Ignore)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"album/01.flac", "partial/01.flac"}, files)
+}
+
+func TestRepoKeeperIgnoreFileChanged(t *testing.T) {
+	root := t.TempDir()
+	writeTestTracks(t, filepath.Join(root, "artist", "album1"), "01.flac", "02.flac")
+	writeTestTracks(t, filepath.Join(root, "artist", "album2"), "01.flac")
+	rules := filepath.Join(root, "artist", IgnoreFileName)
+	require.NoError(t, ioutil.WriteFile(rules, []byte("album2/\n"), 0644))
+	rk := newTestKeeper(t, root)
+	rk.settleDelay = 0
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		events = append(events, string(data))
+		return nil
+	}
+	rk.applyChangesBetweenSessions()
+	rk.addWatchPoints()
+	album1, album2 := filepath.Join(root, "artist", "album1"), filepath.Join(root, "artist", "album2")
+	assert.Equal(t, []string{album1}, rk.roots[0].entries.AlbumEntries())
+	assert.NotContains(t, watchedDirs(rk), album2)
+
+	id1 := rk.entryID(album1)
+	require.NoError(t, ioutil.WriteFile(rules, []byte("album1/\nalbum2/02.flac\n"), 0644))
+	rk.onFsEvent(fsnotify.Event{Name: rules, Op: fsnotify.Write})
+	assert.Equal(t, []string{album2}, rk.roots[0].entries.AlbumEntries())
+	require.Len(t, events, 2)
+	assert.Equal(t, "dir deleted: default:artist/album1; id="+id1, events[0])
+	assert.Contains(t, events[1], "dir created: default:artist/album2; tracks=1; id=")
+	assert.NotContains(t, watchedDirs(rk), album1)
+	assert.Contains(t, watchedDirs(rk), album2)
+
+	// исключение файла Album Entry
+	events = nil
+	id2 := rk.entryID(album2)
+	require.NoError(t, ioutil.WriteFile(rules, []byte("album2/01.flac\n"), 0644))
+	rk.onFsEvent(fsnotify.Event{Name: rules, Op: fsnotify.Write})
+	require.NotEmpty(t, events)
+	assert.Equal(t, "dir deleted: default:artist/album2; id="+id2, events[0])
+	assert.Contains(t, rk.roots[0].entries.AlbumEntries(), album1)
+}
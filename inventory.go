@@ -0,0 +1,263 @@
+package repokeeper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// TrackChange - тип изменения файла трека Album Entry.
+type TrackChange uint8
+
+// Допустимые изменения файлов треков.
+// При замене файл с тем же именем является другим файловым объектом (другой inode),
+// при модификации изменены размер, время изменения или хеш содержимого файла.
+const (
+	AddedTrackChange TrackChange = iota + 1
+	RemovedTrackChange
+	ReplacedTrackChange
+	ModifiedTrackChange
+)
+
+func (c TrackChange) String() string {
+	switch c {
+	case AddedTrackChange:
+		return "added"
+	case RemovedTrackChange:
+		return "removed"
+	case ReplacedTrackChange:
+		return "replaced"
+	case ModifiedTrackChange:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// TrackFile описывает аудиофайл Album Entry в кеше.
+// `ModTime` содержит время изменения файла в наносекундах Unix, `Format` - имя
+// формата из реестра форматов. `Hash` (SHA-256 содержимого) вычисляется только
+// при включенном хешировании треков, `PartialHash` (SHA-256 начала и конца файла)
+// используется для опознания Album Entry, перемещенного между ФС (FingerprintMatch).
+type TrackFile struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"mod_time"`
+	Inode       uint64 `json:"inode"`
+	Format      string `json:"format"`
+	Hash        string `json:"hash,omitempty"`
+	PartialHash string `json:"partial_hash,omitempty"`
+}
+
+// TrackModification описывает изменение файла трека с именем `Name`.
+type TrackModification struct {
+	Change TrackChange `json:"change"`
+	Name   string      `json:"name"`
+}
+
+// readInventory возвращает отсортированный по имени список аудиофайлов каталога.
+// Аудиофайлы, не изменившиеся относительно списка `prev` (имя, размер, время изменения,
+// inode), берутся из него без определения формата и хеширования. Хеши новых и
+// измененных файлов вычисляются при `hash`.
+func (ent *Entries) readInventory(dir string, prev []TrackFile, hash bool) ([]TrackFile, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := ent.readDirInventory(dir, files, prev)
+	if err != nil || !hash {
+		return ret, err
+	}
+	return ent.hashTracks(dir, ret)
+}
+
+// readDirInventory формирует список аудиофайлов по прочитанному содержимому каталога
+// `files` без вычисления хешей (см. readInventory). Сведения о файлах запрашиваются
+// только для не исключенных правилами файлов с расширениями форматов реестра.
+func (ent *Entries) readDirInventory(dir string, files []fs.DirEntry, prev []TrackFile) ([]TrackFile, error) {
+	prevByName := make(map[string]*TrackFile, len(prev))
+	for i := range prev {
+		prevByName[prev[i].Name] = &prev[i]
+	}
+	var ret []TrackFile
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if f.Type()&fs.ModeSymlink != 0 && ent.Symlinks != FollowSymlinks ||
+			ent.formats.ByExtension(path) == nil || ent.Ignore.match(path, false) {
+			continue
+		}
+		var info fs.FileInfo
+		var err error
+		if f.Type()&fs.ModeSymlink != 0 {
+			info, err = os.Stat(path)
+		} else {
+			info, err = f.Info()
+		}
+		if err != nil || info.IsDir() {
+			// файл удален после чтения каталога или ссылка на каталог
+			continue
+		}
+		id, err := FileIDByInfo(info)
+		if err != nil {
+			return nil, err
+		}
+		track := TrackFile{
+			Name:    info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Inode:   id.Inode}
+		if p, ok := prevByName[f.Name()]; ok && p.sameFile(&track) {
+			track = *p
+		} else {
+			format, err := ent.formats.Detect(path)
+			if err != nil || format == nil {
+				continue
+			}
+			track.Format = format.Name
+		}
+		ret = append(ret, track)
+	}
+	return ret, nil
+}
+
+// hashTracks вычисляет отсутствующие хеши аудиофайлов `tracks` каталога `dir`.
+// Файлы, удаленные после чтения каталога, исключаются из списка.
+func (ent *Entries) hashTracks(dir string, tracks []TrackFile) ([]TrackFile, error) {
+	ret := tracks[:0]
+	for _, track := range tracks {
+		if err := ent.hashTrack(filepath.Join(dir, track.Name), &track); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ret = append(ret, track)
+	}
+	return ret, nil
+}
+
+// sameFile проверяет совпадение имени, размера, времени изменения и inode файлов.
+func (track *TrackFile) sameFile(other *TrackFile) bool {
+	return track.Name == other.Name && track.Size == other.Size &&
+		track.ModTime == other.ModTime && track.Inode == other.Inode
+}
+
+// hashTrack вычисляет отсутствующие хеши аудиофайла `path`: частичный всегда,
+// полный - при включенном хешировании треков.
+func (ent *Entries) hashTrack(path string, track *TrackFile) (err error) {
+	if track.PartialHash == "" {
+		if track.PartialHash, err = partialHash(path, track.Size); err != nil {
+			return err
+		}
+	}
+	if ent.TrackHashes && track.Hash == "" {
+		if track.Hash, err = fileHash(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HashTracks вычисляет отсутствующие хеши аудиофайлов Album Entry `dir`, добавленных
+// или обновленных UpdateAlbumEntry. Хеш сохраняется в кеше, только если файл
+// не изменился за время вычисления; удаленные файлы пропускаются.
+func (ent *Entries) HashTracks(ctx context.Context, dir string) error {
+	elem, err := ent.Get(dir)
+	if err != nil {
+		return err
+	}
+	for _, track := range elem.Files {
+		if track.PartialHash != "" && (track.Hash != "" || !ent.TrackHashes) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, track.Name)
+		if err := ent.hashTrack(path, &track); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		id, err := FileIDByInfo(info)
+		if err != nil {
+			return err
+		}
+		if !track.sameFile(&TrackFile{Name: track.Name, Size: info.Size(),
+			ModTime: info.ModTime().UnixNano(), Inode: id.Inode}) {
+			continue
+		}
+		ent.setTrackHashes(dir, &track)
+	}
+	return nil
+}
+
+// setTrackHashes сохраняет хеши аудиофайла Album Entry `dir`, если он не изменился
+// в кеше.
+func (ent *Entries) setTrackHashes(dir string, track *TrackFile) {
+	ent.mu.Lock()
+	defer ent.mu.Unlock()
+	elem, ok := ent.Cache[dir]
+	if !ok {
+		return
+	}
+	for i := range elem.Files {
+		if f := &elem.Files[i]; f.sameFile(track) {
+			f.PartialHash, f.Hash = track.PartialHash, track.Hash
+			ent.touch(dir)
+			return
+		}
+	}
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CompareTracks сравнивает списки файлов треков `old` и `cur` по именам файлов.
+// Хеши содержимого сравниваются, только если они есть в обоих списках.
+func CompareTracks(old, cur []TrackFile) []TrackModification {
+	var ret []TrackModification
+	oldByName := make(map[string]*TrackFile, len(old))
+	for i := range old {
+		oldByName[old[i].Name] = &old[i]
+	}
+	for i := range cur {
+		track := &cur[i]
+		prev, ok := oldByName[track.Name]
+		switch {
+		case !ok:
+			ret = append(ret, TrackModification{Change: AddedTrackChange, Name: track.Name})
+		case prev.Inode != track.Inode:
+			ret = append(ret, TrackModification{Change: ReplacedTrackChange, Name: track.Name})
+		case prev.Size != track.Size, prev.ModTime != track.ModTime,
+			prev.Hash != "" && track.Hash != "" && prev.Hash != track.Hash:
+			ret = append(ret, TrackModification{Change: ModifiedTrackChange, Name: track.Name})
+		}
+		delete(oldByName, track.Name)
+	}
+	for name := range oldByName {
+		ret = append(ret, TrackModification{Change: RemovedTrackChange, Name: name})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
@@ -0,0 +1,142 @@
+package repokeeper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareTracks(t *testing.T) {
+	old := []TrackFile{
+		{Name: "01.flac", Size: 10, ModTime: 1, Inode: 1},
+		{Name: "02.flac", Size: 10, ModTime: 1, Inode: 2},
+		{Name: "03.flac", Size: 10, ModTime: 1, Inode: 3, Hash: "a"},
+		{Name: "04.flac", Size: 10, ModTime: 1, Inode: 4},
+	}
+	cur := []TrackFile{
+		{Name: "01.flac", Size: 10, ModTime: 1, Inode: 1},
+		{Name: "02.flac", Size: 10, ModTime: 1, Inode: 5},
+		{Name: "03.flac", Size: 10, ModTime: 1, Inode: 3, Hash: "b"},
+		{Name: "05.flac", Size: 10, ModTime: 1, Inode: 6},
+	}
+	assert.Equal(t, []TrackModification{
+		{Change: ReplacedTrackChange, Name: "02.flac"},
+		{Change: ModifiedTrackChange, Name: "03.flac"},
+		{Change: RemovedTrackChange, Name: "04.flac"},
+		{Change: AddedTrackChange, Name: "05.flac"},
+	}, CompareTracks(old, cur))
+	assert.Empty(t, CompareTracks(old, old))
+}
+
+func TestEntriesTrackInventory(t *testing.T) {
+	flac, err := ioutil.ReadFile("testdata/repo/flac/flac/test.flac")
+	require.NoError(t, err)
+	root := t.TempDir()
+	album := filepath.Join(root, "album")
+	require.NoError(t, os.Mkdir(album, 0755))
+	for _, name := range []string{"01.flac", "02.flac", "03.flac", "04.flac"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(album, name), flac, 0644))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(album, "cover.jpg"), []byte("jpg"), 0644))
+
+	old := NewEntries(root, DefaultFormats())
+	old.TrackHashes = true
+	require.NoError(t, old.Calculate(root))
+	require.Len(t, old.Cache[album].Files, 4)
+	assert.Equal(t, "FLAC", old.Cache[album].Files[0].Format)
+	fn := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, old.SaveTo(fn))
+	loaded := NewEntries(root, DefaultFormats())
+	require.NoError(t, loaded.LoadFrom(fn))
+
+	// изменения, внесенные при остановленном сервисе
+	require.NoError(t, ioutil.WriteFile(filepath.Join(album, "05.flac"), flac, 0644))
+	require.NoError(t, os.Remove(filepath.Join(album, "04.flac")))
+	tmp := filepath.Join(album, "02.tmp")
+	require.NoError(t, ioutil.WriteFile(tmp, flac, 0644))
+	require.NoError(t, os.Rename(tmp, filepath.Join(album, "02.flac")))
+	// содержимое изменено без изменения размера и времени модификации
+	fn3 := filepath.Join(album, "03.flac")
+	info, err := os.Stat(fn3)
+	require.NoError(t, err)
+	modified := append([]byte(nil), flac...)
+	modified[len(modified)-1]++
+	require.NoError(t, ioutil.WriteFile(fn3, modified, 0644))
+	require.NoError(t, os.Chtimes(fn3, time.Now(), info.ModTime()))
+
+	cur := NewEntries(root, DefaultFormats())
+	cur.TrackHashes = true
+	require.NoError(t, cur.Calculate(root))
+	require.NoError(t, cur.InheritEntryIDs(loaded))
+	changes, err := cur.Compare(loaded)
+	require.NoError(t, err)
+	assert.Equal(t, DirModification{
+		Change:  ModifiedFsChange,
+		Kind:    AlbumEntryNode,
+		EntryID: old.Cache[album].EntryID,
+		Tracks: []TrackModification{
+			{Change: ReplacedTrackChange, Name: "02.flac"},
+			{Change: ModifiedTrackChange, Name: "03.flac"},
+			{Change: RemovedTrackChange, Name: "04.flac"},
+			{Change: AddedTrackChange, Name: "05.flac"},
+		}}, changes[album])
+
+	// переименование каталога с изменением треков
+	renamed := filepath.Join(root, "album2")
+	require.NoError(t, os.Rename(album, renamed))
+	cur = NewEntries(root, DefaultFormats())
+	require.NoError(t, cur.Calculate(root))
+	require.NoError(t, cur.InheritEntryIDs(loaded))
+	assert.Equal(t, old.Cache[album].EntryID, cur.Cache[renamed].EntryID)
+	changes, err = cur.Compare(loaded)
+	require.NoError(t, err)
+	assert.Equal(t, RenamedFsChange, changes[album].Change)
+	assert.Equal(t, renamed, changes[album].NewName)
+	assert.Len(t, changes[album].Tracks, 3)
+}
+
+func TestEntriesUpdateAlbumEntry(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "album")
+	writeTestTracks(t, album, "01.flac", "02.flac")
+	ent := NewEntries(root, DefaultFormats())
+	require.NoError(t, ent.AddAlbumEntry(album))
+	elem, err := ent.Get(album)
+	require.NoError(t, err)
+	require.Len(t, elem.Files, 2)
+	require.NotEmpty(t, elem.Files[0].PartialHash)
+
+	// неизмененные файлы не определяются и не хешируются повторно
+	ent.mu.Lock()
+	ent.Cache[album].Files[0].Format = "cached"
+	ent.mu.Unlock()
+	writeTestTracks(t, album, "03.flac")
+	require.NoError(t, ent.UpdateAlbumEntry(album))
+	elem, err = ent.Get(album)
+	require.NoError(t, err)
+	require.Len(t, elem.Files, 3)
+	assert.Equal(t, "cached", elem.Files[0].Format)
+	assert.Equal(t, "FLAC", elem.Files[2].Format)
+	assert.Empty(t, elem.Files[2].PartialHash)
+
+	require.NoError(t, ent.HashTracks(context.Background(), album))
+	elem, err = ent.Get(album)
+	require.NoError(t, err)
+	assert.Equal(t, elem.Files[0].PartialHash, elem.Files[2].PartialHash)
+
+	// хеш не сохраняется для файла, удаленного до вычисления
+	writeTestTracks(t, album, "04.flac")
+	require.NoError(t, ent.UpdateAlbumEntry(album))
+	require.NoError(t, os.Remove(filepath.Join(album, "04.flac")))
+	require.NoError(t, ent.HashTracks(context.Background(), album))
+	elem, err = ent.Get(album)
+	require.NoError(t, err)
+	require.Len(t, elem.Files, 4)
+	assert.Empty(t, elem.Files[3].PartialHash)
+}
@@ -0,0 +1,81 @@
+package repokeeper
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// JobProgress описывает событие о ходе выполнения фоновой задачи.
+// Событие публикуется после обработки каждого каталога альбома и по завершении задачи.
+type JobProgress struct {
+	Job       string           `json:"job"`
+	Cmd       string           `json:"cmd"`
+	Path      string           `json:"path,omitempty"`
+	EntryID   string           `json:"entry_id,omitempty"`
+	Done      int              `json:"done"`
+	Total     int              `json:"total"`
+	Loudness  *EntryLoudness   `json:"loudness,omitempty"`
+	Transcode *TranscodeReport `json:"transcode,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Finished  bool             `json:"finished,omitempty"`
+	Canceled  bool             `json:"canceled,omitempty"`
+}
+
+// jobRegistry хранит функции отмены выполняющихся фоновых задач.
+type jobRegistry struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{cancels: make(map[string]context.CancelFunc)}
+}
+
+// start запускает задачу в отдельной горутине и возвращает ее идентификатор.
+func (jr *jobRegistry) start(run func(ctx context.Context, id string)) string {
+	id, _ := uuid.NewV4()
+	ctx, cancel := context.WithCancel(context.Background())
+	jr.mu.Lock()
+	jr.cancels[id.String()] = cancel
+	jr.wg.Add(1)
+	jr.mu.Unlock()
+	go func() {
+		defer jr.wg.Done()
+		defer jr.finish(id.String())
+		run(ctx, id.String())
+	}()
+	return id.String()
+}
+
+func (jr *jobRegistry) finish(id string) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if cancel, ok := jr.cancels[id]; ok {
+		cancel()
+		delete(jr.cancels, id)
+	}
+}
+
+// cancel отменяет задачу. Возвращает false, если задача не найдена.
+func (jr *jobRegistry) cancel(id string) bool {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	cancel, ok := jr.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// cancelAll отменяет все задачи и ожидает их завершения.
+func (jr *jobRegistry) cancelAll() {
+	jr.mu.Lock()
+	for _, cancel := range jr.cancels {
+		cancel()
+	}
+	jr.mu.Unlock()
+	jr.wg.Wait()
+}
@@ -0,0 +1,336 @@
+package repokeeper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Параметры измерения громкости по ITU-R BS.1770 / EBU R128.
+const (
+	loudnessBlockMs     = 400   // длительность блока стробирования
+	loudnessStepMs      = 100   // шаг блоков (перекрытие 75%)
+	loudnessAbsGate     = -70.0 // абсолютный порог стробирования, LUFS (и нижняя граница значений)
+	loudnessRelGate     = -10.0 // относительный порог стробирования, LU
+	replayGainReference = -18.0 // опорный уровень ReplayGain 2.0, LUFS
+	truePeakTaps        = 12    // число отводов интерполирующего фильтра на фазу
+)
+
+// TrackLoudness описывает громкость трека.
+// `Integrated` - интегральная громкость в LUFS, `TruePeak` - истинный пик в dBTP.
+// `Gain` и `Peak` - значения ReplayGain 2.0 (дБ и линейный пик).
+type TrackLoudness struct {
+	File       string  `json:"file"`
+	Integrated float64 `json:"integrated"`
+	TruePeak   float64 `json:"true_peak"`
+	Gain       float64 `json:"gain"`
+	Peak       float64 `json:"peak"`
+	blocks     []float64
+}
+
+// EntryLoudness описывает громкость треков альбома и альбома в целом.
+type EntryLoudness struct {
+	Path       string           `json:"path"`
+	Tracks     []*TrackLoudness `json:"tracks,omitempty"`
+	Integrated float64          `json:"integrated"`
+	TruePeak   float64          `json:"true_peak"`
+	Gain       float64          `json:"gain"`
+	Peak       float64          `json:"peak"`
+}
+
+// MeasureLoudness вычисляет громкость аудиофайла FLAC.
+func MeasureLoudness(ctx context.Context, path string) (*TrackLoudness, error) {
+	dec, err := openPCM(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	meter := newLoudnessMeter(dec.SampleRate())
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		channels, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		meter.add(channels)
+	}
+	tl := &TrackLoudness{
+		File:       path,
+		Integrated: gatedLoudness(meter.blocks),
+		Peak:       meter.peak,
+		blocks:     meter.blocks}
+	tl.TruePeak = linearToDB(tl.Peak)
+	tl.Gain = replayGain(tl.Integrated)
+	return tl, nil
+}
+
+// MeasureEntryLoudness вычисляет громкость всех lossless-треков каталога альбома.
+// Громкость альбома вычисляется по объединенному набору блоков всех треков.
+// Файлы, исключенные правилами `ignore`, не учитываются. Для альбома с треками,
+// декодирование которых не поддерживается (WavPack), возвращается ошибка
+// ErrPCMUnsupported: громкость альбома по части треков была бы неверной.
+func MeasureEntryLoudness(ctx context.Context, dir string, ignore *IgnoreRules) (*EntryLoudness, error) {
+	var files []string
+	err := ignore.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isLossless(path) {
+			return nil
+		}
+		if !isPCMDecodable(path) {
+			return fmt.Errorf("%w: %s", ErrPCMUnsupported, path)
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	el := &EntryLoudness{Path: dir}
+	var blocks []float64
+	for _, fn := range files {
+		tl, err := MeasureLoudness(ctx, fn)
+		if err != nil {
+			return nil, err
+		}
+		el.Tracks = append(el.Tracks, tl)
+		blocks = append(blocks, tl.blocks...)
+		el.Peak = math.Max(el.Peak, tl.Peak)
+	}
+	el.Integrated = gatedLoudness(blocks)
+	el.TruePeak = linearToDB(el.Peak)
+	el.Gain = replayGain(el.Integrated)
+	return el, nil
+}
+
+// ReplayGainTags формирует теги ReplayGain для трека альбома.
+func (el *EntryLoudness) ReplayGainTags(tl *TrackLoudness) map[string]string {
+	return map[string]string{
+		"REPLAYGAIN_TRACK_GAIN":         formatGain(tl.Gain),
+		"REPLAYGAIN_TRACK_PEAK":         formatPeak(tl.Peak),
+		"REPLAYGAIN_ALBUM_GAIN":         formatGain(el.Gain),
+		"REPLAYGAIN_ALBUM_PEAK":         formatPeak(el.Peak),
+		"REPLAYGAIN_REFERENCE_LOUDNESS": formatLUFS(replayGainReference)}
+}
+
+// WriteReplayGain записывает теги ReplayGain во все треки альбома.
+func (el *EntryLoudness) WriteReplayGain() error {
+	for _, tl := range el.Tracks {
+		if err := WriteReplayGainTags(tl.File, el.ReplayGainTags(tl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// biquad - фильтр второго порядка (прямая форма II, транспонированная).
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// kWeighting создает каскад фильтров K-взвешивания для заданной частоты дискретизации
+// (коэффициенты рассчитываются билинейным преобразованием, как в libebur128).
+func kWeighting(sampleRate int) [2]*biquad {
+	f0, g, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / float64(sampleRate))
+	vh := math.Pow(10, g/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := &biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / float64(sampleRate))
+	a0 = 1 + k/q + k*k
+	highpass := &biquad{
+		b0: 1, b1: -2, b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0}
+	return [2]*biquad{shelf, highpass}
+}
+
+// loudnessMeter накапливает энергию K-взвешенного сигнала по блокам шагом 100 мс
+// и истинный пик сигнала.
+type loudnessMeter struct {
+	sampleRate int
+	filters    [][2]*biquad
+	peaks      []*truePeakMeter
+	step       int       // отсчетов в шаге блока
+	stepPos    int       // позиция в текущем шаге
+	stepEnergy float64   // взвешенная энергия текущего шага
+	steps      []float64 // энергии шагов, еще не вошедших в полный блок
+	blocks     []float64 // средние взвешенные энергии блоков 400 мс
+	peak       float64
+}
+
+func newLoudnessMeter(sampleRate int) *loudnessMeter {
+	return &loudnessMeter{
+		sampleRate: sampleRate,
+		step:       sampleRate * loudnessStepMs / 1000}
+}
+
+// channelWeight возвращает весовой коэффициент канала по BS.1770.
+// Для раскладки 5.1 канал LFE исключается, тыловые каналы усиливаются на 1.5 дБ.
+func channelWeight(ch, count int) float64 {
+	if count == 6 {
+		switch ch {
+		case 3:
+			return 0
+		case 4, 5:
+			return 1.41
+		}
+	}
+	return 1
+}
+
+func (m *loudnessMeter) add(channels [][]float64) {
+	for len(m.filters) < len(channels) {
+		m.filters = append(m.filters, kWeighting(m.sampleRate))
+		m.peaks = append(m.peaks, newTruePeakMeter(m.sampleRate))
+	}
+	stepsPerBlock := loudnessBlockMs / loudnessStepMs
+	for i := range channels[0] {
+		for ch, samples := range channels {
+			x := samples[i]
+			m.peak = math.Max(m.peak, m.peaks[ch].process(x))
+			w := channelWeight(ch, len(channels))
+			if w == 0 {
+				continue
+			}
+			y := m.filters[ch][1].process(m.filters[ch][0].process(x))
+			m.stepEnergy += w * y * y
+		}
+		m.stepPos++
+		if m.stepPos < m.step {
+			continue
+		}
+		m.steps = append(m.steps, m.stepEnergy/float64(m.step))
+		m.stepPos, m.stepEnergy = 0, 0
+		if len(m.steps) == stepsPerBlock {
+			var sum float64
+			for _, e := range m.steps {
+				sum += e
+			}
+			m.blocks = append(m.blocks, sum/float64(stepsPerBlock))
+			m.steps = m.steps[1:]
+		}
+	}
+}
+
+// gatedLoudness вычисляет интегральную громкость по энергиям блоков
+// с абсолютным и относительным стробированием.
+func gatedLoudness(blocks []float64) float64 {
+	gate := func(threshold float64) (float64, int) {
+		var sum float64
+		var n int
+		for _, e := range blocks {
+			if energyToLUFS(e) > threshold {
+				sum += e
+				n++
+			}
+		}
+		return sum, n
+	}
+	sum, n := gate(loudnessAbsGate)
+	if n == 0 {
+		return loudnessAbsGate
+	}
+	sum, n = gate(energyToLUFS(sum/float64(n)) + loudnessRelGate)
+	if n == 0 {
+		return loudnessAbsGate
+	}
+	return energyToLUFS(sum / float64(n))
+}
+
+func energyToLUFS(e float64) float64 {
+	return -0.691 + 10*math.Log10(e)
+}
+
+// truePeakMeter определяет истинный пик сигнала с передискретизацией
+// (4x для частот ниже 96 кГц, 2x - ниже 192 кГц).
+type truePeakMeter struct {
+	factor  int
+	history []float64
+	coeffs  [][]float64
+}
+
+func newTruePeakMeter(sampleRate int) *truePeakMeter {
+	factor := 1
+	switch {
+	case sampleRate < 96000:
+		factor = 4
+	case sampleRate < 192000:
+		factor = 2
+	}
+	m := &truePeakMeter{factor: factor, history: make([]float64, truePeakTaps)}
+	// многофазный интерполятор на основе sinc с окном Ханна
+	total := truePeakTaps * factor
+	for phase := 0; phase < factor; phase++ {
+		c := make([]float64, truePeakTaps)
+		for tap := range c {
+			n := float64(tap*factor+phase) - float64(total-1)/2
+			x := n / float64(factor)
+			sinc := 1.0
+			if x != 0 {
+				sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+			}
+			window := 0.5 + 0.5*math.Cos(2*math.Pi*n/float64(total))
+			c[tap] = sinc * window
+		}
+		m.coeffs = append(m.coeffs, c)
+	}
+	return m
+}
+
+func (m *truePeakMeter) process(x float64) float64 {
+	copy(m.history, m.history[1:])
+	m.history[len(m.history)-1] = x
+	peak := math.Abs(x)
+	if m.factor == 1 {
+		return peak
+	}
+	for _, c := range m.coeffs {
+		var y float64
+		for i, v := range m.history {
+			y += v * c[len(c)-1-i]
+		}
+		peak = math.Max(peak, math.Abs(y))
+	}
+	return peak
+}
+
+func replayGain(lufs float64) float64 {
+	if lufs <= loudnessAbsGate {
+		return 0
+	}
+	return replayGainReference - lufs
+}
+
+func linearToDB(v float64) float64 {
+	if v <= 0 {
+		return loudnessAbsGate
+	}
+	return math.Max(20*math.Log10(v), loudnessAbsGate)
+}
@@ -0,0 +1,66 @@
+package repokeeper
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeasureEntryLoudness(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "01.flac")
+	// синус 1 кГц с уровнем -20 dBFS
+	samples := make([]int32, 10*testSampleRate/4096*4096)
+	for i := range samples {
+		samples[i] = int32(0.1 * 32767 * math.Sin(2*math.Pi*1000*float64(i)/testSampleRate))
+	}
+	require.NoError(t, writeTestFlac(fn, samples))
+
+	el, err := MeasureEntryLoudness(context.Background(), dir, nil)
+	require.NoError(t, err)
+	require.Len(t, el.Tracks, 1)
+	assert.InDelta(t, -23.0, el.Tracks[0].Integrated, 0.3)
+	assert.InDelta(t, -20.0, el.TruePeak, 0.1)
+	assert.InDelta(t, 5.0, el.Gain, 0.3)
+
+	require.NoError(t, el.WriteReplayGain())
+	before, err := os.Stat(fn)
+	require.NoError(t, err)
+	// теги помещаются в PADDING, но файл все равно заменяется целиком
+	require.NoError(t, el.WriteReplayGain())
+	after, err := os.Stat(fn)
+	require.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+	assert.False(t, os.SameFile(before, after))
+	f, err := os.Open(fn)
+	require.NoError(t, err)
+	defer f.Close()
+	blocks, _, err := readFlacMetaBlocks(f)
+	require.NoError(t, err)
+	var comment []byte
+	for _, blk := range blocks {
+		if blk.typ == flacBlockVorbisComment {
+			comment = blk.data
+		}
+	}
+	assert.Equal(t, 1, strings.Count(string(comment), "REPLAYGAIN_TRACK_GAIN="))
+
+	_, err = MeasureLoudness(context.Background(), fn)
+	require.NoError(t, err, "audio data must stay intact after tags writing")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = MeasureEntryLoudness(ctx, dir, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	// альбом с WavPack треками не измеряется
+	require.NoError(t, copyFile("testdata/repo/wv/wv/wv/test.wv", filepath.Join(dir, "02.wv"), 0644))
+	_, err = MeasureEntryLoudness(context.Background(), dir, nil)
+	assert.ErrorIs(t, err, ErrPCMUnsupported)
+}
@@ -0,0 +1,163 @@
+package repokeeper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// moveEntry перемещает Album Entry `path` корня `src` в корень `dst` с сохранением
+// пути относительно корня и обновляет кеши обоих корней. Все аудиофайлы каталога
+// должны поддерживаться корнем назначения, идентификатор и состояние Album Entry
+// сохраняются. Возвращает новый путь каталога.
+func (rk *RepoKeeper) moveEntry(src *repoRoot, path string, dst *repoRoot) (string, error) {
+	if src == dst {
+		return "", fmt.Errorf("album entry %s is already in root %s", path, dst.name)
+	}
+	elem, err := src.entries.Get(path)
+	if err != nil || elem.Kind != AlbumEntryNode {
+		return "", fmt.Errorf("album entry not found: %s", src.qualify(path))
+	}
+	for _, track := range elem.Files {
+		if dst.formats.byName(track.Format) == nil {
+			return "", fmt.Errorf("format %s of %s is not supported by root %s",
+				track.Format, track.Name, dst.name)
+		}
+	}
+	rel, err := relativePath(src.dir, path)
+	if err != nil {
+		return "", err
+	}
+	newPath := filepath.Join(dst.dir, rel)
+	if _, err := os.Lstat(newPath); err == nil {
+		return "", fmt.Errorf("%s already exists", dst.qualify(newPath))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	// события ФС перемещения обрабатываются командой: они поступают асинхронно,
+	// поэтому обработка возобновляется после периода suspendGrace
+	rk.suspendWatch(path, newPath)
+	defer rk.resumeWatch(path, newPath)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return "", err
+	}
+	var leftover *SourceLeftoverError
+	if err := moveDir(path, newPath); err != nil && !errors.As(err, &leftover) {
+		return "", err
+	}
+	src.entries.Delete(path)
+	rk.unwatchTree(path)
+	if err := dst.entries.AddAlbumEntry(newPath); err != nil {
+		return "", err
+	}
+	dst.entries.SetEntryID(newPath, elem.EntryID, elem.State)
+	rk.watchTree(dst, newPath, false)
+	if leftover != nil {
+		return newPath, leftover
+	}
+	return newPath, nil
+}
+
+// SourceLeftoverError сообщает, что каталог скопирован в корень назначения,
+// но исходный каталог `Path` не удалось удалить полностью.
+type SourceLeftoverError struct {
+	Path string
+	Err  error
+}
+
+func (e *SourceLeftoverError) Error() string {
+	return fmt.Sprintf("source %s is left after moving: %v", e.Path, e.Err)
+}
+
+func (e *SourceLeftoverError) Unwrap() error { return e.Err }
+
+// moveDir перемещает каталог `src` в `dst`. Между файловыми системами каталог
+// копируется с сохранением прав доступа и времени изменения файлов, после чего
+// исходный каталог удаляется только после сброса копии на диск. Ошибка удаления исходного каталога возвращается
+// как SourceLeftoverError.
+func moveDir(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyDir(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	// копия должна сохраниться на диске до удаления исходного каталога
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return &SourceLeftoverError{Path: src, Err: err}
+	}
+	return nil
+}
+
+// copyDir копирует дерево каталога `src` в `dst` и сбрасывает на диск скопированные
+// файлы и записи созданных каталогов.
+func copyDir(src, dst string) error {
+	var dirs []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, target)
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		// специальные файлы не копируются
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := syncDir(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,170 @@
+package repokeeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+// mp3SyncSearchSize - объем данных после тега ID3v2, в котором ищется первый кадр MPEG.
+const mp3SyncSearchSize = 64 * 1024
+
+// битрейт (кбит/с) по индексу заголовка кадра: MPEG-1 Layer I-III, MPEG-2/2.5 Layer I
+// и MPEG-2/2.5 Layer II-III
+var mpegBitrates = [5][15]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegSampleRates = [3]int{44100, 48000, 32000}
+
+// mpegHeader описывает заголовок кадра MPEG Audio.
+type mpegHeader struct {
+	mpeg1      bool
+	layer      int
+	bitrate    int
+	sampleRate int
+	channels   int
+}
+
+// parseMPEGHeader разбирает заголовок кадра MPEG Audio Layer I-III.
+func parseMPEGHeader(h []byte) (*mpegHeader, bool) {
+	if len(h) < 4 || h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return nil, false
+	}
+	version, layer := h[1]>>3&3, h[1]>>1&3
+	bitrate, rate := h[2]>>4, h[2]>>2&3
+	if version == 1 || layer == 0 || bitrate == 0xf || rate == 3 {
+		return nil, false
+	}
+	hdr := &mpegHeader{
+		mpeg1:      version == 3,
+		layer:      4 - int(layer),
+		sampleRate: mpegSampleRates[rate],
+		channels:   2}
+	table := hdr.layer - 1
+	if !hdr.mpeg1 {
+		table = 4
+		if hdr.layer == 1 {
+			table = 3
+		}
+	}
+	hdr.bitrate = mpegBitrates[table][bitrate]
+	switch version {
+	case 2:
+		hdr.sampleRate /= 2
+	case 0:
+		hdr.sampleRate /= 4
+	}
+	if h[3]>>6 == 3 {
+		hdr.channels = 1
+	}
+	return hdr, true
+}
+
+// samplesPerFrame возвращает число отсчетов в кадре.
+func (hdr *mpegHeader) samplesPerFrame() int {
+	switch {
+	case hdr.layer == 1:
+		return 384
+	case hdr.layer == 3 && !hdr.mpeg1:
+		return 576
+	}
+	return 1152
+}
+
+// xingOffset возвращает смещение заголовка Xing/Info от начала кадра Layer III.
+func (hdr *mpegHeader) xingOffset() int {
+	switch {
+	case hdr.mpeg1 && hdr.channels == 1, !hdr.mpeg1 && hdr.channels == 2:
+		return 4 + 17
+	case hdr.mpeg1:
+		return 4 + 32
+	}
+	return 4 + 9
+}
+
+// sniffMP3 проверяет заголовок кадра MPEG Audio Layer I-III.
+func sniffMP3(header []byte) bool {
+	_, ok := parseMPEGHeader(header)
+	return ok
+}
+
+// readMP3Tags читает теги ID3v2 в начале файла и дополняет их значениями ID3v1.
+func readMP3Tags(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	if _, err := readID3v2Tags(f, 0, tags); err != nil {
+		return nil, err
+	}
+	if _, err := readID3v1Tags(f, fi.Size(), tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// readMP3Properties читает заголовок первого кадра MPEG. Для файлов с заголовком
+// Xing/Info или VBRI средний битрейт вычисляется по числу кадров.
+func readMP3Properties(path string) (*md.AudioInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	offset, err := readID3v2Tags(f, 0, make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, mp3SyncSearchSize)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf); i++ {
+		hdr, ok := parseMPEGHeader(buf[i:])
+		if !ok {
+			continue
+		}
+		ai := &md.AudioInfo{
+			Samplerate: hdr.sampleRate, Channels: hdr.channels, AvgBitrate: hdr.bitrate}
+		if frames := mp3FrameCount(hdr, buf[i:]); frames > 0 {
+			return ai, setAvgBitrate(ai, path, frames*int64(hdr.samplesPerFrame()))
+		}
+		return ai, nil
+	}
+	return nil, errors.New("MPEG audio frame is missing")
+}
+
+// mp3FrameCount возвращает число кадров из заголовка Xing/Info или VBRI первого
+// кадра `frame` или 0, если заголовок отсутствует.
+func mp3FrameCount(hdr *mpegHeader, frame []byte) int64 {
+	if hdr.layer != 3 {
+		return 0
+	}
+	if off := hdr.xingOffset(); len(frame) >= off+12 {
+		xing := frame[off:]
+		if (string(xing[:4]) == "Xing" || string(xing[:4]) == "Info") &&
+			binary.BigEndian.Uint32(xing[4:])&1 != 0 {
+			return int64(binary.BigEndian.Uint32(xing[8:]))
+		}
+	}
+	if len(frame) >= 4+32+18 && string(frame[4+32:4+36]) == "VBRI" {
+		return int64(binary.BigEndian.Uint32(frame[4+32+14:]))
+	}
+	return 0
+}
@@ -0,0 +1,278 @@
+package repokeeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+// mp4MaxMoovSize ограничивает размер читаемого в память атома moov.
+const mp4MaxMoovSize = 64 << 20
+
+// mp4ItemTags сопоставляет атомы iTunes (ilst) именам тегов Vorbis.
+var mp4ItemTags = map[string]string{
+	"\xa9nam": "TITLE",
+	"\xa9ART": "ARTIST",
+	"aART":    "ALBUMARTIST",
+	"\xa9alb": "ALBUM",
+	"\xa9day": "DATE",
+	"\xa9gen": "GENRE",
+	"\xa9wrt": "COMPOSER",
+	"\xa9cmt": "COMMENT",
+	"trkn":    "TRACKNUMBER",
+	"disk":    "DISCNUMBER",
+}
+
+// walkMP4Atoms перебирает атомы в данных `data`, пока `fn` возвращает true.
+func walkMP4Atoms(data []byte, fn func(typ string, payload []byte) bool) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errors.New("invalid MP4 atom")
+		}
+		size, header := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return errors.New("invalid MP4 atom")
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return errors.New("invalid MP4 atom")
+		}
+		if !fn(string(data[4:8]), data[header:size]) {
+			return nil
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// findMP4Atom возвращает содержимое атома по пути из типов вложенных атомов.
+func findMP4Atom(data []byte, path ...string) ([]byte, error) {
+	for _, typ := range path {
+		var found []byte
+		err := walkMP4Atoms(data, func(t string, payload []byte) bool {
+			if t != typ {
+				return true
+			}
+			found = payload
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			return nil, nil
+		}
+		data = found
+		if typ == "meta" {
+			data = mp4MetaChildren(data)
+		}
+	}
+	return data, nil
+}
+
+// mp4MetaChildren возвращает вложенные атомы meta. В ISO BMFF атом meta начинается
+// с версии и флагов, в QuickTime - сразу с вложенных атомов.
+func mp4MetaChildren(data []byte) []byte {
+	if len(data) >= 8 && string(data[4:8]) == "hdlr" {
+		return data
+	}
+	if len(data) < 4 {
+		return nil
+	}
+	return data[4:]
+}
+
+// readMP4Moov читает атом moov файла.
+func readMP4Moov(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var offset int64
+	for {
+		var hdr [16]byte
+		if _, err := f.ReadAt(hdr[:8], offset); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("MP4 moov atom is missing")
+			}
+			return nil, err
+		}
+		size, header := int64(binary.BigEndian.Uint32(hdr[:])), int64(8)
+		if size == 1 {
+			if _, err := f.ReadAt(hdr[8:], offset+8); err != nil {
+				return nil, err
+			}
+			size, header = int64(binary.BigEndian.Uint64(hdr[8:])), 16
+		}
+		if size == 0 || size < header {
+			return nil, errors.New("MP4 moov atom is missing")
+		}
+		if string(hdr[4:8]) == "moov" {
+			if size-header > mp4MaxMoovSize {
+				return nil, errors.New("MP4 moov atom is too large")
+			}
+			data := make([]byte, size-header)
+			if _, err := f.ReadAt(data, offset+header); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		offset += size
+	}
+}
+
+// readMP4Tags читает теги iTunes (moov/udta/meta/ilst). Теги вида "----"
+// добавляются под своим именем (например, REPLAYGAIN_TRACK_GAIN).
+func readMP4Tags(path string) (map[string]string, error) {
+	moov, err := readMP4Moov(path)
+	if err != nil {
+		return nil, err
+	}
+	ilst, err := findMP4Atom(moov, "udta", "meta", "ilst")
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	err = walkMP4Atoms(ilst, func(typ string, item []byte) bool {
+		var name string
+		var values [][]byte
+		walkMP4Atoms(item, func(t string, payload []byte) bool {
+			switch {
+			case t == "name" && len(payload) >= 4:
+				name = string(payload[4:])
+			case t == "data" && len(payload) >= 8:
+				values = append(values, payload)
+			}
+			return true
+		})
+		key := mp4ItemTags[typ]
+		if typ == "----" {
+			key = strings.ToUpper(name)
+		}
+		if key == "" {
+			return true
+		}
+		for _, data := range values {
+			if value := mp4DataValue(typ, data); value != "" {
+				addTag(tags, key, value)
+			}
+		}
+		return true
+	})
+	return tags, err
+}
+
+// mp4DataValue возвращает текстовое значение атома data. Номера трека и диска
+// хранятся в двоичном виде и возвращаются в виде "номер/всего".
+func mp4DataValue(typ string, data []byte) string {
+	// тип значения и локаль
+	kind, value := binary.BigEndian.Uint32(data)&0xffffff, data[8:]
+	if typ == "trkn" || typ == "disk" {
+		if len(value) < 6 {
+			return ""
+		}
+		number := strconv.Itoa(int(binary.BigEndian.Uint16(value[2:])))
+		if total := binary.BigEndian.Uint16(value[4:]); total > 0 {
+			number += "/" + strconv.Itoa(int(total))
+		}
+		return number
+	}
+	if kind != 1 {
+		return ""
+	}
+	return string(value)
+}
+
+// readMP4Properties читает описание первой звуковой дорожки (AAC или ALAC).
+func readMP4Properties(path string) (*md.AudioInfo, error) {
+	moov, err := readMP4Moov(path)
+	if err != nil {
+		return nil, err
+	}
+	var ai *md.AudioInfo
+	var samples int64
+	err = walkMP4Atoms(moov, func(typ string, trak []byte) bool {
+		if typ != "trak" {
+			return true
+		}
+		mdia, err := findMP4Atom(trak, "mdia")
+		if err != nil || mdia == nil {
+			return true
+		}
+		stsd, err := findMP4Atom(mdia, "minf", "stbl", "stsd")
+		if err != nil || len(stsd) < 8 {
+			return true
+		}
+		if ai = mp4SampleEntry(stsd[8:]); ai == nil {
+			return true
+		}
+		if mdhd, err := findMP4Atom(mdia, "mdhd"); err == nil {
+			samples = mp4Samples(mdhd, ai.Samplerate)
+		}
+		return false
+	})
+	if err == nil && ai == nil {
+		err = errors.New("MP4 audio track is missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ai, setAvgBitrate(ai, path, samples)
+}
+
+// mp4SampleEntry разбирает первое описание звукового потока атома stsd
+// (после версии и числа описаний).
+func mp4SampleEntry(entries []byte) *md.AudioInfo {
+	var ai *md.AudioInfo
+	walkMP4Atoms(entries, func(typ string, entry []byte) bool {
+		if typ != "mp4a" && typ != "alac" || len(entry) < 28 {
+			return false
+		}
+		ai = &md.AudioInfo{
+			Channels:   int(binary.BigEndian.Uint16(entry[16:])),
+			Samplerate: int(binary.BigEndian.Uint32(entry[24:]) >> 16)}
+		if typ != "alac" {
+			return false
+		}
+		ai.SampleSize = int(binary.BigEndian.Uint16(entry[18:]))
+		// точные параметры ALAC хранятся во вложенном атоме alac
+		walkMP4Atoms(entry[28:], func(t string, cfg []byte) bool {
+			if t == "alac" && len(cfg) >= 28 {
+				ai.SampleSize = int(cfg[9])
+				ai.Channels = int(cfg[13])
+				ai.Samplerate = int(binary.BigEndian.Uint32(cfg[24:]))
+			}
+			return t != "alac"
+		})
+		return false
+	})
+	return ai
+}
+
+// mp4Samples возвращает длительность дорожки из атома mdhd в отсчетах.
+func mp4Samples(mdhd []byte, sampleRate int) int64 {
+	var timescale, duration uint64
+	switch {
+	case len(mdhd) >= 24 && mdhd[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(mdhd[12:]))
+		duration = uint64(binary.BigEndian.Uint32(mdhd[16:]))
+	case len(mdhd) >= 32 && mdhd[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(mdhd[20:]))
+		duration = binary.BigEndian.Uint64(mdhd[24:])
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return int64(duration * uint64(sampleRate) / timescale)
+}
@@ -1,3 +1,30 @@
 package repokeeper
 
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/ytsiuryn/go-collection"
+)
+
 // TODO: Формат каталогов определяется с помощью шаблона в переменной AUDIOREPO_DIR_PATTERN.
+
+// Имена и расширения файлов, относящихся к техническим данным и подлежащих удалению
+// при очистке каталога альбома.
+var (
+	technicalFileNames = []string{".ds_store", "thumbs.db", "desktop.ini", ".directory"}
+	technicalFileExts  = []string{".tmp", ".bak", ".part", ".log"}
+)
+
+// IsTechnicalFile проверяет, относится ли файл к техническим данным каталога альбома.
+// Логи риппинга EAC/XLD техническими данными не считаются и при очистке сохраняются.
+func IsTechnicalFile(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	if collection.ContainsStr(name, technicalFileNames) || strings.HasPrefix(name, "._") {
+		return true
+	}
+	if !collection.ContainsStr(filepath.Ext(name), technicalFileExts) {
+		return false
+	}
+	return !IsRipLogFile(path)
+}
@@ -0,0 +1,121 @@
+package repokeeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	md "github.com/ytsiuryn/ds-audiomd"
+)
+
+const (
+	oggPageHeaderSize = 27
+	// oggMaxHeaderSize ограничивает размер заголовков потока (комментарий Vorbis
+	// может содержать обложку в METADATA_BLOCK_PICTURE)
+	oggMaxHeaderSize = 16 << 20
+)
+
+// readOggPackets читает первые `n` пакетов первого логического потока Ogg.
+func readOggPackets(path string, n int) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var packets [][]byte
+	var packet []byte
+	var serial uint32
+	var offset, total int64
+	for first := true; len(packets) < n; first = false {
+		var hdr [oggPageHeaderSize]byte
+		if _, err := f.ReadAt(hdr[:], offset); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("Ogg stream headers are incomplete")
+			}
+			return nil, err
+		}
+		if string(hdr[:4]) != "OggS" {
+			return nil, errors.New("invalid Ogg page")
+		}
+		segments := make([]byte, hdr[26])
+		if _, err := f.ReadAt(segments, offset+oggPageHeaderSize); err != nil {
+			return nil, err
+		}
+		var size int64
+		for _, s := range segments {
+			size += int64(s)
+		}
+		pageSerial := binary.LittleEndian.Uint32(hdr[14:])
+		if first {
+			serial = pageSerial
+		}
+		offset += oggPageHeaderSize + int64(len(segments))
+		if pageSerial != serial {
+			offset += size
+			continue
+		}
+		if total += size; total > oggMaxHeaderSize {
+			return nil, errors.New("Ogg stream headers are too large")
+		}
+		data := make([]byte, size)
+		if _, err := f.ReadAt(data, offset); err != nil {
+			return nil, err
+		}
+		offset += size
+		for _, s := range segments {
+			packet = append(packet, data[:s]...)
+			data = data[s:]
+			// пакет продолжается на следующем сегменте, если текущий заполнен
+			if s < 255 {
+				packets = append(packets, packet)
+				packet = nil
+				if len(packets) == n {
+					break
+				}
+			}
+		}
+	}
+	return packets, nil
+}
+
+// readOggProperties читает заголовок идентификации потока Vorbis или Opus.
+func readOggProperties(path string) (*md.AudioInfo, error) {
+	packets, err := readOggPackets(path, 1)
+	if err != nil {
+		return nil, err
+	}
+	payload := packets[0]
+	switch {
+	case sniffMagic(0, "\x01vorbis")(payload) && len(payload) >= 16:
+		return &md.AudioInfo{
+			Channels:   int(payload[11]),
+			Samplerate: int(binary.LittleEndian.Uint32(payload[12:]))}, nil
+	case sniffMagic(0, "OpusHead")(payload) && len(payload) >= 16:
+		// Opus всегда декодируется с частотой 48 кГц
+		return &md.AudioInfo{Channels: int(payload[9]), Samplerate: 48000}, nil
+	}
+	return nil, errors.New("Ogg identification header is missing")
+}
+
+// readOggTags читает комментарий Vorbis из второго пакета потока Vorbis или Opus.
+func readOggTags(path string) (map[string]string, error) {
+	packets, err := readOggPackets(path, 2)
+	if err != nil {
+		return nil, err
+	}
+	comment := packets[1]
+	switch {
+	case sniffMagic(0, "\x03vorbis")(comment):
+		comment = comment[7:]
+	case sniffMagic(0, "OpusTags")(comment):
+		comment = comment[8:]
+	default:
+		return nil, errors.New("Ogg comment header is missing")
+	}
+	tags := make(map[string]string)
+	if err := parseVorbisComment(comment, tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
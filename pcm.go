@@ -0,0 +1,111 @@
+package repokeeper
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mewkiz/flac"
+)
+
+// pcmDecoder последовательно декодирует аудиофайл в блоки отсчетов по каналам,
+// нормализованных к диапазону [-1, 1]. Окончание потока обозначается ошибкой io.EOF.
+type pcmDecoder interface {
+	SampleRate() int
+	Next() ([][]float64, error)
+	Close() error
+}
+
+// ErrPCMUnsupported возвращается для lossless-файлов, декодирование которых
+// не поддерживается (WavPack).
+var ErrPCMUnsupported = errors.New("PCM decoding is not supported")
+
+// openPCM открывает декодер, соответствующий формату файла.
+func openPCM(path string) (pcmDecoder, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		return openFlacPCM(path)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPCMUnsupported, path)
+}
+
+// isPCMDecodable проверяет, поддерживается ли декодирование аудиофайла.
+func isPCMDecodable(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		return true
+	}
+	return false
+}
+
+// isLossless проверяет, является ли аудиофайл lossless-файлом (FLAC, WavPack),
+// для которого выполняются анализ спектра и измерение громкости.
+func isLossless(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac", ".wv":
+		return true
+	}
+	return false
+}
+
+type flacPCM struct {
+	stream *flac.Stream
+	scale  float64
+}
+
+func openFlacPCM(path string) (*flacPCM, error) {
+	stream, err := flac.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &flacPCM{
+		stream: stream,
+		scale:  float64(int64(1) << (stream.Info.BitsPerSample - 1))}, nil
+}
+
+func (d *flacPCM) SampleRate() int {
+	return int(d.stream.Info.SampleRate)
+}
+
+func (d *flacPCM) Next() ([][]float64, error) {
+	f, err := d.stream.ParseNext()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]float64, len(f.Subframes))
+	for i, sub := range f.Subframes {
+		ret[i] = normalize(sub.Samples, d.scale)
+	}
+	return ret, nil
+}
+
+func (d *flacPCM) Close() error {
+	return d.stream.Close()
+}
+
+// normalize переводит целочисленные отсчеты в диапазон [-1, 1] по масштабу `scale`.
+func normalize(samples []int32, scale float64) []float64 {
+	ret := make([]float64, len(samples))
+	for i, v := range samples {
+		ret[i] = float64(v) / scale
+	}
+	return ret
+}
+
+// downmix сводит каналы в моно.
+func downmix(channels [][]float64) []float64 {
+	if len(channels) == 1 {
+		return channels[0]
+	}
+	ret := make([]float64, len(channels[0]))
+	for _, ch := range channels {
+		for i, v := range ch {
+			ret[i] += v
+		}
+	}
+	for i := range ret {
+		ret[i] /= float64(len(channels))
+	}
+	return ret
+}
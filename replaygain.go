@@ -0,0 +1,286 @@
+package repokeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	replayGainTagPrefix = "REPLAYGAIN_"
+	flacVendor          = "repokeeper"
+	flacPaddingSize     = 4096
+)
+
+// Типы блоков метаданных FLAC.
+const (
+	flacBlockStreamInfo    = 0
+	flacBlockPadding       = 1
+	flacBlockVorbisComment = 4
+)
+
+// WriteReplayGainTags записывает теги ReplayGain в аудиофайл, заменяя ранее записанные.
+// Поддерживается только FLAC (блок VORBIS_COMMENT).
+func WriteReplayGainTags(path string, tags map[string]string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		return writeFlacTags(path, tags)
+	}
+	return fmt.Errorf("ReplayGain tags writing is not supported for %s", path)
+}
+
+func formatGain(gain float64) string {
+	return fmt.Sprintf("%.2f dB", gain)
+}
+
+func formatPeak(peak float64) string {
+	return fmt.Sprintf("%.6f", peak)
+}
+
+func formatLUFS(lufs float64) string {
+	return fmt.Sprintf("%.2f LUFS", lufs)
+}
+
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type flacMetaBlock struct {
+	typ  byte
+	data []byte
+}
+
+// writeFlacTags заменяет теги ReplayGain в блоке VORBIS_COMMENT.
+// Файл всегда перезаписывается через временный файл (см. rewriteFile), поэтому при
+// сбое во время записи исходный файл остается целым. Если обновленные метаданные
+// помещаются в место, занятое старыми (с учетом блока PADDING), размер области
+// метаданных сохраняется.
+func writeFlacTags(path string, tags map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	blocks, audioOffset, err := readFlacMetaBlocks(f)
+	if err != nil {
+		return err
+	}
+	var comment *flacMetaBlock
+	var kept []*flacMetaBlock
+	for _, blk := range blocks {
+		switch blk.typ {
+		case flacBlockPadding:
+			continue
+		case flacBlockVorbisComment:
+			comment = blk
+		}
+		kept = append(kept, blk)
+	}
+	if comment == nil {
+		comment = &flacMetaBlock{typ: flacBlockVorbisComment}
+		kept = append(kept, comment)
+	}
+	if comment.data, err = updateVorbisComment(comment.data, tags); err != nil {
+		return err
+	}
+	size := int64(4)
+	for _, blk := range kept {
+		size += 4 + int64(len(blk.data))
+	}
+	if padding := audioOffset - size - 4; padding >= 0 {
+		kept = append(kept, &flacMetaBlock{typ: flacBlockPadding, data: make([]byte, padding)})
+	} else if audioOffset != size {
+		kept = append(kept, &flacMetaBlock{typ: flacBlockPadding, data: make([]byte, flacPaddingSize)})
+	}
+	return rewriteFile(path, func(w io.Writer) error {
+		if err := writeFlacMetaBlocks(w, kept); err != nil {
+			return err
+		}
+		if _, err := f.Seek(audioOffset, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+func readFlacMetaBlocks(r io.Reader) ([]*flacMetaBlock, int64, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, 0, err
+	}
+	if string(magic[:]) != "fLaC" {
+		return nil, 0, errors.New("not a FLAC file")
+	}
+	offset := int64(4)
+	var blocks []*flacMetaBlock
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, 0, err
+		}
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		blk := &flacMetaBlock{typ: hdr[0] & 0x7f, data: make([]byte, size)}
+		if _, err := io.ReadFull(r, blk.data); err != nil {
+			return nil, 0, err
+		}
+		blocks = append(blocks, blk)
+		offset += 4 + int64(size)
+		if hdr[0]&0x80 != 0 {
+			return blocks, offset, nil
+		}
+	}
+}
+
+func writeFlacMetaBlocks(w io.Writer, blocks []*flacMetaBlock) error {
+	buf := bytes.NewBufferString("fLaC")
+	for i, blk := range blocks {
+		if len(blk.data) >= 1<<24 {
+			return errors.New("FLAC metadata block is too large")
+		}
+		typ := blk.typ
+		if i == len(blocks)-1 {
+			typ |= 0x80
+		}
+		n := len(blk.data)
+		buf.Write([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)})
+		buf.Write(blk.data)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// updateVorbisComment удаляет из комментария все теги ReplayGain и добавляет `tags`.
+func updateVorbisComment(data []byte, tags map[string]string) ([]byte, error) {
+	vendor := flacVendor
+	var comments []string
+	if len(data) > 0 {
+		r := bytes.NewReader(data)
+		var err error
+		if vendor, err = readVorbisString(r); err != nil {
+			return nil, err
+		}
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < count; i++ {
+			s, err := readVorbisString(r)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(strings.ToUpper(s), replayGainTagPrefix) {
+				comments = append(comments, s)
+			}
+		}
+	}
+	for _, k := range sortedTagKeys(tags) {
+		comments = append(comments, k+"="+tags[k])
+	}
+	buf := new(bytes.Buffer)
+	writeVorbisString(buf, vendor)
+	binary.Write(buf, binary.LittleEndian, uint32(len(comments)))
+	for _, s := range comments {
+		writeVorbisString(buf, s)
+	}
+	return buf.Bytes(), nil
+}
+
+func readVorbisString(r *bytes.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	if int64(n) > int64(r.Len()) {
+		return "", errors.New("invalid vorbis comment")
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func writeVorbisString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// Флаги тега APEv2.
+const (
+	apeFlagHasHeader = 1 << 31
+	apeTagFooterSize = 32
+	apeItemTypeMask  = 6
+	apeItemUTF8      = 0
+	id3v1TagSize     = 128
+)
+
+type apeFooter struct {
+	Preamble [8]byte
+	Version  uint32
+	Size     uint32
+	Count    uint32
+	Flags    uint32
+	Reserved [8]byte
+}
+
+type apeItem struct {
+	key   string
+	flags uint32
+	value []byte
+}
+
+// readAPEItems читает тег APEv2, заканчивающийся в позиции `end`.
+// Возвращает элементы тега и позицию его начала (или `end` при отсутствии тега).
+func readAPEItems(f *os.File, end int64) ([]*apeItem, int64, error) {
+	if end < apeTagFooterSize {
+		return nil, end, nil
+	}
+	var footer apeFooter
+	if err := binary.Read(
+		io.NewSectionReader(f, end-apeTagFooterSize, apeTagFooterSize),
+		binary.LittleEndian, &footer); err != nil {
+		return nil, 0, err
+	}
+	if string(footer.Preamble[:]) != "APETAGEX" || int64(footer.Size) > end {
+		return nil, end, nil
+	}
+	start := end - int64(footer.Size)
+	data := make([]byte, int(footer.Size)-apeTagFooterSize)
+	if _, err := f.ReadAt(data, start); err != nil {
+		return nil, 0, err
+	}
+	if footer.Flags&apeFlagHasHeader != 0 {
+		start -= apeTagFooterSize
+	}
+	var items []*apeItem
+	for i := uint32(0); i < footer.Count; i++ {
+		if len(data) < 9 {
+			return nil, 0, errors.New("invalid APEv2 tag")
+		}
+		size := binary.LittleEndian.Uint32(data)
+		flags := binary.LittleEndian.Uint32(data[4:])
+		data = data[8:]
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || int64(nul)+1+int64(size) > int64(len(data)) {
+			return nil, 0, errors.New("invalid APEv2 tag")
+		}
+		items = append(items, &apeItem{
+			key:   string(data[:nul]),
+			flags: flags,
+			value: data[nul+1 : nul+1+int(size)]})
+		data = data[nul+1+int(size):]
+	}
+	return items, start, nil
+}
@@ -0,0 +1,361 @@
+package repokeeper
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Программы риппинга, логи которых поддерживаются.
+const (
+	RipperEAC = "EAC"
+	RipperXLD = "XLD"
+)
+
+// Результаты сверки трека с базой AccurateRip.
+const (
+	AccurateRipUnknown    = ""
+	AccurateRipAccurate   = "accurate"
+	AccurateRipInaccurate = "inaccurate"
+	AccurateRipNotPresent = "not_present"
+)
+
+// RipLogExt - расширение файла лога риппинга.
+const RipLogExt = ".log"
+
+// ErrNotRipLog возвращается при разборе файла, не являющегося логом EAC/XLD.
+var ErrNotRipLog = errors.New("not an EAC/XLD rip log")
+
+// RipTrack описывает результаты риппинга отдельного трека.
+// `Errors` содержит количество ошибок чтения (для XLD - сумма счетчиков статистики).
+// `Suspicious` содержит позиции подозрительных участков, отмеченных EAC.
+type RipTrack struct {
+	Number        int      `json:"number"`
+	Filename      string   `json:"filename,omitempty"`
+	TestCRC       string   `json:"test_crc,omitempty"`
+	CopyCRC       string   `json:"copy_crc,omitempty"`
+	AccurateRip   string   `json:"accurate_rip,omitempty"`
+	ARConfidence  int      `json:"ar_confidence,omitempty"`
+	Errors        int      `json:"errors,omitempty"`
+	Suspicious    []string `json:"suspicious,omitempty"`
+	CopyCompleted bool     `json:"copy_completed"`
+}
+
+// RipLog описывает содержимое лога риппинга EAC или XLD.
+type RipLog struct {
+	Ripper   string      `json:"ripper"`
+	Version  string      `json:"version,omitempty"`
+	Drive    string      `json:"drive,omitempty"`
+	ReadMode string      `json:"read_mode,omitempty"`
+	Tracks   []*RipTrack `json:"tracks,omitempty"`
+	NoErrors bool        `json:"no_errors"`
+}
+
+// RipLogInfo связывает файл лога с результатами его разбора и оценкой качества.
+type RipLogInfo struct {
+	File  string  `json:"file"`
+	Log   *RipLog `json:"log"`
+	Score int     `json:"score"`
+}
+
+// RipQualityReport описывает качество риппинга альбома по всем найденным логам.
+// Итоговая оценка `Score` равна минимальной из оценок логов.
+// При отсутствии логов `Score` равен -1.
+type RipQualityReport struct {
+	Path  string        `json:"path"`
+	Logs  []*RipLogInfo `json:"logs,omitempty"`
+	Score int           `json:"score"`
+}
+
+var (
+	eacHeaderRe    = regexp.MustCompile(`^Exact Audio Copy\s+(V\S+(?:\s+(?:beta|prebeta)\s+\S+)?)`)
+	xldHeaderRe    = regexp.MustCompile(`^X Lossless Decoder version\s+(.+)$`)
+	trackHeaderRe  = regexp.MustCompile(`^(?:Track|Трек)\s+(\d+)$`)
+	crcRe          = regexp.MustCompile(`[0-9A-Fa-f]{8}`)
+	confidenceRe   = regexp.MustCompile(`(?i)(?:confidence|достоверность)\s*(\d+)`)
+	eacAccurateRe  = regexp.MustCompile(`(?i)^(?:Accurately ripped|Точно скопировано)`)
+	eacNotAccRe    = regexp.MustCompile(`(?i)^(?:Cannot be verified as accurate|Не может быть проверено)`)
+	eacNotPresRe   = regexp.MustCompile(`(?i)^(?:Track not present in AccurateRip database|Трек отсутствует в базе AccurateRip)`)
+	xldAccurateRe  = regexp.MustCompile(`(?i)^->\s*Accurately ripped`)
+	xldNotAccRe    = regexp.MustCompile(`(?i)^->\s*Rip may not be accurate`)
+	xldNotPresRe   = regexp.MustCompile(`(?i)^->\s*Track not present in AccurateRip database`)
+	xldErrorStatRe = regexp.MustCompile(`^(Read error|Skipped \(treated as error\)|Inconsistency in error sectors|Damaged sector count)\s*:\s*(\d+)`)
+)
+
+// Варианты подписей полей в англоязычных и русскоязычных логах.
+var (
+	driveLabels      = []string{"Used drive", "Используемый привод", "Дисковод"}
+	readModeLabels   = []string{"Read mode", "Режим чтения", "Ripper mode"}
+	paranoiaLabels   = []string{"Use cdparanoia mode"}
+	filenameLabels   = []string{"Filename", "Имя файла"}
+	testCRCLabels    = []string{"Test CRC", "CRC32 hash (test run)", "CRC теста"}
+	copyCRCLabels    = []string{"Copy CRC", "CRC32 hash", "CRC копии"}
+	suspiciousLabels = []string{"Suspicious position", "Подозрительная позиция"}
+	copyOKLabels     = []string{"Copy OK", "Copy finished", "Копирование завершено", "Копирование... OK"}
+	noErrorsLabels   = []string{"No errors occurred", "No errors occured", "Ошибок не обнаружено", "Ошибок не произошло"}
+)
+
+// ParseRipLog разбирает лог риппинга EAC или XLD.
+// Кодировка определяется автоматически: UTF-16 (по BOM), UTF-8 или CP1251.
+func ParseRipLog(data []byte) (*RipLog, error) {
+	text, err := decodeRipLog(data)
+	if err != nil {
+		return nil, err
+	}
+	rl := &RipLog{}
+	var track *RipTrack
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if rl.Ripper == "" {
+			if m := eacHeaderRe.FindStringSubmatch(line); m != nil {
+				rl.Ripper, rl.Version = RipperEAC, m[1]
+			} else if m := xldHeaderRe.FindStringSubmatch(line); m != nil {
+				rl.Ripper, rl.Version = RipperXLD, m[1]
+			}
+			continue
+		}
+		if m := trackHeaderRe.FindStringSubmatch(line); m != nil {
+			num, _ := strconv.Atoi(m[1])
+			track = &RipTrack{Number: num}
+			rl.Tracks = append(rl.Tracks, track)
+			continue
+		}
+		if hasLabel(line, noErrorsLabels) {
+			rl.NoErrors = true
+			continue
+		}
+		if track == nil {
+			rl.parseHeaderLine(line)
+		} else {
+			rl.parseTrackLine(track, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if rl.Ripper == "" {
+		return nil, ErrNotRipLog
+	}
+	return rl, nil
+}
+
+// ReadRipLog читает и разбирает лог риппинга из файла.
+func ReadRipLog(fn string) (*RipLog, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRipLog(data)
+}
+
+// IsRipLogFile проверяет, является ли файл логом риппинга EAC/XLD.
+// Содержимое файла проверяется только для файлов с расширением ".log".
+func IsRipLogFile(fn string) bool {
+	if !strings.EqualFold(filepath.Ext(fn), RipLogExt) {
+		return false
+	}
+	_, err := ReadRipLog(fn)
+	return err == nil
+}
+
+// IsSecureMode проверяет, выполнялся ли риппинг в безопасном (secure/paranoia) режиме.
+func (rl *RipLog) IsSecureMode() bool {
+	mode := strings.ToLower(rl.ReadMode)
+	return strings.HasPrefix(mode, "secure") ||
+		strings.HasPrefix(mode, "достоверность") ||
+		strings.HasPrefix(mode, "xld secure") ||
+		strings.HasPrefix(mode, "cdparanoia")
+}
+
+// QualityScore вычисляет оценку качества риппинга в диапазоне 0..100.
+// Оценка снижается за небезопасный режим чтения, расхождение CRC тестового и основного
+// проходов, отсутствие тестового прохода, ошибки чтения, подозрительные позиции и
+// отрицательный результат сверки с AccurateRip.
+func (rl *RipLog) QualityScore() int {
+	score := 100
+	if !rl.IsSecureMode() {
+		score -= 30
+	}
+	if !rl.NoErrors {
+		score -= 10
+	}
+	for _, tr := range rl.Tracks {
+		switch {
+		case tr.TestCRC == "":
+			score -= 2
+		case tr.CopyCRC != "" && !strings.EqualFold(tr.TestCRC, tr.CopyCRC):
+			score -= 20
+		}
+		if tr.Errors > 0 || len(tr.Suspicious) > 0 {
+			score -= 10
+		}
+		if tr.AccurateRip == AccurateRipInaccurate {
+			score -= 10
+		}
+		if !tr.CopyCompleted {
+			score -= 5
+		}
+	}
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+func (rl *RipLog) parseHeaderLine(line string) {
+	if v, ok := labelValue(line, driveLabels); ok {
+		rl.Drive = v
+	} else if v, ok := labelValue(line, readModeLabels); ok {
+		rl.ReadMode = v
+	} else if v, ok := labelValue(line, paranoiaLabels); ok && rl.ReadMode == "" {
+		if strings.HasPrefix(strings.ToUpper(v), "YES") {
+			rl.ReadMode = "CDParanoia"
+		}
+	}
+}
+
+func (rl *RipLog) parseTrackLine(track *RipTrack, line string) {
+	// порядок проверок важен: "CRC32 hash (test run)" - частный случай "CRC32 hash"
+	if v, ok := labelValue(line, filenameLabels); ok {
+		track.Filename = v
+	} else if v, ok := labelValue(line, testCRCLabels); ok {
+		track.TestCRC = crcRe.FindString(v)
+	} else if v, ok := labelValue(line, copyCRCLabels); ok {
+		if strings.HasPrefix(line, "CRC32 hash (") {
+			return
+		}
+		track.CopyCRC = crcRe.FindString(v)
+	} else if v, ok := labelValue(line, suspiciousLabels); ok {
+		track.Suspicious = append(track.Suspicious, v)
+	} else if hasLabel(line, copyOKLabels) {
+		track.CopyCompleted = true
+	} else if m := xldErrorStatRe.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		track.Errors += n
+	} else {
+		track.parseAccurateRip(line)
+	}
+}
+
+func (track *RipTrack) parseAccurateRip(line string) {
+	var status string
+	switch {
+	case eacAccurateRe.MatchString(line), xldAccurateRe.MatchString(line):
+		status = AccurateRipAccurate
+	case eacNotAccRe.MatchString(line), xldNotAccRe.MatchString(line):
+		status = AccurateRipInaccurate
+	case eacNotPresRe.MatchString(line), xldNotPresRe.MatchString(line):
+		status = AccurateRipNotPresent
+	default:
+		return
+	}
+	// XLD указывает результат для каждой версии AR: приоритет у положительного
+	if track.AccurateRip == AccurateRipAccurate {
+		return
+	}
+	track.AccurateRip = status
+	if m := confidenceRe.FindStringSubmatch(line); m != nil {
+		track.ARConfidence, _ = strconv.Atoi(m[1])
+	}
+	// XLD завершает трек без явного "Copy OK"
+	track.CopyCompleted = true
+}
+
+// EntryRipQuality формирует отчет о качестве риппинга для каталога альбома.
+// Логи ищутся в самом каталоге и его подкаталогах (многодисковые издания).
+// Файлы ".log", не являющиеся логами EAC/XLD, и файлы, исключенные правилами `ignore`,
+// пропускаются.
+func EntryRipQuality(dir string, ignore *IgnoreRules) (*RipQualityReport, error) {
+	report := &RipQualityReport{Path: dir, Score: -1}
+	err := ignore.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), RipLogExt) {
+			return nil
+		}
+		rl, err := ReadRipLog(path)
+		if err != nil {
+			if err == ErrNotRipLog {
+				return nil
+			}
+			return err
+		}
+		report.Logs = append(
+			report.Logs,
+			&RipLogInfo{File: path, Log: rl, Score: rl.QualityScore()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(report.Logs, func(i, j int) bool { return report.Logs[i].File < report.Logs[j].File })
+	for _, info := range report.Logs {
+		if report.Score == -1 || info.Score < report.Score {
+			report.Score = info.Score
+		}
+	}
+	return report, nil
+}
+
+func decodeRipLog(data []byte) (string, error) {
+	var dec *encoding.Decoder
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		dec = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder()
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		dec = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder()
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), nil
+	case utf8.Valid(data):
+		return string(data), nil
+	default:
+		dec = charmap.Windows1251.NewDecoder()
+	}
+	ret, err := dec.Bytes(data)
+	if err != nil {
+		return "", err
+	}
+	return string(ret), nil
+}
+
+func labelValue(line string, labels []string) (string, bool) {
+	for _, label := range labels {
+		if !strings.HasPrefix(line, label) {
+			continue
+		}
+		rest := line[len(label):]
+		if len(rest) > 0 && rest[0] != ' ' && rest[0] != '\t' && rest[0] != ':' {
+			continue
+		}
+		rest = strings.TrimSpace(rest)
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ":"))
+		return rest, true
+	}
+	return "", false
+}
+
+func hasLabel(line string, labels []string) bool {
+	for _, label := range labels {
+		if strings.HasPrefix(line, label) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package repokeeper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRipLogEAC(t *testing.T) {
+	rl, err := ReadRipLog("testdata/riplog/eac_utf16.log")
+	require.NoError(t, err)
+	assert.Equal(t, RipperEAC, rl.Ripper)
+	assert.Equal(t, "V1.0 beta 3", rl.Version)
+	assert.Equal(t, "Secure", rl.ReadMode)
+	assert.Contains(t, rl.Drive, "PLEXTOR")
+	assert.False(t, rl.NoErrors)
+	require.Len(t, rl.Tracks, 2)
+	assert.Equal(t, "1A2B3C4D", rl.Tracks[0].CopyCRC)
+	assert.Equal(t, AccurateRipAccurate, rl.Tracks[0].AccurateRip)
+	assert.Equal(t, 5, rl.Tracks[0].ARConfidence)
+	assert.Equal(t, AccurateRipInaccurate, rl.Tracks[1].AccurateRip)
+	assert.Equal(t, []string{"0:02:20"}, rl.Tracks[1].Suspicious)
+	assert.Less(t, rl.QualityScore(), 100)
+}
+
+func TestParseRipLogCP1251(t *testing.T) {
+	rl, err := ReadRipLog("testdata/riplog/eac_cp1251.log")
+	require.NoError(t, err)
+	assert.Equal(t, RipperEAC, rl.Ripper)
+	assert.True(t, rl.IsSecureMode())
+	assert.True(t, rl.NoErrors)
+	require.Len(t, rl.Tracks, 1)
+	assert.Equal(t, "0F0F0F0F", rl.Tracks[0].TestCRC)
+	assert.Equal(t, 100, rl.QualityScore())
+}
+
+func TestParseRipLogXLD(t *testing.T) {
+	rl, err := ReadRipLog("testdata/riplog/xld.log")
+	require.NoError(t, err)
+	assert.Equal(t, RipperXLD, rl.Ripper)
+	assert.Equal(t, "XLD Secure Ripper", rl.ReadMode)
+	require.Len(t, rl.Tracks, 1)
+	assert.Equal(t, "8DE2EDBB", rl.Tracks[0].TestCRC)
+	assert.Equal(t, "8DE2EDBB", rl.Tracks[0].CopyCRC)
+	assert.Equal(t, AccurateRipAccurate, rl.Tracks[0].AccurateRip)
+	assert.Equal(t, 100, rl.QualityScore())
+}
+
+func TestEntryRipQuality(t *testing.T) {
+	report, err := EntryRipQuality("testdata/riplog", nil)
+	require.NoError(t, err)
+	assert.Len(t, report.Logs, 3)
+	assert.Equal(t, report.Logs[1].Score, report.Score)
+
+	assert.False(t, IsTechnicalFile("testdata/riplog/xld.log"))
+	assert.True(t, IsTechnicalFile("testdata/riplog/build.log"))
+	assert.True(t, IsTechnicalFile("Thumbs.db"))
+}
@@ -0,0 +1,251 @@
+package repokeeper
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultRootName - имя корня репозитория, создаваемого функцией New.
+const DefaultRootName = "default"
+
+// RootConfig описывает корень репозитория, управляемый хранителем.
+// `Name` указывает корень в путях запросов и событий (см. QualifiedPath), `Dir` -
+// абсолютный путь корневого каталога, `Extensions` - расширения поддерживаемых
+// аудиофайлов, `IgnorePatterns` дополняют общие шаблоны исключения хранителя.
+// `Detection` задает правила распознавания Album Entry корня вместо общих правил
+// хранителя (WithDetectionRules).
+type RootConfig struct {
+	Name           string
+	Dir            string
+	Extensions     []string
+	IgnorePatterns []string
+	Detection      *DetectionRules
+}
+
+// repoRoot описывает состояние корня репозитория. Кеш каждого корня хранится
+// и блокируется отдельно.
+type repoRoot struct {
+	name          string
+	dir           string
+	formats       *FormatRegistry
+	ignore        *IgnoreRules
+	entries       *Entries
+	cache         CacheBackend
+	cacheMu       sync.Mutex
+	lock          *cacheLock
+	transcodes    *TranscodeCache
+	transcodeFile string
+	scanned       chan struct{}
+}
+
+// save сохраняет кеш аудио каталогов корня. Сохранения из горутины наблюдения за ФС
+// и из обработчиков команд выполняются последовательно.
+func (root *repoRoot) save() error {
+	root.cacheMu.Lock()
+	defer root.cacheMu.Unlock()
+	return root.cache.Save(root.entries)
+}
+
+// entryID возвращает идентификатор Album Entry `path` или пустую строку.
+func (root *repoRoot) entryID(path string) string {
+	if elem, err := root.entries.Get(path); err == nil {
+		return elem.EntryID
+	}
+	return ""
+}
+
+// trackCount возвращает число аудиофайлов Album Entry `path`.
+func (root *repoRoot) trackCount(path string) int {
+	if elem, err := root.entries.Get(path); err == nil {
+		return len(elem.Files)
+	}
+	return 0
+}
+
+// qualify возвращает путь `path` корня в виде QualifiedPath.
+func (root *repoRoot) qualify(path string) string {
+	rel, err := relativePath(root.dir, path)
+	if err != nil {
+		return path
+	}
+	return QualifiedPath(root.name, rel)
+}
+
+// QualifiedPath возвращает путь в виде "<имя корня>:<путь относительно корня>".
+// Корневой каталог записывается как "<имя корня>:".
+func QualifiedPath(root, rel string) string {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	if rel == "." {
+		rel = ""
+	}
+	return root + ":" + rel
+}
+
+// SplitQualifiedPath разделяет путь вида QualifiedPath на имя корня и путь
+// относительно корня. Для абсолютных путей возвращает false.
+func SplitQualifiedPath(path string) (root, rel string, ok bool) {
+	if filepath.IsAbs(path) {
+		return "", "", false
+	}
+	i := strings.Index(path, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+	return path[:i], filepath.FromSlash(path[i+1:]), true
+}
+
+// validateRoots проверяет уникальность имен корней и отсутствие вложенных корней.
+func validateRoots(roots []RootConfig) error {
+	if len(roots) == 0 {
+		return errors.New("audio repository roots are not specified")
+	}
+	for i, root := range roots {
+		if root.Name == "" || strings.ContainsAny(root.Name, ":/"+string(filepath.Separator)) {
+			return fmt.Errorf("invalid audio repository root name: %q", root.Name)
+		}
+		if !filepath.IsAbs(root.Dir) {
+			return errors.New("audio repository root dir must be an absolute path")
+		}
+		for _, prev := range roots[:i] {
+			if prev.Name == root.Name {
+				return fmt.Errorf("duplicate audio repository root name: %s", root.Name)
+			}
+			if isSubdir(prev.Dir, root.Dir) || isSubdir(root.Dir, prev.Dir) {
+				return fmt.Errorf("audio repository roots %s and %s overlap", prev.Name, root.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func isSubdir(dir, path string) bool {
+	_, err := relativePath(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil
+}
+
+// openRoot создает состояние корня репозитория по описанию `cfg`: блокирует
+// и открывает его кеш, загружает кеш анализа транскодирования.
+func (rk *RepoKeeper) openRoot(cfg RootConfig) (*repoRoot, error) {
+	dir := filepath.Clean(cfg.Dir)
+	formats, err := FormatsByExtensions(cfg.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	patterns := append(append([]string(nil), DefaultIgnorePatterns...), rk.ignorePatterns...)
+	ignore, err := NewIgnoreRules(dir, append(patterns, cfg.IgnorePatterns...))
+	if err != nil {
+		return nil, err
+	}
+	root := &repoRoot{
+		name:       cfg.Name,
+		dir:        dir,
+		formats:    formats,
+		ignore:     ignore,
+		entries:    NewEntries(dir, formats),
+		transcodes: NewTranscodeCache(),
+		scanned:    make(chan struct{})}
+	root.entries.Ignore = ignore
+	root.entries.Symlinks = rk.symlinks
+	root.entries.TrackHashes = rk.trackHashes
+	root.entries.Xattrs = rk.entryXattrs
+	root.entries.Detection = rk.detection
+	if cfg.Detection != nil {
+		root.entries.Detection = *cfg.Detection
+	}
+
+	base := filepath.Join(rk.cacheDir, CacheBaseName(dir))
+	root.transcodeFile = base + TranscodeCacheFileExt
+	if root.lock, err = lockCache(base + LockFileExt); err != nil {
+		return nil, err
+	}
+	if root.cache, err = rk.openCache(base, dir, formats); err != nil {
+		root.lock.unlock()
+		return nil, err
+	}
+	if err := root.transcodes.LoadFrom(root.transcodeFile); err != nil && !os.IsNotExist(err) {
+		root.cache.Close()
+		root.lock.unlock()
+		return nil, err
+	}
+	return root, nil
+}
+
+// closeRoot сохраняет кеши корня и снимает блокировку кеша.
+// Результат незавершенного сканирования не сохраняется.
+func (rk *RepoKeeper) closeRoot(root *repoRoot) {
+	select {
+	case <-root.scanned:
+		if err := root.save(); err != nil {
+			rk.Log.Error(err)
+		}
+	default:
+	}
+	if err := root.cache.Close(); err != nil {
+		rk.Log.Error(err)
+	}
+	if err := root.transcodes.SaveTo(root.transcodeFile); err != nil {
+		rk.Log.Error(err)
+	}
+	if err := root.lock.unlock(); err != nil {
+		rk.Log.Error(err)
+	}
+}
+
+// rootOf возвращает корень, содержащий абсолютный путь `path`, или nil.
+func (rk *RepoKeeper) rootOf(path string) *repoRoot {
+	for _, root := range rk.roots {
+		if isSubdir(root.dir, path) {
+			return root
+		}
+	}
+	return nil
+}
+
+// rootByName возвращает корень по имени. Пустое имя допускается для хранителя
+// с единственным корнем.
+func (rk *RepoKeeper) rootByName(name string) (*repoRoot, error) {
+	if name == "" && len(rk.roots) == 1 {
+		return rk.roots[0], nil
+	}
+	for _, root := range rk.roots {
+		if root.name == name {
+			return root, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown audio repository root: %q", name)
+}
+
+// resolvePath возвращает корень и абсолютный путь для пути запроса `path`, заданного
+// в виде QualifiedPath или абсолютным путем внутри одного из корней.
+func (rk *RepoKeeper) resolvePath(path string) (*repoRoot, string, error) {
+	if name, rel, ok := SplitQualifiedPath(path); ok {
+		root, err := rk.rootByName(name)
+		if err != nil {
+			return nil, "", err
+		}
+		abs := filepath.Join(root.dir, rel)
+		if !isSubdir(root.dir, abs) {
+			return nil, "", fmt.Errorf("%s is out of root %s", path, root.name)
+		}
+		return root, abs, nil
+	}
+	if filepath.IsAbs(path) {
+		if root := rk.rootOf(path); root != nil {
+			return root, filepath.Clean(path), nil
+		}
+	}
+	return nil, "", fmt.Errorf("path is out of audio repository roots: %s", path)
+}
+
+// qualify возвращает абсолютный путь `path` в виде QualifiedPath. Пути вне корней
+// репозитория возвращаются без изменений.
+func (rk *RepoKeeper) qualify(path string) string {
+	if root := rk.rootOf(path); root != nil {
+		return root.qualify(path)
+	}
+	return path
+}
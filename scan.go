@@ -0,0 +1,295 @@
+package repokeeper
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DefaultScanWorkers - число параллельно сканируемых каталогов по умолчанию.
+const DefaultScanWorkers = 8
+
+// SymlinkPolicy задает обработку символических ссылок при сканировании репозитория.
+type SymlinkPolicy uint8
+
+// Политики обработки символических ссылок:
+// IgnoreSymlinks - ссылки на файлы и каталоги пропускаются;
+// FollowSymlinks - ссылки на файлы обрабатываются как файлы, каталоги по ссылкам
+// сканируются, если не были просмотрены по другому пути (иначе ссылка - псевдоним);
+// AliasSymlinks - ссылки на файлы пропускаются, ссылки на просмотренные каталоги
+// репозитория сохраняются как псевдонимы.
+const (
+	IgnoreSymlinks SymlinkPolicy = iota
+	FollowSymlinks
+	AliasSymlinks
+)
+
+// ScanProgress описывает ход сканирования репозитория.
+// `Dirs` содержит число просмотренных каталогов, `AlbumEntries` - число найденных
+// Album Entry.
+type ScanProgress struct {
+	Dirs         int
+	AlbumEntries int
+}
+
+// ScanOptions задает параметры сканирования репозитория.
+// `Workers` ограничивает число параллельно сканируемых каталогов (DefaultScanWorkers,
+// если не задано). `Progress` вызывается последовательно после просмотра каждого
+// каталога и не должен выполнять длительных операций. Из снимка кеша предыдущей
+// сессии `Previous` берутся хеши аудиофайлов, не изменившихся с тем же путем.
+type ScanOptions struct {
+	Workers  int
+	Progress func(progress ScanProgress)
+	Previous NodeStore
+}
+
+// scanner обходит дерево каталогов пулом горутин.
+// Очередь каталогов не ограничена, чтобы обработчики не блокировались при добавлении
+// подкаталогов; `pending` учитывает каталоги в очереди и в обработке.
+// `visited` содержит просмотренные каталоги по идентификаторам, `links` - найденные
+// ссылки на каталоги, которые обрабатываются после обхода реальных каталогов.
+type scanner struct {
+	ent        *Entries
+	root       string
+	prev       NodeStore
+	ctx        context.Context
+	progressFn func(progress ScanProgress)
+	policy     SymlinkPolicy
+	visited    map[FileID]string
+	links      []string
+	mu         sync.Mutex
+	cond       *sync.Cond
+	queue      []string
+	pending    int
+	err        error
+	progress   ScanProgress
+}
+
+// Scan пересчитывает кеш аудио каталогов параллельным обходом каталога `dir`.
+// Каталог считается Album Entry по правилам Detection: по файлу-маркеру или по
+// найденному аудиофайлу с номером MinTracks, подкаталоги, следующие по имени за этим
+// аудиофайлом, и подкаталоги Album Entry с маркером не просматриваются.
+// Ссылки на каталоги обрабатываются в порядке сортировки путей после обхода реальных
+// каталогов, поэтому основным путем каталога всегда является путь без ссылок.
+// При отмене `ctx` сканирование прерывается с ошибкой контекста, а кеш остается
+// заполненным частично.
+func (ent *Entries) Scan(ctx context.Context, dir string, opts ScanOptions) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultScanWorkers
+	}
+	s := &scanner{
+		ent:        ent,
+		root:       dir,
+		prev:       opts.Previous,
+		ctx:        ctx,
+		progressFn: opts.Progress,
+		policy:     ent.Symlinks,
+		visited:    make(map[FileID]string)}
+	s.cond = sync.NewCond(&s.mu)
+	s.push(dir)
+	for s.run(workers); s.err == nil && len(s.links) > 0; s.run(workers) {
+		links := s.links
+		s.links = nil
+		sort.Strings(links)
+		for _, link := range links {
+			id, err := FileIdentity(link)
+			if err != nil {
+				continue
+			}
+			if target, ok := s.visited[id]; ok {
+				// ссылка на просмотренный каталог, в том числе на родительский
+				ent.AddAlias(target, link)
+			} else if s.policy == FollowSymlinks {
+				s.visited[id] = link
+				s.push(link)
+			}
+		}
+	}
+	return s.err
+}
+
+// run обходит каталоги очереди пулом из `workers` горутин.
+func (s *scanner) run(workers int) {
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := s.pop()
+				if !ok {
+					return
+				}
+				s.done(s.scanDir(dir))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// visit отмечает каталог `dir` как просмотренный. Возвращает путь, по которому
+// каталог уже был просмотрен, или пустую строку.
+func (s *scanner) visit(id FileID, dir string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.visited[id]; ok && prev != dir {
+		return prev
+	}
+	s.visited[id] = dir
+	return ""
+}
+
+func (s *scanner) push(dirs ...string) {
+	if len(dirs) == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.queue = append(s.queue, dirs...)
+	s.pending += len(dirs)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// pop возвращает очередной каталог или false, если обход завершен или прерван.
+func (s *scanner) pop() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) == 0 && s.pending > 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil || len(s.queue) == 0 {
+		return "", false
+	}
+	// обход в глубину ограничивает размер очереди
+	dir := s.queue[len(s.queue)-1]
+	s.queue = s.queue[:len(s.queue)-1]
+	return dir, true
+}
+
+func (s *scanner) done(album bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+	s.pending--
+	if err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+		return
+	}
+	s.progress.Dirs++
+	if album {
+		s.progress.AlbumEntries++
+	}
+	if s.progressFn != nil {
+		s.progressFn(s.progress)
+	}
+}
+
+// scanDir просматривает каталог и добавляет его подкаталоги в очередь обхода.
+// Список аудиофайлов формируется по прочитанному содержимому каталога, хеши
+// вычисляются, только если каталог является Album Entry.
+// Возвращает true, если каталог является Album Entry.
+func (s *scanner) scanDir(dir string) (bool, error) {
+	if err := s.ctx.Err(); err != nil {
+		return false, err
+	}
+	id, err := FileIdentity(dir)
+	if os.IsNotExist(err) && dir != s.root {
+		// каталог удален во время сканирования
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if prev := s.visit(id, dir); prev != "" {
+		// тот же каталог, доступный по другому пути (например, точка bind-монтирования)
+		s.ent.AddAlias(prev, dir)
+		return false, nil
+	}
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) && dir != s.root {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	marker := dirMarker(files)
+	var inventory []TrackFile
+	if marker != SkipMarkerFile {
+		if inventory, err = s.ent.readDirInventory(dir, files, s.prevFiles(dir)); err != nil {
+			return false, err
+		}
+	}
+	if marker == AlbumMarkerFile {
+		return s.addAlbumEntry(dir, inventory)
+	}
+	audio := make(map[string]bool, len(inventory))
+	for _, track := range inventory {
+		audio[track.Name] = true
+	}
+	tracks := 0
+	var subdirs, links []string
+	defer func() {
+		s.push(subdirs...)
+		s.mu.Lock()
+		s.links = append(s.links, links...)
+		s.mu.Unlock()
+	}()
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		isDir, isLink := f.IsDir(), f.Type()&fs.ModeSymlink != 0
+		if isLink {
+			info, err := os.Stat(path)
+			if err != nil {
+				// ссылка на отсутствующий объект
+				continue
+			}
+			isDir = info.IsDir()
+		}
+		if s.ent.Ignore.match(path, isDir) || isDir && s.ent.Detection.skipDir(path) {
+			continue
+		}
+		switch {
+		case isLink && isDir:
+			if s.policy != IgnoreSymlinks {
+				links = append(links, path)
+			}
+		case isDir:
+			subdirs = append(subdirs, path)
+		case audio[f.Name()]:
+			if tracks++; tracks >= s.ent.Detection.minTracks() {
+				return s.addAlbumEntry(dir, inventory)
+			}
+		}
+	}
+	return false, nil
+}
+
+// prevFiles возвращает список аудиофайлов Album Entry `dir` из снимка кеша
+// предыдущей сессии.
+func (s *scanner) prevFiles(dir string) []TrackFile {
+	if s.prev != nil {
+		if elem, err := s.prev.Get(dir); err == nil && elem.Kind == AlbumEntryNode {
+			return elem.Files
+		}
+	}
+	return nil
+}
+
+// addAlbumEntry добавляет Album Entry со списком аудиофайлов `inventory`, вычисляя
+// отсутствующие хеши файлов.
+func (s *scanner) addAlbumEntry(dir string, inventory []TrackFile) (bool, error) {
+	files, err := s.ent.hashTracks(dir, inventory)
+	if err != nil {
+		return false, err
+	}
+	if err := s.ent.setAlbumFiles(dir, files); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,141 @@
+package repokeeper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntriesScan(t *testing.T) {
+	flac, err := ioutil.ReadFile("testdata/repo/flac/flac/test.flac")
+	require.NoError(t, err)
+	root := t.TempDir()
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 5; j++ {
+			dir := filepath.Join(root, fmt.Sprintf("artist%d", i), fmt.Sprintf("album%d", j))
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "Scans"), 0755))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "01.flac"), flac, 0644))
+		}
+	}
+
+	seq := NewEntries(root, DefaultFormats())
+	require.NoError(t, seq.Scan(context.Background(), root, ScanOptions{Workers: 1}))
+	var last ScanProgress
+	par := NewEntries(root, DefaultFormats())
+	require.NoError(t, par.Scan(context.Background(), root, ScanOptions{
+		Workers:  8,
+		Progress: func(progress ScanProgress) { last = progress }}))
+
+	assert.Len(t, par.AlbumEntries(), 100)
+	assert.Equal(t, seq.AlbumEntries(), par.AlbumEntries())
+	assert.Len(t, par.Cache, len(seq.Cache))
+	for path, elem := range seq.Cache {
+		require.Contains(t, par.Cache, path)
+		assert.ElementsMatch(t, elem.Children, par.Cache[path].Children, path)
+	}
+	// подкаталоги после аудиофайла не просматриваются
+	assert.Equal(t, ScanProgress{Dirs: 1 + 20 + 100, AlbumEntries: 100}, last)
+}
+
+func TestEntriesScanCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ent := NewEntries("testdata/repo", DefaultFormats())
+	assert.ErrorIs(t, ent.Scan(ctx, "testdata/repo", ScanOptions{}), context.Canceled)
+
+	assert.Error(t, ent.Scan(context.Background(), "testdata/nonexistent", ScanOptions{}))
+}
+
+func TestEntriesScanSymlinks(t *testing.T) {
+	flac, err := ioutil.ReadFile("testdata/repo/flac/flac/test.flac")
+	require.NoError(t, err)
+	root, outside := t.TempDir(), t.TempDir()
+	album := filepath.Join(root, "artist/album")
+	require.NoError(t, os.MkdirAll(album, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(album, "01.flac"), flac, 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(outside, "ext_album"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outside, "ext_album/01.flac"), flac, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "singles"), 0755))
+	require.NoError(t, os.Symlink(album, filepath.Join(root, "artist/album_link")))
+	require.NoError(t, os.Symlink(root, filepath.Join(root, "loop")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "external")))
+	require.NoError(t, os.Symlink(
+		filepath.Join(album, "01.flac"), filepath.Join(root, "singles/01.flac")))
+
+	scan := func(policy SymlinkPolicy) *Entries {
+		ent := NewEntries(root, DefaultFormats())
+		ent.Symlinks = policy
+		require.NoError(t, ent.Calculate(root))
+		return ent
+	}
+
+	ent := scan(IgnoreSymlinks)
+	assert.Equal(t, []string{album}, ent.AlbumEntries())
+	assert.Empty(t, ent.Cache[album].Aliases)
+
+	ent = scan(AliasSymlinks)
+	assert.Equal(t, []string{album}, ent.AlbumEntries())
+	assert.Equal(t, []string{filepath.Join(root, "artist/album_link")}, ent.Cache[album].Aliases)
+	assert.Equal(t, []string{filepath.Join(root, "loop")}, ent.Cache[root].Aliases)
+
+	ent = scan(FollowSymlinks)
+	assert.Equal(t, []string{
+		album,
+		filepath.Join(root, "external/ext_album"),
+		filepath.Join(root, "singles"),
+	}, ent.AlbumEntries())
+	assert.Equal(t, []string{filepath.Join(root, "artist/album_link")}, ent.Cache[album].Aliases)
+	require.Len(t, ent.Cache[filepath.Join(root, "singles")].Files, 1)
+
+	info := ent.Info(filepath.Join(root, "loop/artist/album_link"))
+	require.NotNil(t, info)
+	assert.Equal(t, album, info.Path)
+	info = ent.Info(filepath.Join(root, "loop/artist/album"))
+	require.NotNil(t, info)
+	assert.Equal(t, album, info.Path)
+	assert.Equal(t, AlbumEntryNode, info.Kind)
+	assert.Nil(t, ent.Info(filepath.Join(root, "nonexistent")))
+
+	// псевдонимы сохраняются в кеше относительно корня
+	fn := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, ent.SaveTo(fn))
+	loaded := NewEntries(root, DefaultFormats())
+	require.NoError(t, loaded.LoadFrom(fn))
+	assert.Equal(t, ent.Cache[album].Aliases, loaded.Cache[album].Aliases)
+
+	// псевдонимы переносятся вместе с переименованным каталогом и удаляются вместе
+	// с удаленным
+	require.NoError(t, ent.Rename(filepath.Join(root, "artist"), filepath.Join(root, "artist2")))
+	album = filepath.Join(root, "artist2/album")
+	assert.Equal(t, []string{filepath.Join(root, "artist2/album_link")}, ent.Cache[album].Aliases)
+	ent.AddAlias(album, filepath.Join(root, "singles/album_link"))
+	ent.Delete(filepath.Join(root, "singles"))
+	assert.Equal(t, []string{filepath.Join(root, "artist2/album_link")}, ent.Cache[album].Aliases)
+}
+
+func TestEntriesScanPrevious(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "album")
+	writeTestTracks(t, album, "01.flac", "02.flac")
+	old := NewEntries(root, DefaultFormats())
+	require.NoError(t, old.Scan(context.Background(), root, ScanOptions{}))
+	old.Cache[album].Files[0].PartialHash = "cached"
+	old.Cache[album].Files[1].PartialHash = "cached"
+	// файл изменен после сохранения кеша
+	require.NoError(t, os.Chtimes(filepath.Join(album, "02.flac"), time.Now(), time.Unix(1, 0)))
+
+	ent := NewEntries(root, DefaultFormats())
+	require.NoError(t, ent.Scan(context.Background(), root, ScanOptions{Previous: old}))
+	files := ent.Cache[album].Files
+	require.Len(t, files, 2)
+	assert.Equal(t, "cached", files[0].PartialHash)
+	assert.NotEqual(t, "cached", files[1].PartialHash)
+	assert.NotEmpty(t, files[1].PartialHash)
+}
@@ -1,6 +1,7 @@
 package repokeeper
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,7 +9,10 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/streadway/amqp"
@@ -19,43 +23,171 @@ import (
 
 // Константы микросервиса
 const (
-	ServiceName = "repokeeper"
-	CacheFile   = ".cache"
+	ServiceName    = "repokeeper"
+	ServiceVersion = "0.1.0"
 )
 
+// scanProgressLogStep - периодичность (в каталогах) журналирования хода сканирования.
+const scanProgressLogStep = 1000
+
 // RepoKeeper описывает внутреннее состояние хранителя репозитория.
 type RepoKeeper struct {
 	*srv.Service
-	rootDir           string
-	extensions        []string
+	roots             []*repoRoot
 	pub               *srv.Publisher
 	w                 *fsnotify.Watcher
-	entries           *Entries
-	inodesForRenaming map[string]uint64
+	watches           *watchSet
+	inodesForRenaming map[string]renamedDir    // используется только в горутине fsEvents
+	pending           map[string]*pendingEntry // используется только в горутине fsEvents
+	hashQueue         *trackHashQueue
+	settleDelay       time.Duration
+	jobs              *jobRegistry
+	cacheDir          string
+	boltCache         bool
+	emit              func(contentType string, data []byte) error
+	scanWorkers       int
+	ignorePatterns    []string
+	symlinks          SymlinkPolicy
+	detection         DetectionRules
+	trackHashes       bool
+	entryXattrs       bool
+	ctx               context.Context
+	cancel            context.CancelFunc
 }
 
-// New создает объект хранителя репозитория.
-// Корневой каталог аудио рпеозитори должен быть указан как абсолютный путь.
-func New(rootDir string, extensions []string) *RepoKeeper {
-	if !filepath.IsAbs(rootDir) {
-		srv.FailOnError(
-			errors.New("audio repository root dir must be an absolute path"),
-			"service parameters parsing")
+// Option задает необязательный параметр хранителя репозитория.
+type Option func(rk *RepoKeeper)
+
+// WithCacheDir задает каталог для файлов кеша сервиса вместо DefaultCacheDir().
+func WithCacheDir(dir string) Option {
+	return func(rk *RepoKeeper) {
+		rk.cacheDir = dir
+	}
+}
+
+// WithBoltCache задает хранение кеша аудио каталогов во встроенной базе данных
+// вместо JSON-файла. Рекомендуется для репозиториев с большим числом альбомов.
+func WithBoltCache() Option {
+	return func(rk *RepoKeeper) {
+		rk.boltCache = true
+	}
+}
+
+// WithScanWorkers задает число параллельно сканируемых каталогов при запуске сервиса.
+// Для репозиториев на дисках с низкой скоростью позиционирования (NAS, HDD) имеет
+// смысл уменьшить значение по умолчанию DefaultScanWorkers.
+func WithScanWorkers(n int) Option {
+	return func(rk *RepoKeeper) {
+		rk.scanWorkers = n
 	}
+}
+
+// WithIgnorePatterns добавляет общие шаблоны исключения файлов и каталогов репозитория
+// к DefaultIgnorePatterns (формат шаблонов описан в IgnoreRules). Дополнительно
+// учитываются файлы IgnoreFileName в каталогах репозитория.
+func WithIgnorePatterns(patterns ...string) Option {
+	return func(rk *RepoKeeper) {
+		rk.ignorePatterns = append(rk.ignorePatterns, patterns...)
+	}
+}
+
+// WithSymlinkPolicy задает обработку символических ссылок при сканировании репозитория
+// (по умолчанию IgnoreSymlinks).
+func WithSymlinkPolicy(policy SymlinkPolicy) Option {
+	return func(rk *RepoKeeper) {
+		rk.symlinks = policy
+	}
+}
+
+// WithDetectionRules задает правила распознавания Album Entry для корней репозитория
+// вместо DefaultDetectionRules.
+func WithDetectionRules(rules DetectionRules) Option {
+	return func(rk *RepoKeeper) {
+		rk.detection = rules
+	}
+}
+
+// WithEntryXattrs включает хранение идентификаторов и состояния Album Entry (EntryState)
+// в расширенных атрибутах каталогов `user.repokeeper.*`. Атрибуты сохраняются при
+// копировании каталога с атрибутами и позволяют опознать Album Entry при запуске
+// сервиса, даже если изменился inode каталога (копия на другом диске, восстановление
+// из резервной копии). На ФС без поддержки расширенных атрибутов используется только кеш.
+func WithEntryXattrs() Option {
+	return func(rk *RepoKeeper) {
+		rk.entryXattrs = true
+	}
+}
+
+// WithSettleDelay задает продолжительность периода без изменений содержимого нового
+// каталога (событий создания, записи и изменения атрибутов файлов, а также размеров
+// файлов), после которого распознается Album Entry и передается событие о его создании.
+// Позволяет сообщать о скопированном альбоме после завершения копирования, а не по
+// первому файлу. Нулевое значение отключает ожидание.
+func WithSettleDelay(d time.Duration) Option {
+	return func(rk *RepoKeeper) {
+		rk.settleDelay = d
+	}
+}
+
+// WithTrackHashes включает хеширование содержимого файлов треков при сканировании
+// репозитория. Позволяет обнаружить изменения треков без изменения размера и времени
+// модификации файлов ценой полного чтения репозитория при запуске сервиса.
+func WithTrackHashes() Option {
+	return func(rk *RepoKeeper) {
+		rk.trackHashes = true
+	}
+}
+
+// New создает объект хранителя репозитория с единственным корнем DefaultRootName.
+// Корневой каталог аудио рпеозитори должен быть указан как абсолютный путь.
+// Файлы кеша размещаются в каталоге кеша под именем, производным от корневого каталога,
+// и блокируются от использования другими экземплярами сервиса.
+func New(rootDir string, extensions []string, opts ...Option) *RepoKeeper {
+	return NewWithRoots(
+		[]RootConfig{{Name: DefaultRootName, Dir: rootDir, Extensions: extensions}}, opts...)
+}
+
+// NewWithRoots создает объект хранителя репозитория из нескольких корней, например
+// на разных дисках. Корни не должны быть вложены друг в друга. Кеш каждого корня
+// хранится отдельно, пути в запросах и событиях указываются в виде QualifiedPath.
+func NewWithRoots(roots []RootConfig, opts ...Option) *RepoKeeper {
+	srv.FailOnError(validateRoots(roots), "service parameters parsing")
 
 	w, err := fsnotify.NewWatcher()
 	srv.FailOnError(err, "watcher initialization")
 
-	err = w.Add(rootDir)
-	srv.FailOnError(err, "watch point adding")
-
-	return &RepoKeeper{
+	rk := &RepoKeeper{
 		Service:           srv.NewService(ServiceName),
-		rootDir:           rootDir,
-		extensions:        extensions,
 		w:                 w,
-		entries:           NewEntries(rootDir, extensions),
-		inodesForRenaming: make(map[string]uint64)}
+		watches:           newWatchSet(),
+		inodesForRenaming: make(map[string]renamedDir),
+		pending:           make(map[string]*pendingEntry),
+		hashQueue:         newTrackHashQueue(),
+		settleDelay:       DefaultSettleDelay,
+		jobs:              newJobRegistry(),
+		detection:         DefaultDetectionRules}
+	rk.ctx, rk.cancel = context.WithCancel(context.Background())
+	rk.emit = func(contentType string, data []byte) error {
+		return rk.pub.Emit(contentType, data)
+	}
+	for _, opt := range opts {
+		opt(rk)
+	}
+
+	if rk.cacheDir == "" {
+		rk.cacheDir, err = DefaultCacheDir()
+		srv.FailOnError(err, "cache dir detection")
+	}
+	srv.FailOnError(os.MkdirAll(rk.cacheDir, 0755), "cache dir creation")
+	for _, cfg := range roots {
+		root, err := rk.openRoot(cfg)
+		srv.FailOnError(err, fmt.Sprintf("audio repository root opening: %s", cfg.Name))
+		rk.roots = append(rk.roots, root)
+		if !rk.watchDir(root.dir) {
+			srv.FailOnError(fmt.Errorf("watch point adding: %s", root.dir), "watcher initialization")
+		}
+	}
+	return rk
 }
 
 // AnswerWithError заполняет структуру ответа информацией об ошибке.
@@ -78,7 +210,7 @@ func (rk *RepoKeeper) StartWithConnection(connstr string) {
 	rk.pub = srv.NewPublisher(connstr)
 	msgs := rk.Service.ConnectToMessageBroker(connstr)
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
@@ -106,8 +238,10 @@ func (rk *RepoKeeper) StartWithConnection(connstr string) {
 }
 
 func (rk *RepoKeeper) cleanup() {
-	if err := rk.entries.SaveTo(CacheFile); err != nil {
-		rk.Log.Error(err)
+	rk.cancel()
+	rk.jobs.cancelAll()
+	for _, root := range rk.roots {
+		rk.closeRoot(root)
 	}
 	if err := rk.w.Close(); err != nil {
 		rk.Log.Error(err)
@@ -132,6 +266,22 @@ func (rk *RepoKeeper) RunCmd(req *AudioRepoRequest, delivery *amqp.Delivery) {
 	switch req.Cmd {
 	case "normalize":
 		data, err = rk.normalize(req)
+	case "rip_quality":
+		data, err = rk.ripQuality(req)
+	case "transcode_check":
+		data, err = rk.transcodeCheck(req)
+	case "completeness":
+		data, err = rk.completeness(req)
+	case "loudness":
+		data, err = rk.loudness(req)
+	case "cancel_job":
+		data, err = rk.cancelJob(req)
+	case "relocate":
+		data, err = rk.relocate(req)
+	case "move":
+		data, err = rk.move(req)
+	case "entry_info":
+		data, err = rk.entryInfo(req)
 	default:
 		rk.Service.RunCmd(req.Cmd, delivery)
 		return
@@ -148,136 +298,792 @@ func (rk *RepoKeeper) RunCmd(req *AudioRepoRequest, delivery *amqp.Delivery) {
 }
 
 func (rk *RepoKeeper) applyChangesBetweenSessions() {
-	err := rk.entries.Calculate(rk.rootDir)
+	for _, root := range rk.roots {
+		if !rk.applyRootChanges(root) {
+			return
+		}
+	}
+}
+
+// applyRootChanges сканирует корень репозитория и передает подписчикам изменения
+// с момента последнего сохранения кеша. Возвращает false при отмене сканирования.
+func (rk *RepoKeeper) applyRootChanges(root *repoRoot) bool {
+	oldParents, snapErr := root.cache.Snapshot()
+	var prev NodeStore
+	if snapErr == nil {
+		prev = oldParents
+	}
+	err := root.entries.Scan(rk.ctx, root.dir, ScanOptions{
+		Workers: rk.scanWorkers,
+		Progress: func(progress ScanProgress) {
+			rk.logScanProgress(root, progress)
+		},
+		Previous: prev})
+	if errors.Is(err, context.Canceled) {
+		if snapErr == nil {
+			closeSnapshot(oldParents)
+		}
+		return false
+	}
 	srv.FailOnError(err, "entry cache creation")
+	close(root.scanned)
 	// проведение изменений с момента последнего формирования кеша и по настоящий момент
-	oldParents := NewEntries(rk.rootDir, rk.extensions)
-	if err := oldParents.LoadFrom(CacheFile); err == nil {
-		for path, mod := range rk.entries.Compare(oldParents) {
-			switch mod.Change {
-			case CreatedFsChange:
-				rk.onEntryCreated(path)
-			case RenamedFsChange:
-				rk.onEntryRenamed(path, mod.NewName)
-			case DeletedFsChange:
-				rk.onEntryDeleted(path)
-			}
+	if snapErr == nil {
+		srv.FailOnError(root.entries.InheritEntryIDs(oldParents), "entry ids inheriting")
+		srv.FailOnError(rk.emitChanges(root, oldParents), "cache comparing")
+	} else if errors.Is(snapErr, ErrCacheMismatch) || errors.Is(snapErr, ErrCacheCorrupt) {
+		// кеш другого репозитория или поврежденный кеш заменяется результатом
+		// полного сканирования, изменения между сессиями не определяются
+		rk.Log.Warn(snapErr)
+	} else if !errors.Is(snapErr, os.ErrNotExist) {
+		srv.FailOnError(snapErr, "cache reading")
+	}
+	if snapErr == nil {
+		srv.FailOnError(closeSnapshot(oldParents), "cache reading")
+	}
+	rk.checkpoint(root)
+	return true
+}
+
+func (rk *RepoKeeper) logScanProgress(root *repoRoot, progress ScanProgress) {
+	if progress.Dirs%scanProgressLogStep == 0 {
+		rk.Log.Infof("scanning %s: %d dirs, %d album entries",
+			root.name, progress.Dirs, progress.AlbumEntries)
+	}
+}
+
+// openCache открывает хранилище кеша аудио каталогов для корня `root`.
+// `base` - путь к файлам кеша без расширения.
+func (rk *RepoKeeper) openCache(base, root string, formats *FormatRegistry) (CacheBackend, error) {
+	if rk.boltCache {
+		return OpenBoltBackend(base+BoltCacheFileExt, root, formats)
+	}
+	return NewJSONBackend(base+CacheFileExt, root, formats), nil
+}
+
+// emitChanges передает подписчикам изменения Album Entry корня относительно снимка `old`.
+func (rk *RepoKeeper) emitChanges(root *repoRoot, old NodeStore) error {
+	changes, err := root.entries.Compare(old)
+	if err != nil {
+		return err
+	}
+	for path, mod := range changes {
+		if mod.Kind != AlbumEntryNode {
+			continue
 		}
-	} else {
-		if os.IsExist(err) {
-			// if err != os.ErrNotExist {
-			srv.FailOnError(err, "cache reading")
+		switch mod.Change {
+		case CreatedFsChange:
+			rk.onEntryCreated(path, mod.EntryID, root.trackCount(path))
+		case RenamedFsChange:
+			rk.onEntryRenamed(path, mod.NewName, mod.EntryID)
+			rk.onTracksChanged(mod.NewName, mod.Tracks, mod.EntryID)
+		case DeletedFsChange:
+			rk.onEntryDeleted(path, mod.EntryID)
+		case ModifiedFsChange:
+			rk.onTracksChanged(path, mod.Tracks, mod.EntryID)
+		case MovedFsChange:
+			// Album Entry, опознанный по содержимому, сохраняет идентификатор и состояние
+			prev, err := old.Get(path)
+			if err != nil {
+				return err
+			}
+			var state *EntryState
+			if cur, err := root.entries.Get(mod.NewName); err == nil && cur.State == nil {
+				state = prev.State
+			}
+			root.entries.SetEntryID(mod.NewName, mod.EntryID, state)
+			rk.onEntryMatched(path, mod.NewName, mod.EntryID, mod.Confidence)
+			rk.onTracksChanged(mod.NewName, mod.Tracks, mod.EntryID)
 		}
 	}
+	return nil
 }
 
-// рекурсивное добавление Entry и их родительских каталогов по данным кеша.
+// addWatchPoints добавляет наблюдение за всеми каталогами корней репозитория.
 func (rk *RepoKeeper) addWatchPoints() {
-	for path := range rk.entries.Cache {
-		if rk.isAlbumEntry(path) {
-			srv.FailOnError(rk.w.Add(path), fmt.Sprintf("add watch dir: %s", path))
-		}
+	for _, root := range rk.roots {
+		rk.watchTree(root, root.dir, false)
+	}
+}
+
+// checkpoint сохраняет кеш аудио каталогов корня, если в нем есть несохраненные изменения.
+func (rk *RepoKeeper) checkpoint(root *repoRoot) {
+	if root.entries.Changes() == 0 {
+		return
+	}
+	if err := root.save(); err != nil {
+		rk.Log.Error(err)
 	}
 }
 
 func (rk *RepoKeeper) fsEvents() {
+	go rk.trackHashing()
+	ticker := time.NewTicker(CheckpointInterval)
+	defer ticker.Stop()
+	settle := time.NewTicker(rk.settleTick())
+	defer settle.Stop()
 	for {
 		select {
-		case event, ok := <-rk.w.Events:
-			if !ok {
-				srv.FailOnError(errors.New("event retriving error"), "fsEvents")
+		case <-ticker.C:
+			for _, root := range rk.roots {
+				rk.checkpoint(root)
 			}
-			rk.Log.Debug(event)
-
-			info, err := os.Stat(event.Name)
-			srv.FailOnError(err, "fsEvents")
-
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				rk.onFsObjectCreated(event.Name, info)
 
-			} else if event.Op&fsnotify.Rename == fsnotify.Rename {
-				rk.onFsObjectRenamed(event.Name, info)
+		case now := <-settle.C:
+			rk.settlePending(now)
 
-			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-				rk.onFsObjectDeleted(event.Name, info)
+		case event, ok := <-rk.w.Events:
+			if !ok {
+				// наблюдение за ФС прекращено при освобождении ресурсов
+				return
 			}
+			rk.onFsEvent(event)
 
 		case err, ok := <-rk.w.Errors:
 			if !ok {
-				srv.FailOnError(errors.New("error retriving error"), "fsEvents")
+				return
 			}
 			rk.Log.Error(err)
 		}
 	}
 }
 
-func (rk *RepoKeeper) onFsObjectCreated(path string, info fs.FileInfo) {
+func (rk *RepoKeeper) onFsEvent(event fsnotify.Event) {
+	rk.Log.Debug(event)
+
+	root := rk.rootOf(event.Name)
+	if root == nil || rk.suspended(event.Name) {
+		return
+	}
+	if filepath.Base(event.Name) == IgnoreFileName {
+		rk.onIgnoreFileChanged(root, filepath.Dir(event.Name))
+		return
+	}
+	if event.Op&fsnotify.Remove == fsnotify.Remove {
+		// объекта уже нет на диске, используются данные кеша
+		rk.onFsObjectDeleted(root, event.Name)
+
+	} else if event.Op&fsnotify.Rename == fsnotify.Rename {
+		rk.onFsObjectRenamed(root, event.Name)
+
+	} else if event.Op&fsnotify.Create == fsnotify.Create {
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			// объект удален или перемещен до обработки события
+			rk.Log.Debug(err)
+			return
+		}
+		if !root.ignore.Excluded(event.Name, info.IsDir()) {
+			rk.onFsObjectCreated(root, event.Name, info)
+		}
+
+	} else if event.Op&(fsnotify.Write|fsnotify.Chmod) != 0 {
+		// запись в файлы каталога, ожидающего распознавания
+		rk.touchPending(event.Name)
+		rk.touchPending(filepath.Dir(event.Name))
+		if dir := filepath.Dir(event.Name); event.Op&fsnotify.Write != 0 && root.entries.IsAlbumEntry(dir) {
+			// список аудиофайлов обновляется после завершения записи
+			rk.settleEntry(root, dir)
+		}
+	}
+	if root.entries.Changes() >= CheckpointChanges {
+		rk.checkpoint(root)
+	}
+}
+
+// onIgnoreFileChanged применяет измененные правила файла IgnoreFileName к дереву
+// каталога `dir`: исключенные каталоги удаляются из кеша и наблюдения, списки
+// аудиофайлов Album Entry обновляются, а ставшие доступными каталоги просматриваются
+// (см. watchTree).
+func (rk *RepoKeeper) onIgnoreFileChanged(root *repoRoot, dir string) {
+	root.ignore.Reload(dir)
+	var paths []string
+	root.entries.ForEach(func(path string, elem *CacheElem) error {
+		if path != dir && isSubdir(dir, path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	var excluded []string
+	for _, path := range paths {
+		if len(excluded) > 0 && isSubdir(excluded[len(excluded)-1], path) {
+			continue
+		}
+		if root.ignore.Excluded(path, true) {
+			excluded = append(excluded, path)
+		}
+	}
+	for _, path := range excluded {
+		rk.unwatchTree(path)
+		rk.dropPending(path)
+		for _, entry := range albumEntriesUnder(root, path) {
+			rk.onEntryDeleted(entry, root.entryID(entry))
+		}
+		root.entries.Delete(path)
+	}
+	for _, entry := range albumEntriesUnder(root, dir) {
+		rk.detectEntry(root, entry)
+	}
+	rk.watchTree(root, dir, true)
+}
+
+// onFsObjectCreated обрабатывает создание файла или каталога. За новым каталогом
+// (в том числе переименованным) и его подкаталогами устанавливается наблюдение.
+func (rk *RepoKeeper) onFsObjectCreated(root *repoRoot, path string, info fs.FileInfo) {
 	if info.IsDir() {
-		inode, err := InodeByInfo(info)
+		id, err := FileIDByInfo(info)
 		srv.FailOnError(err, "inode retrieving")
-		for oldName, oldInode := range rk.inodesForRenaming {
-			if oldInode == inode {
-				if rk.isAlbumEntry(path) {
-					rk.onEntryRenamed(oldName, path)
+		for oldName, renamed := range rk.inodesForRenaming {
+			if renamed.id != id {
+				continue
+			}
+			if renamed.root == root {
+				for _, entry := range albumEntriesUnder(root, oldName) {
+					rk.onEntryRenamed(entry, filepath.Join(path, strings.TrimPrefix(entry, oldName)),
+						root.entryID(entry))
 				}
-				rk.entries.Rename(oldName, path)
-				delete(rk.inodesForRenaming, path)
-				break
+				if err := root.entries.Rename(oldName, path); err != nil {
+					rk.Log.Error(err)
+				}
+			} else {
+				rk.onDirMovedAcrossRoots(renamed.root, oldName, root, path)
 			}
+			delete(rk.inodesForRenaming, oldName)
+			break
 		}
-	} else {
-		if rk.entries.isSupportedAudio(path) {
-			parent := filepath.Dir(path)
-			if _, ok := rk.entries.Cache[parent]; !ok {
-				rk.entries.AddAlbumEntry(parent)
-				rk.onEntryCreated(path)
-			}
+		rk.watchTree(root, path, true)
+	} else if name := filepath.Base(path); rk.settleDelay > 0 ||
+		name == AlbumMarkerFile || name == SkipMarkerFile || root.entries.isSupportedAudio(path) {
+		// формат создаваемого файла определяется после завершения его записи
+		rk.settleEntry(root, filepath.Dir(path))
+	}
+}
+
+// detectEntry применяет правила распознавания Album Entry к каталогу `dir` после
+// изменения его содержимого.
+func (rk *RepoKeeper) detectEntry(root *repoRoot, dir string) {
+	album, err := root.entries.IsAlbumDir(dir)
+	if os.IsNotExist(err) {
+		// каталог удален, изменения вносятся по событию удаления каталога
+		return
+	} else if err != nil {
+		rk.Log.Error(err)
+		return
+	}
+	existed := root.entries.IsAlbumEntry(dir)
+	switch {
+	case album:
+		// обновление списка аудиофайлов Album Entry, хеши новых и измененных файлов
+		// вычисляются в фоне
+		if err := root.entries.UpdateAlbumEntry(dir); err != nil {
+			rk.Log.Error(err)
+			return
 		}
+		rk.hashTracks(root, dir)
+		if !existed {
+			rk.onEntryCreated(dir, root.entryID(dir), root.trackCount(dir))
+		}
+	case existed:
+		// каталог исключен маркером SkipMarkerFile или в нем не осталось треков
+		rk.onEntryDeleted(dir, root.entryID(dir))
+		root.entries.Delete(dir)
 	}
 }
 
-func (rk *RepoKeeper) onFsObjectRenamed(path string, info fs.FileInfo) {
-	if info.IsDir() && rk.isAlbumEntry(path) {
-		inode, err := InodeByInfo(info)
-		srv.FailOnError(err, "inode retrieving")
-		rk.inodesForRenaming[path] = inode
+// onFsObjectRenamed запоминает идентификатор переименованного каталога из кеша для
+// сопоставления с последующим событием создания каталога под новым именем.
+func (rk *RepoKeeper) onFsObjectRenamed(root *repoRoot, path string) {
+	rk.unwatchTree(path)
+	rk.dropPending(path)
+	if elem, err := root.entries.Get(path); err == nil {
+		rk.inodesForRenaming[path] = renamedDir{root, elem.ID()}
+		return
 	}
+	rk.onFileRemoved(root, path)
 }
 
-func (rk *RepoKeeper) onFsObjectDeleted(path string, info fs.FileInfo) {
-	if info.IsDir() {
-		if rk.isAlbumEntry(path) {
-			rk.onEntryDeleted(path)
+// renamedDir описывает переименованный каталог корня `root`, ожидающий события
+// создания под новым именем.
+type renamedDir struct {
+	root *repoRoot
+	id   FileID
+}
+
+// onDirMovedAcrossRoots обновляет кеши корней после перемещения каталога `oldDir`
+// корня `src` в каталог `newDir` корня `dst` средствами ФС: Album Entry удаляются
+// из кеша `src` и добавляются в кеш `dst` с сохранением идентификаторов и состояния.
+func (rk *RepoKeeper) onDirMovedAcrossRoots(src *repoRoot, oldDir string, dst *repoRoot, newDir string) {
+	moved := make(map[string]*CacheElem)
+	for _, entry := range albumEntriesUnder(src, oldDir) {
+		if elem, err := src.entries.Get(entry); err == nil {
+			moved[entry] = elem
+		}
+	}
+	src.entries.Delete(oldDir)
+	for entry, elem := range moved {
+		newPath := filepath.Join(newDir, strings.TrimPrefix(entry, oldDir))
+		if album, err := dst.entries.IsAlbumDir(newPath); err != nil || !album {
+			// аудиофайлы каталога не поддерживаются корнем назначения
+			rk.onEntryDeleted(entry, elem.EntryID)
+			continue
 		}
-		rk.entries.Delete(filepath.Dir(path))
+		if err := dst.entries.UpdateAlbumEntry(newPath); err != nil {
+			rk.Log.Error(err)
+			continue
+		}
+		rk.hashTracks(dst, newPath)
+		dst.entries.SetEntryID(newPath, elem.EntryID, elem.State)
+		rk.onEntryMoved(entry, newPath, elem.EntryID)
+	}
+	rk.checkpoint(src)
+}
+
+// onFsObjectDeleted удаляет из кеша каталог со всеми вложенными Album Entry и
+// промежуточные каталоги, которые больше не ведут к Album Entry.
+func (rk *RepoKeeper) onFsObjectDeleted(root *repoRoot, path string) {
+	rk.unwatchTree(path)
+	rk.dropPending(path)
+	if !root.entries.Contains(path) {
+		rk.onFileRemoved(root, path)
+		return
+	}
+	for _, entry := range albumEntriesUnder(root, path) {
+		rk.onEntryDeleted(entry, root.entryID(entry))
+	}
+	root.entries.Delete(path)
+	delete(rk.inodesForRenaming, path)
+}
+
+// onFileRemoved обновляет Album Entry после удаления или перемещения его файла.
+// После удаления файла-маркера или аудиофайла из другого каталога каталог проверяется
+// заново, например, каталог без SkipMarkerFile может стать Album Entry.
+func (rk *RepoKeeper) onFileRemoved(root *repoRoot, path string) {
+	parent := filepath.Dir(path)
+	if root.entries.IsAlbumEntry(parent) {
+		rk.detectEntry(root, parent)
+		return
+	}
+	name := filepath.Base(path)
+	if parent != root.dir && (name == AlbumMarkerFile || name == SkipMarkerFile ||
+		root.formats.ByExtension(path) != nil) {
+		rk.settleEntry(root, parent)
+	}
+}
+
+// albumEntriesUnder возвращает Album Entry корня, совпадающие с каталогом `dir` или
+// вложенные в него.
+func albumEntriesUnder(root *repoRoot, dir string) []string {
+	var ret []string
+	for _, entry := range root.entries.AlbumEntries() {
+		if isSubdir(dir, entry) {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// onEntryCreated сообщает о новом Album Entry с числом аудиофайлов `tracks`.
+// Для каталога, распознанного только по маркеру, число аудиофайлов не сообщается.
+func (rk *RepoKeeper) onEntryCreated(path, id string, tracks int) {
+	msg := "dir created: " + rk.qualify(path)
+	if tracks > 0 {
+		msg += fmt.Sprintf("; tracks=%d", tracks)
+	}
+	rk.emitEntryEvent(msg, id)
+}
+
+func (rk *RepoKeeper) onEntryRenamed(oldPath, newPath, id string) {
+	rk.emitEntryEvent("dir renamed: "+rk.qualify(oldPath)+" -> "+rk.qualify(newPath), id)
+}
+
+func (rk *RepoKeeper) onEntryDeleted(path, id string) {
+	rk.emitEntryEvent("dir deleted: "+rk.qualify(path), id)
+}
+
+func (rk *RepoKeeper) onEntryMoved(oldPath, newPath, id string) {
+	rk.emitEntryEvent("dir moved: "+rk.qualify(oldPath)+" -> "+rk.qualify(newPath), id)
+}
+
+// onEntryMatched сообщает о перемещении Album Entry, опознанного по содержимому,
+// со степенью совпадения `confidence`.
+func (rk *RepoKeeper) onEntryMatched(oldPath, newPath, id string, confidence float64) {
+	rk.emitEntryEvent(fmt.Sprintf("dir moved: %s -> %s; confidence=%.2f",
+		rk.qualify(oldPath), rk.qualify(newPath), confidence), id)
+}
+
+func (rk *RepoKeeper) onTracksChanged(dir string, tracks []TrackModification, id string) {
+	for _, track := range tracks {
+		rk.emitEntryEvent(
+			"track "+track.Change.String()+": "+rk.qualify(filepath.Join(dir, track.Name)), id)
 	}
 }
 
-func (rk *RepoKeeper) onEntryCreated(path string) {
-	rk.pub.Emit("text/plain", []byte("dir created: "+path))
+// emitEntryEvent передает подписчикам текстовое событие `msg`, дополненное
+// идентификатором Album Entry `id` в виде "; id=<UUID>".
+func (rk *RepoKeeper) emitEntryEvent(msg, id string) {
+	if id != "" {
+		msg += "; id=" + id
+	}
+	rk.emit("text/plain", []byte(msg))
 }
 
-func (rk *RepoKeeper) onEntryRenamed(oldPath, newPath string) {
-	rk.pub.Emit("text/plain", []byte("dir renamed: "+oldPath+" -> "+newPath))
+// entryID возвращает идентификатор Album Entry по абсолютному пути или пустую строку.
+func (rk *RepoKeeper) entryID(path string) string {
+	if root := rk.rootOf(path); root != nil {
+		return root.entryID(path)
+	}
+	return ""
+}
+
+// перенос кеша, сохраненного для прежнего корневого каталога (`path`), на текущий
+// каталог корня `target`.
+// Подписчикам передаются изменения Album Entry относительно перенесенного кеша.
+func (rk *RepoKeeper) relocate(req *AudioRepoRequest) (_ []byte, err error) {
+	if len(req.Path) == 0 {
+		return nil, errors.New("previous repository root is not specified")
+	}
+	root, err := rk.rootByName(req.Target)
+	if err != nil {
+		return
+	}
+	base := filepath.Join(rk.cacheDir, CacheBaseName(req.Path))
+	lock, err := lockCache(base + LockFileExt)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if lockErr := lock.unlock(); err == nil {
+			err = lockErr
+		}
+	}()
+	cache, err := rk.openCache(base, req.Path, root.formats)
+	if err != nil {
+		return
+	}
+	snapshot, err := cache.Snapshot()
+	if err != nil {
+		cache.Close()
+		return
+	}
+	old, err := entriesFromStore(snapshot, req.Path, root.formats)
+	if closeErr := closeSnapshot(snapshot); err == nil {
+		err = closeErr
+	}
+	if closeErr := cache.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if err = old.Relocate(root.dir); err != nil {
+		return
+	}
+	if err = root.entries.InheritEntryIDs(old); err != nil {
+		return
+	}
+	if err = rk.emitChanges(root, old); err != nil {
+		return
+	}
+	// результаты анализа транскодирования переносятся вместе с кешем каталогов
+	transcodes := NewTranscodeCache()
+	switch err = transcodes.LoadFrom(base + TranscodeCacheFileExt); {
+	case err == nil:
+		root.transcodes.Import(transcodes, filepath.Clean(req.Path), root.dir)
+		if err = root.transcodes.SaveTo(root.transcodeFile); err != nil {
+			return
+		}
+	case !os.IsNotExist(err):
+		return
+	}
+	if err = root.save(); err != nil {
+		return
+	}
+	if err = os.Remove(cache.Path()); err != nil {
+		return
+	}
+	if err := os.Remove(base + TranscodeCacheFileExt); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	os.Remove(base + LockFileExt)
+	return json.Marshal(&AudioRepoResponse{AudioRepoRequest: req})
 }
 
-func (rk *RepoKeeper) onEntryDeleted(path string) {
-	rk.pub.Emit("text/plain", []byte("dir deleted: "+path))
+// перемещение Album Entry (`path`) в корень `target` с сохранением пути относительно корня
+func (rk *RepoKeeper) move(req *AudioRepoRequest) (_ []byte, err error) {
+	if len(req.Path) == 0 {
+		return nil, errors.New("album entry path is not specified")
+	}
+	src, path, err := rk.resolvePath(req.Path)
+	if err != nil {
+		return
+	}
+	dst, err := rk.rootByName(req.Target)
+	if err != nil {
+		return
+	}
+	newPath, err := rk.moveEntry(src, path, dst)
+	var leftover *SourceLeftoverError
+	if err != nil && !errors.As(err, &leftover) {
+		return
+	}
+	id := dst.entryID(newPath)
+	rk.onEntryMoved(path, newPath, id)
+	rk.checkpoint(src)
+	rk.checkpoint(dst)
+	resp := &AudioRepoResponse{AudioRepoRequest: req, EntryID: id}
+	if leftover != nil {
+		rk.Log.Warn(leftover)
+		resp.Leftover = src.qualify(leftover.Path)
+	}
+	return json.Marshal(resp)
 }
 
-func (rk *RepoKeeper) isAlbumEntry(path string) bool {
-	return rk.entries.IsAlbumEntry(path)
+// сведения о каталоге репозитория по данным кеша, включая его псевдонимы
+func (rk *RepoKeeper) entryInfo(req *AudioRepoRequest) (_ []byte, err error) {
+	if len(req.Path) == 0 {
+		return nil, errors.New("album entry path is not specified")
+	}
+	root, path, err := rk.resolvePath(req.Path)
+	if err != nil {
+		return
+	}
+	info := root.entries.Info(path)
+	if info == nil {
+		return nil, fmt.Errorf("entry not found: %s", req.Path)
+	}
+	entryID := root.entryID(info.Path)
+	info.Path = rk.qualify(info.Path)
+	for i, alias := range info.Aliases {
+		info.Aliases[i] = rk.qualify(alias)
+	}
+	return json.Marshal(&AudioRepoResponse{AudioRepoRequest: req, Entry: info, EntryID: entryID})
 }
 
 // нормализация имени каталога, исходя из метаданных альбома
 // Из amqp.Delivery извлекаются параметры:
-// - нормализовать один каталог с альбомом или все
-// - путь к каталогу альбома для единичной нормализации
+// - путь к каталогу альбома (обязателен: полнота каждого альбома проверяется
+// по своему релизу, поэтому нормализация всех каталогов одним запросом не выполняется)
 // - JSON для объекта ds_audiomd.Release
 func (rk *RepoKeeper) normalize(req *AudioRepoRequest) (_ []byte, err error) {
+	report, _, err := rk.checkCompleteness(req)
+	if err != nil {
+		return
+	}
+	if !report.Complete {
+		entryID := rk.entryID(report.Path)
+		report.Path = rk.qualify(report.Path)
+		return json.Marshal(&AudioRepoResponse{
+			AudioRepoRequest: req,
+			Completeness:     report,
+			EntryID:          entryID,
+			Error: &srv.ErrorResponse{
+				Error:   "album entry does not match the release track list",
+				Context: req.Cmd}})
+	}
+	// признак Normalized не сохраняется до реализации проверки IsNormalized
 	return
 }
 
+// проверка соответствия файлов каталога альбома списку треков релиза
+// (путь к каталогу альбома обязателен)
+func (rk *RepoKeeper) completeness(req *AudioRepoRequest) (_ []byte, err error) {
+	report, _, err := rk.checkCompleteness(req)
+	if err != nil {
+		return
+	}
+	entryID := rk.entryID(report.Path)
+	report.Path = rk.qualify(report.Path)
+	return json.Marshal(&AudioRepoResponse{
+		AudioRepoRequest: req, Completeness: report, EntryID: entryID})
+}
+
+// checkCompleteness проверяет полноту альбома и сохраняет время проверки и, для полного
+// альбома, идентификатор релиза в состоянии Album Entry.
+func (rk *RepoKeeper) checkCompleteness(
+	req *AudioRepoRequest) (*CompletenessReport, *md.Release, error) {
+	if len(req.Path) == 0 {
+		return nil, nil, errors.New("album entry path is not specified")
+	}
+	root, path, err := rk.resolvePath(req.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := req.Release
+	if release == nil || release.ReleaseStub == nil {
+		if release, err = LoadReleaseSidecar(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	report, err := CheckCompleteness(path, release, root.formats, root.ignore)
+	if err != nil {
+		return nil, nil, err
+	}
+	rk.updateEntryState(path, func(state *EntryState) {
+		state.VerifiedAt = time.Now().UTC().Truncate(time.Second)
+		if id := ReleaseID(release); report.Complete && id != "" {
+			state.ReleaseID = id
+		}
+	})
+	return report, release, nil
+}
+
+// updateEntryState изменяет состояние Album Entry, если каталог `path` является
+// Album Entry.
+func (rk *RepoKeeper) updateEntryState(path string, update func(state *EntryState)) {
+	root := rk.rootOf(path)
+	if root == nil || !root.entries.IsAlbumEntry(path) {
+		return
+	}
+	if err := root.entries.UpdateEntryState(path, update); err != nil {
+		rk.Log.Error(err)
+	}
+}
+
+// отчет о качестве риппинга альбома по логам EAC/XLD в каталоге альбома
+func (rk *RepoKeeper) ripQuality(req *AudioRepoRequest) (_ []byte, err error) {
+	if len(req.Path) == 0 {
+		return nil, errors.New("album entry path is not specified")
+	}
+	root, path, err := rk.resolvePath(req.Path)
+	if err != nil {
+		return
+	}
+	report, err := EntryRipQuality(path, root.ignore)
+	if err != nil {
+		return
+	}
+	report.Path = rk.qualify(report.Path)
+	for _, info := range report.Logs {
+		info.File = rk.qualify(info.File)
+	}
+	return json.Marshal(&AudioRepoResponse{
+		AudioRepoRequest: req, RipQuality: report, EntryID: root.entryID(path)})
+}
+
+// запуск фонового спектрального анализа lossless-треков альбома на признаки
+// lossy-источника; результат публикуется событием хода выполнения задачи
+func (rk *RepoKeeper) transcodeCheck(req *AudioRepoRequest) (_ []byte, err error) {
+	if len(req.Path) == 0 {
+		return nil, errors.New("album entry path is not specified")
+	}
+	root, path, err := rk.resolvePath(req.Path)
+	if err != nil {
+		return
+	}
+	resp := *req
+	resp.Job = rk.jobs.start(func(ctx context.Context, id string) {
+		progress := JobProgress{
+			Job: id, Cmd: req.Cmd, Path: rk.qualify(path), EntryID: rk.entryID(path),
+			Done: 1, Total: 1}
+		report, err := root.transcodes.AnalyzeEntry(ctx, path, root.ignore)
+		if ctx.Err() != nil {
+			rk.emitProgress(&JobProgress{
+				Job: id, Cmd: req.Cmd, Total: 1, Finished: true, Canceled: true})
+			return
+		}
+		if err == nil {
+			err = root.transcodes.SaveTo(root.transcodeFile)
+		}
+		if report != nil {
+			report.Path = rk.qualify(report.Path)
+		}
+		switch {
+		case err != nil:
+			progress.Error = err.Error()
+		case len(report.Files) == 0 && len(report.Unsupported) > 0:
+			// альбом без декодируемых треков не может быть признан чистым
+			progress.Error = ErrPCMUnsupported.Error()
+			progress.Transcode = report
+		default:
+			progress.Transcode = report
+		}
+		rk.emitProgress(&progress)
+		rk.emitProgress(&JobProgress{Job: id, Cmd: req.Cmd, Done: 1, Total: 1, Finished: true})
+	})
+	return json.Marshal(&AudioRepoResponse{AudioRepoRequest: &resp, EntryID: root.entryID(path)})
+}
+
+// запуск фонового измерения громкости альбомов (одного или всех) с публикацией
+// хода выполнения и, при необходимости, записью тегов ReplayGain
+func (rk *RepoKeeper) loudness(req *AudioRepoRequest) (_ []byte, err error) {
+	var paths []string
+	var entryID string
+	if len(req.Path) > 0 {
+		root, path, err := rk.resolvePath(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		// громкость альбома вычисляется по трекам одного Album Entry
+		if !root.entries.IsAlbumEntry(path) {
+			return nil, fmt.Errorf("album entry not found: %s", req.Path)
+		}
+		paths = append(paths, path)
+		entryID = root.entryID(path)
+	} else {
+		for _, root := range rk.roots {
+			paths = append(paths, root.entries.AlbumEntries()...)
+		}
+	}
+	writeTags := req.WriteTags
+	resp := *req
+	resp.Job = rk.jobs.start(func(ctx context.Context, id string) {
+		for i, path := range paths {
+			progress := JobProgress{
+				Job: id, Cmd: req.Cmd, Path: rk.qualify(path), EntryID: rk.entryID(path),
+				Done: i + 1, Total: len(paths)}
+			root := rk.rootOf(path)
+			el, err := MeasureEntryLoudness(ctx, path, root.ignore)
+			if err == nil && writeTags {
+				err = el.WriteReplayGain()
+			}
+			if err == nil && writeTags {
+				// файлы треков заменены с записанными тегами (другой inode)
+				if err := root.entries.UpdateAlbumEntry(path); err != nil {
+					rk.Log.Error(err)
+				}
+				rk.hashTracks(root, path)
+			}
+			if ctx.Err() != nil {
+				rk.emitProgress(&JobProgress{
+					Job: id, Cmd: req.Cmd, Done: i, Total: len(paths), Finished: true, Canceled: true})
+				return
+			}
+			if err != nil {
+				progress.Error = err.Error()
+			} else {
+				el.Path = rk.qualify(el.Path)
+				for _, track := range el.Tracks {
+					track.File = rk.qualify(track.File)
+				}
+				progress.Loudness = el
+			}
+			rk.emitProgress(&progress)
+		}
+		rk.emitProgress(&JobProgress{
+			Job: id, Cmd: req.Cmd, Done: len(paths), Total: len(paths), Finished: true})
+	})
+	return json.Marshal(&AudioRepoResponse{AudioRepoRequest: &resp, EntryID: entryID})
+}
+
+func (rk *RepoKeeper) cancelJob(req *AudioRepoRequest) (_ []byte, err error) {
+	if !rk.jobs.cancel(req.Job) {
+		return nil, fmt.Errorf("job not found: %s", req.Job)
+	}
+	return
+}
+
+func (rk *RepoKeeper) emitProgress(progress *JobProgress) {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		rk.Log.Error(err)
+		return
+	}
+	if err := rk.emit("application/json", data); err != nil {
+		rk.Log.Error(err)
+	}
+}
+
 // IsReadyForNormalization проверка наличия всех необходимых метаданных
 // для проведения нормализации.
 func IsReadyForNormalization(release md.Release) bool {
@@ -0,0 +1,101 @@
+package repokeeper
+
+import (
+	"os"
+	"reflect"
+	"time"
+)
+
+// DefaultSettleDelay - продолжительность периода без изменений содержимого каталога,
+// после которого распознается новый Album Entry (см. WithSettleDelay).
+const DefaultSettleDelay = 5 * time.Second
+
+// minSettleTick - минимальный интервал проверки каталогов, ожидающих распознавания.
+const minSettleTick = 10 * time.Millisecond
+
+// pendingEntry описывает каталог, ожидающий завершения изменений (например, копирования
+// альбома) перед распознаванием Album Entry. `sizes` содержит размеры файлов каталога
+// на момент предыдущей проверки.
+type pendingEntry struct {
+	root     *repoRoot
+	deadline time.Time
+	sizes    map[string]int64
+}
+
+// settleEntry откладывает распознавание Album Entry в каталоге `dir` до окончания
+// изменений его содержимого. Повторный вызов для ожидающего каталога продлевает период
+// ожидания. При нулевой задержке каталог проверяется сразу.
+func (rk *RepoKeeper) settleEntry(root *repoRoot, dir string) {
+	if rk.settleDelay <= 0 {
+		rk.detectEntry(root, dir)
+		return
+	}
+	deadline := time.Now().Add(rk.settleDelay)
+	if p, ok := rk.pending[dir]; ok {
+		p.deadline = deadline
+		return
+	}
+	rk.pending[dir] = &pendingEntry{root: root, deadline: deadline, sizes: dirFileSizes(dir)}
+}
+
+// touchPending продлевает период ожидания каталога `dir`, если он ожидает распознавания.
+func (rk *RepoKeeper) touchPending(dir string) {
+	if p, ok := rk.pending[dir]; ok {
+		p.deadline = time.Now().Add(rk.settleDelay)
+	}
+}
+
+// dropPending отменяет ожидание для каталога `dir` и вложенных в него каталогов.
+func (rk *RepoKeeper) dropPending(dir string) {
+	for path := range rk.pending {
+		if isSubdir(dir, path) {
+			delete(rk.pending, path)
+		}
+	}
+}
+
+// settlePending распознает Album Entry в каталогах, период ожидания которых истек
+// к моменту `now`, а размеры файлов не изменились с предыдущей проверки. Для каталогов
+// с изменившимися размерами файлов период ожидания продлевается.
+func (rk *RepoKeeper) settlePending(now time.Time) {
+	for dir, p := range rk.pending {
+		if now.Before(p.deadline) {
+			continue
+		}
+		sizes := dirFileSizes(dir)
+		if sizes != nil && !reflect.DeepEqual(sizes, p.sizes) {
+			// запись файлов без событий ФС (например, на сетевой ФС)
+			p.sizes, p.deadline = sizes, now.Add(rk.settleDelay)
+			continue
+		}
+		delete(rk.pending, dir)
+		rk.detectEntry(p.root, dir)
+	}
+}
+
+// settleTick возвращает интервал проверки каталогов, ожидающих распознавания.
+func (rk *RepoKeeper) settleTick() time.Duration {
+	if tick := rk.settleDelay / 4; tick > minSettleTick {
+		return tick
+	}
+	return minSettleTick
+}
+
+// dirFileSizes возвращает размеры файлов каталога по именам или nil, если каталог
+// не может быть прочитан.
+func dirFileSizes(dir string) map[string]int64 {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	ret := make(map[string]int64, len(files))
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if info, err := f.Info(); err == nil {
+			ret[f.Name()] = info.Size()
+		}
+	}
+	return ret
+}
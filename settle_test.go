@@ -0,0 +1,87 @@
+package repokeeper
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepoKeeperSettleEntry(t *testing.T) {
+	root := t.TempDir()
+	rk := newTestKeeper(t, root)
+	rk.settleDelay = time.Minute
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		events = append(events, string(data))
+		return nil
+	}
+	rk.applyChangesBetweenSessions()
+
+	album := filepath.Join(root, "album")
+	writeTestTracks(t, album, "01.flac")
+	rk.onFsEvent(fsnotify.Event{Name: filepath.Join(album, "01.flac"), Op: fsnotify.Create})
+	writeTestTracks(t, album, "02.flac")
+	rk.onFsEvent(fsnotify.Event{Name: filepath.Join(album, "02.flac"), Op: fsnotify.Create})
+	deadline := rk.pending[album].deadline
+	time.Sleep(time.Millisecond)
+	rk.onFsEvent(fsnotify.Event{Name: filepath.Join(album, "02.flac"), Op: fsnotify.Write})
+	assert.True(t, rk.pending[album].deadline.After(deadline))
+	rk.settlePending(time.Now())
+	assert.Empty(t, events)
+
+	// размеры файлов изменились с начала ожидания
+	now := time.Now().Add(2 * rk.settleDelay)
+	rk.settlePending(now)
+	assert.Empty(t, events)
+	rk.settlePending(now.Add(rk.settleDelay))
+	assert.Equal(t, []string{"dir created: default:album; tracks=2; id=" + rk.entryID(album)}, events)
+	assert.Empty(t, rk.pending)
+
+	// удаленный каталог не распознается
+	events = nil
+	other := filepath.Join(root, "other")
+	writeTestTracks(t, other, "01.flac")
+	rk.onFsEvent(fsnotify.Event{Name: filepath.Join(other, "01.flac"), Op: fsnotify.Create})
+	require.NoError(t, os.RemoveAll(other))
+	rk.onFsEvent(fsnotify.Event{Name: other, Op: fsnotify.Remove})
+	assert.Empty(t, rk.pending)
+}
+
+func TestRepoKeeperSettleCopy(t *testing.T) {
+	root := t.TempDir()
+	rk := newTestKeeper(t, root)
+	rk.settleDelay = 200 * time.Millisecond
+	var mu sync.Mutex
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, string(data))
+		return nil
+	}
+	rk.applyChangesBetweenSessions()
+	rk.addWatchPoints()
+	go rk.fsEvents()
+
+	// файлы создаются пустыми и записываются после создания
+	album := filepath.Join(root, "artist", "album")
+	for _, name := range []string{"01.flac", "02.flac", "03.flac"} {
+		writeTestTracks(t, album, name)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(2 * rk.settleDelay)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"dir created: default:artist/album; tracks=3; id=" + rk.entryID(album)}, events)
+}
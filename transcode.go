@@ -0,0 +1,322 @@
+package repokeeper
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Параметры спектрального анализа для выявления lossy-источника.
+const (
+	spectrumSize      = 4096
+	spectrumMaxWindow = 1500  // ограничение числа окон анализа на файл (~140 с для 44.1 кГц)
+	silenceLevel      = 1e-4  // окна с меньшим RMS в анализе не участвуют
+	cutoffMinFreq     = 10000 // нижняя граница поиска частоты среза, Гц
+	cutoffBandWidth   = 750   // ширина полос сравнения по обе стороны от среза, Гц
+	cutoffGuardWidth  = 250   // зазор между полосами сравнения и точкой среза, Гц
+	cutoffMinDrop     = 25.0  // минимальный перепад уровня на срезе, дБ
+	lossyCutoffLimit  = 20500 // срез ниже этой частоты характерен для MP3/AAC, Гц
+)
+
+// TranscodeInfo описывает результат спектрального анализа аудиофайла.
+// `Cutoff` содержит обнаруженную частоту среза спектра в Гц или 0, если резкий срез
+// не найден. Поля `Size` и `ModTime` используются для проверки актуальности кеша.
+type TranscodeInfo struct {
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"mod_time"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Cutoff     int    `json:"cutoff,omitempty"`
+	Suspicious bool   `json:"suspicious"`
+	Error      string `json:"error,omitempty"`
+}
+
+// TranscodeReport описывает результат анализа каталога альбома.
+// Альбом считается подозрительным, если таковыми признаны более половины треков.
+// `Cutoff` содержит медианную частоту среза подозрительных треков.
+// `Unsupported` содержит lossless-файлы, декодирование которых не поддерживается
+// (WavPack): они не анализируются и не учитываются в оценке альбома.
+type TranscodeReport struct {
+	Path        string                    `json:"path"`
+	Files       map[string]*TranscodeInfo `json:"files,omitempty"`
+	Unsupported []string                  `json:"unsupported,omitempty"`
+	Cutoff      int                       `json:"cutoff,omitempty"`
+	Suspicious  bool                      `json:"suspicious"`
+}
+
+// TranscodeCache хранит результаты анализа файлов по абсолютному пути.
+type TranscodeCache struct {
+	mu    sync.Mutex
+	Files map[string]*TranscodeInfo `json:"files"`
+}
+
+// NewTranscodeCache создает пустой кеш результатов анализа.
+func NewTranscodeCache() *TranscodeCache {
+	return &TranscodeCache{Files: make(map[string]*TranscodeInfo)}
+}
+
+// LoadFrom заполняет кеш из JSON.
+func (tc *TranscodeCache) LoadFrom(fn string) error {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return json.Unmarshal(data, &tc.Files)
+}
+
+// SaveTo сохраняет кеш в указанном файле.
+func (tc *TranscodeCache) SaveTo(fn string) error {
+	tc.mu.Lock()
+	data, err := json.Marshal(tc.Files)
+	tc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, data, 0644)
+}
+
+// Import добавляет результаты анализа файлов из дерева каталога `oldDir` кеша `other`
+// под путем `newDir`. Имеющиеся в кеше результаты не замещаются.
+func (tc *TranscodeCache) Import(other *TranscodeCache, oldDir, newDir string) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for path, info := range other.Files {
+		if !isSubdir(oldDir, path) {
+			continue
+		}
+		path = newDir + path[len(oldDir):]
+		if _, ok := tc.Files[path]; !ok {
+			tc.Files[path] = info
+		}
+	}
+}
+
+// Analyze возвращает результат анализа файла.
+// Повторный анализ выполняется только при изменении размера или времени модификации.
+// При отмене `ctx` анализ прерывается с ошибкой контекста, результат не сохраняется.
+func (tc *TranscodeCache) Analyze(ctx context.Context, path string) (*TranscodeInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	tc.mu.Lock()
+	cached, ok := tc.Files[path]
+	tc.mu.Unlock()
+	if ok && cached.Size == fi.Size() && cached.ModTime == fi.ModTime().UnixNano() {
+		return cached, nil
+	}
+	info := &TranscodeInfo{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	if err := info.analyze(ctx, path); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		info.Error = err.Error()
+	}
+	tc.mu.Lock()
+	tc.Files[path] = info
+	tc.mu.Unlock()
+	return info, nil
+}
+
+// AnalyzeEntry выполняет анализ всех lossless-файлов каталога альбома, кроме
+// исключенных правилами `ignore`. Файлы, декодирование которых не поддерживается,
+// перечисляются в TranscodeReport.Unsupported.
+func (tc *TranscodeCache) AnalyzeEntry(
+	ctx context.Context, dir string, ignore *IgnoreRules) (*TranscodeReport, error) {
+	report := &TranscodeReport{Path: dir, Files: make(map[string]*TranscodeInfo)}
+	err := ignore.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !isLossless(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if !isPCMDecodable(path) {
+			report.Unsupported = append(report.Unsupported, rel)
+			return nil
+		}
+		info, err := tc.Analyze(ctx, path)
+		if err != nil {
+			return err
+		}
+		report.Files[rel] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.summarize()
+	return report, nil
+}
+
+func (report *TranscodeReport) summarize() {
+	var cutoffs []int
+	var analyzed int
+	for _, info := range report.Files {
+		if info.Error != "" {
+			continue
+		}
+		analyzed++
+		if info.Suspicious {
+			cutoffs = append(cutoffs, info.Cutoff)
+		}
+	}
+	if analyzed == 0 || len(cutoffs)*2 <= analyzed {
+		return
+	}
+	sort.Ints(cutoffs)
+	report.Suspicious = true
+	report.Cutoff = cutoffs[len(cutoffs)/2]
+}
+
+func (info *TranscodeInfo) analyze(ctx context.Context, path string) error {
+	dec, err := openPCM(path)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	info.SampleRate = dec.SampleRate()
+	spectrum, err := averageSpectrum(ctx, dec)
+	if err != nil {
+		return err
+	}
+	info.Cutoff = findCutoff(spectrum, info.SampleRate)
+	info.Suspicious = info.Cutoff > 0 && info.Cutoff < lossyCutoffLimit
+	return nil
+}
+
+// averageSpectrum вычисляет усредненный по окнам Ханна спектр мощности в дБ.
+func averageSpectrum(ctx context.Context, dec pcmDecoder) ([]float64, error) {
+	window := make([]float64, spectrumSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(spectrumSize-1))
+	}
+	power := make([]float64, spectrumSize/2)
+	buf := make([]complex128, spectrumSize)
+	pending := make([]float64, 0, 2*spectrumSize)
+	var count int
+	for count < spectrumMaxWindow {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		channels, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, downmix(channels)...)
+		for len(pending) >= spectrumSize && count < spectrumMaxWindow {
+			frame := pending[:spectrumSize]
+			if rms(frame) >= silenceLevel {
+				for i, v := range frame {
+					buf[i] = complex(v*window[i], 0)
+				}
+				fft(buf)
+				for i := range power {
+					a := cmplx.Abs(buf[i])
+					power[i] += a * a
+				}
+				count++
+			}
+			pending = pending[spectrumSize:]
+		}
+		pending = append(pending[:0:0], pending...)
+	}
+	if count == 0 {
+		count = 1
+	}
+	for i := range power {
+		power[i] = 10 * math.Log10(power[i]/float64(count)+1e-20)
+	}
+	return power, nil
+}
+
+// findCutoff ищет частоту, на которой уровень спектра падает скачком не менее чем на
+// `cutoffMinDrop` и выше которой не поднимается. Возвращает 0, если срез не найден.
+func findCutoff(spectrum []float64, sampleRate int) int {
+	binWidth := float64(sampleRate) / spectrumSize
+	band := int(cutoffBandWidth / binWidth)
+	guard := int(cutoffGuardWidth / binWidth)
+	if band < 1 {
+		band = 1
+	}
+	first := int(cutoffMinFreq / binWidth)
+	last := len(spectrum) - guard - band
+	var bestBin int
+	var bestDrop float64
+	for k := first; k < last; k++ {
+		below := mean(spectrum[k-guard-band : k-guard])
+		above := mean(spectrum[k+guard : k+guard+band])
+		if drop := below - above; drop > bestDrop {
+			bestBin, bestDrop = k, drop
+		}
+	}
+	if bestDrop < cutoffMinDrop {
+		return 0
+	}
+	below := mean(spectrum[bestBin-guard-band : bestBin-guard])
+	for _, v := range spectrum[bestBin+guard:] {
+		if v > below-cutoffMinDrop/2 {
+			return 0
+		}
+	}
+	return int(float64(bestBin) * binWidth)
+}
+
+// fft выполняет быстрое преобразование Фурье на месте (длина - степень двойки).
+func fft(a []complex128) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := a[start+k], a[start+k+size/2]*w
+				a[start+k], a[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+}
+
+func rms(samples []float64) float64 {
+	var sum float64
+	for _, v := range samples {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,116 @@
+package repokeeper
+
+import (
+	"context"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscodeAnalyze(t *testing.T) {
+	dir := t.TempDir()
+	lossy := filepath.Join(dir, "lossy.flac")
+	lossless := filepath.Join(dir, "lossless.flac")
+	require.NoError(t, writeTestFlac(lossy, bandLimitedNoise(16000)))
+	require.NoError(t, writeTestFlac(lossless, bandLimitedNoise(22050)))
+
+	tc := NewTranscodeCache()
+	info, err := tc.Analyze(context.Background(), lossy)
+	require.NoError(t, err)
+	require.Empty(t, info.Error)
+	assert.True(t, info.Suspicious)
+	assert.InDelta(t, 16000, info.Cutoff, 300)
+
+	cached, err := tc.Analyze(context.Background(), lossy)
+	require.NoError(t, err)
+	assert.Same(t, info, cached)
+
+	info, err = tc.Analyze(context.Background(), lossless)
+	require.NoError(t, err)
+	assert.False(t, info.Suspicious)
+
+	report, err := tc.AnalyzeEntry(context.Background(), dir, nil)
+	require.NoError(t, err)
+	assert.Len(t, report.Files, 2)
+	assert.False(t, report.Suspicious)
+
+	// WavPack не декодируется и не учитывается в оценке
+	require.NoError(t, copyFile("testdata/repo/wv/wv/wv/test.wv", filepath.Join(dir, "03.wv"), 0644))
+	report, err = tc.AnalyzeEntry(context.Background(), dir, nil)
+	require.NoError(t, err)
+	assert.Len(t, report.Files, 2)
+	assert.Equal(t, []string{"03.wv"}, report.Unsupported)
+}
+
+const testSampleRate = 44100
+
+// bandLimitedNoise формирует шум с равномерным спектром до частоты `cutoff`.
+func bandLimitedNoise(cutoff int) []int32 {
+	const n = 1 << 18
+	rnd := rand.New(rand.NewSource(1))
+	spec := make([]complex128, n)
+	maxBin := cutoff * n / testSampleRate
+	for k := 1; k < maxBin && k < n/2; k++ {
+		spec[k] = cmplx.Rect(1, 2*math.Pi*rnd.Float64())
+		spec[n-k] = cmplx.Conj(spec[k])
+	}
+	// обратное преобразование через прямое для сопряженного спектра
+	for i := range spec {
+		spec[i] = cmplx.Conj(spec[i])
+	}
+	fft(spec)
+	var peak float64
+	for _, v := range spec {
+		peak = math.Max(peak, math.Abs(real(v)))
+	}
+	ret := make([]int32, n)
+	for i, v := range spec {
+		ret[i] = int32(real(v) / peak * 16000)
+	}
+	return ret
+}
+
+func writeTestFlac(fn string, samples []int32) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	info := &meta.StreamInfo{
+		BlockSizeMin:  4096,
+		BlockSizeMax:  4096,
+		SampleRate:    testSampleRate,
+		NChannels:     1,
+		BitsPerSample: 16}
+	enc, err := flac.NewEncoder(f, info)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for i := 0; i < len(samples); i += 4096 {
+		fr := &frame.Frame{
+			Header: frame.Header{
+				HasFixedBlockSize: true,
+				BlockSize:         4096,
+				SampleRate:        testSampleRate,
+				Channels:          frame.ChannelsMono,
+				BitsPerSample:     16},
+			Subframes: []*frame.Subframe{{
+				SubHeader: frame.SubHeader{Pred: frame.PredVerbatim},
+				Samples:   samples[i : i+4096],
+				NSamples:  4096}}}
+		if err := enc.WriteFrame(fr); err != nil {
+			enc.Close()
+			return err
+		}
+	}
+	return enc.Close()
+}
@@ -0,0 +1,180 @@
+package repokeeper
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// suspendGrace - период после изменения каталогов командой сервиса, в течение
+// которого поступающие с задержкой события ФС для них не обрабатываются.
+const suspendGrace = 2 * time.Second
+
+// watchSet хранит каталоги корней репозитория, за которыми ведется наблюдение.
+// fsnotify не отслеживает переименование наблюдаемых каталогов, поэтому наблюдение
+// за переименованным или удаленным деревом каталогов снимается явно.
+// События ФС для каталогов `suspended`, изменяемых командами сервиса, не обрабатываются
+// до указанного момента (нулевое время - до возобновления обработки).
+type watchSet struct {
+	mu        sync.Mutex
+	dirs      map[string]bool
+	suspended map[string]time.Time
+}
+
+func newWatchSet() *watchSet {
+	return &watchSet{dirs: make(map[string]bool), suspended: make(map[string]time.Time)}
+}
+
+// watchDir добавляет наблюдение за каталогом `dir`. Возвращает false, если наблюдение
+// уже ведется или не может быть добавлено.
+func (rk *RepoKeeper) watchDir(dir string) bool {
+	rk.watches.mu.Lock()
+	defer rk.watches.mu.Unlock()
+	if rk.watches.dirs[dir] {
+		return false
+	}
+	if err := rk.w.Add(dir); err != nil {
+		// в том числе при исчерпании лимита inotify (fs.inotify.max_user_watches)
+		rk.Log.Error(err)
+		return false
+	}
+	rk.watches.dirs[dir] = true
+	return true
+}
+
+// watchTree добавляет наблюдение за каталогом `dir` корня и всеми его подкаталогами,
+// кроме исключенных правилами IgnoreRules и DetectionRules.SkipDirs.
+// Каталоги просматриваются после добавления наблюдения за ними, поэтому при
+// `detect` Album Entry, сформированные до начала наблюдения (например, при
+// копировании дерева каталогов), распознаются без событий ФС (см. settleEntry),
+// кроме каталогов, изменяемых командами сервиса.
+// При FollowSymlinks, как и при сканировании, наблюдение ведется и за каталогами по
+// ссылкам на каталоги вне корня, которые не были просмотрены ранее.
+func (rk *RepoKeeper) watchTree(root *repoRoot, dir string, detect bool) {
+	visited := make(map[FileID]bool)
+	var links []string
+	// visit добавляет наблюдение за каталогом `path`; возвращает false для
+	// исключенных каталогов
+	visit := func(path string) bool {
+		if path != root.dir && (root.ignore.Excluded(path, true) ||
+			root.entries.Detection.skipDir(path)) {
+			return false
+		}
+		if id, err := FileIdentity(path); err == nil {
+			visited[id] = true
+		}
+		if rk.watchDir(path) && detect && path != root.dir && !rk.suspended(path) {
+			rk.settleEntry(root, path)
+		}
+		return true
+	}
+	walk := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// каталог удален до просмотра
+			return filepath.SkipDir
+		}
+		if d.Type()&fs.ModeSymlink != 0 && root.entries.Symlinks == FollowSymlinks {
+			links = append(links, path)
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if !visit(path) {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	filepath.WalkDir(dir, walk)
+	for len(links) > 0 {
+		pending := links
+		links = nil
+		sort.Strings(pending)
+		for _, link := range pending {
+			if !rk.followLink(root, link, visited) || !visit(link) {
+				continue
+			}
+			files, err := os.ReadDir(link)
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				filepath.WalkDir(filepath.Join(link, f.Name()), walk)
+			}
+		}
+	}
+}
+
+// followLink проверяет, что ссылка `link` указывает на не просмотренный ранее
+// каталог вне корня `root`.
+func (rk *RepoKeeper) followLink(root *repoRoot, link string, visited map[FileID]bool) bool {
+	info, err := os.Stat(link)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	if id, err := FileIDByInfo(info); err != nil || visited[id] {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return false
+	}
+	if rootDir, err := filepath.EvalSymlinks(root.dir); err == nil && isSubdir(rootDir, target) {
+		// каталог корня хранится в кеше как псевдоним
+		return false
+	}
+	return true
+}
+
+// unwatchTree снимает наблюдение за каталогом `dir` и всеми его подкаталогами.
+func (rk *RepoKeeper) unwatchTree(dir string) {
+	rk.watches.mu.Lock()
+	defer rk.watches.mu.Unlock()
+	for path := range rk.watches.dirs {
+		if isSubdir(dir, path) {
+			// наблюдение за удаленным каталогом снимается ФС
+			rk.w.Remove(path)
+			delete(rk.watches.dirs, path)
+		}
+	}
+}
+
+// suspendWatch приостанавливает обработку событий ФС для дерева каталогов `dirs`
+// на время их изменения командой сервиса.
+func (rk *RepoKeeper) suspendWatch(dirs ...string) {
+	rk.watches.mu.Lock()
+	defer rk.watches.mu.Unlock()
+	for _, dir := range dirs {
+		rk.watches.suspended[dir] = time.Time{}
+	}
+}
+
+// resumeWatch возобновляет обработку событий ФС для дерева каталогов `dirs` по
+// истечении периода suspendGrace, в течение которого поступают события изменения.
+func (rk *RepoKeeper) resumeWatch(dirs ...string) {
+	rk.watches.mu.Lock()
+	defer rk.watches.mu.Unlock()
+	until := time.Now().Add(suspendGrace)
+	for _, dir := range dirs {
+		rk.watches.suspended[dir] = until
+	}
+}
+
+// suspended проверяет, приостановлена ли обработка событий ФС для пути `path`.
+func (rk *RepoKeeper) suspended(path string) bool {
+	rk.watches.mu.Lock()
+	defer rk.watches.mu.Unlock()
+	now := time.Now()
+	ret := false
+	for dir, until := range rk.watches.suspended {
+		if !until.IsZero() && !now.Before(until) {
+			delete(rk.watches.suspended, dir)
+		} else if isSubdir(dir, path) {
+			ret = true
+		}
+	}
+	return ret
+}
@@ -0,0 +1,152 @@
+package repokeeper
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func watchedDirs(rk *RepoKeeper) []string {
+	rk.watches.mu.Lock()
+	defer rk.watches.mu.Unlock()
+	var ret []string
+	for dir := range rk.watches.dirs {
+		ret = append(ret, dir)
+	}
+	return ret
+}
+
+func TestRepoKeeperWatchTree(t *testing.T) {
+	root := t.TempDir()
+	writeTestTracks(t, filepath.Join(root, "old", "album"), "01.flac")
+	writeTestTracks(t, filepath.Join(root, "old", "album", "Samples"), "01.flac")
+	rk := newTestRootsKeeper(t, RootConfig{
+		Name: DefaultRootName, Dir: root, Extensions: []string{".flac"},
+		Detection: &DetectionRules{SkipDirs: ExtrasSkipDirs}})
+	rk.settleDelay = 0
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		events = append(events, string(data))
+		return nil
+	}
+	rk.applyChangesBetweenSessions()
+	rk.addWatchPoints()
+	assert.ElementsMatch(t, []string{
+		root, filepath.Join(root, "old"), filepath.Join(root, "old", "album")}, watchedDirs(rk))
+
+	// дерево каталогов создано до начала наблюдения за новым каталогом
+	artist := filepath.Join(root, "artist")
+	album := filepath.Join(artist, "cd", "album")
+	writeTestTracks(t, album, "01.flac", "02.flac")
+	rk.onFsEvent(fsnotify.Event{Name: artist, Op: fsnotify.Create})
+	assert.Equal(t, []string{"dir created: default:artist/cd/album; tracks=2; id=" + rk.entryID(album)}, events)
+	assert.Contains(t, watchedDirs(rk), album)
+	rk.onFsEvent(fsnotify.Event{Name: filepath.Join(artist, "cd"), Op: fsnotify.Create})
+	assert.Len(t, events, 1)
+
+	// переименование и удаление дерева каталогов
+	events = nil
+	renamed := filepath.Join(root, "artist2")
+	require.NoError(t, os.Rename(artist, renamed))
+	rk.onFsEvent(fsnotify.Event{Name: artist, Op: fsnotify.Rename})
+	rk.onFsEvent(fsnotify.Event{Name: renamed, Op: fsnotify.Create})
+	assert.Len(t, events, 1)
+	assert.NotContains(t, watchedDirs(rk), album)
+	assert.Contains(t, watchedDirs(rk), filepath.Join(renamed, "cd", "album"))
+
+	require.NoError(t, os.RemoveAll(renamed))
+	rk.onFsEvent(fsnotify.Event{Name: renamed, Op: fsnotify.Remove})
+	assert.ElementsMatch(t, []string{
+		root, filepath.Join(root, "old"), filepath.Join(root, "old", "album")}, watchedDirs(rk))
+}
+
+func TestRepoKeeperWatchSymlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	writeTestTracks(t, filepath.Join(root, "artist", "album"), "01.flac")
+	writeTestTracks(t, filepath.Join(outside, "ext_album"), "01.flac")
+	external := filepath.Join(root, "external")
+	require.NoError(t, os.Symlink(outside, external))
+	require.NoError(t, os.Symlink(root, filepath.Join(root, "loop")))
+	rk := newTestKeeper(t, root)
+	rk.roots[0].entries.Symlinks = FollowSymlinks
+	rk.settleDelay = 0
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		events = append(events, string(data))
+		return nil
+	}
+	rk.applyChangesBetweenSessions()
+	rk.addWatchPoints()
+	assert.ElementsMatch(t, []string{
+		root, filepath.Join(root, "artist"), filepath.Join(root, "artist", "album"),
+		external, filepath.Join(external, "ext_album")}, watchedDirs(rk))
+
+	// каталог создан в каталоге по ссылке
+	album := filepath.Join(external, "ext_album2")
+	writeTestTracks(t, filepath.Join(outside, "ext_album2"), "01.flac")
+	rk.onFsEvent(fsnotify.Event{Name: album, Op: fsnotify.Create})
+	assert.Equal(t, []string{"dir created: default:external/ext_album2; tracks=1; id=" + rk.entryID(album)}, events)
+	assert.Contains(t, watchedDirs(rk), album)
+}
+
+func TestRepoKeeperWatchNewDirs(t *testing.T) {
+	root := t.TempDir()
+	rk := newTestKeeper(t, root)
+	rk.settleDelay = 0
+	var mu sync.Mutex
+	var events []string
+	rk.emit = func(contentType string, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, string(data))
+		return nil
+	}
+	rk.applyChangesBetweenSessions()
+	rk.addWatchPoints()
+	go rk.fsEvents()
+
+	// дерево каталогов перемещено в корень целиком
+	staging := t.TempDir()
+	writeTestTracks(t, filepath.Join(staging, "artist", "year", "album"), "01.flac")
+	require.NoError(t, os.Rename(filepath.Join(staging, "artist"), filepath.Join(root, "artist")))
+	album := filepath.Join(root, "artist", "year", "album")
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, rk.roots[0].entries.IsAlbumEntry(album))
+
+	// файл перемещен в новый каталог внутри нового дерева каталогов
+	album2 := filepath.Join(root, "artist", "year", "album2")
+	require.NoError(t, os.Mkdir(album2, 0755))
+	writeTestTracks(t, staging, "02.flac")
+	require.NoError(t, os.Rename(filepath.Join(staging, "02.flac"), filepath.Join(album2, "02.flac")))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, rk.roots[0].entries.IsAlbumEntry(album2))
+}
+
+func TestRepoKeeperSuspendWatch(t *testing.T) {
+	rk := newTestKeeper(t, t.TempDir())
+	rk.suspendWatch("/a/b")
+	assert.True(t, rk.suspended("/a/b/c"))
+	assert.False(t, rk.suspended("/a/bc"))
+	// события, поступающие после завершения команды, не обрабатываются
+	rk.resumeWatch("/a/b")
+	assert.True(t, rk.suspended("/a/b/c"))
+	rk.watches.mu.Lock()
+	rk.watches.suspended["/a/b"] = time.Now()
+	rk.watches.mu.Unlock()
+	assert.False(t, rk.suspended("/a/b/c"))
+	assert.Empty(t, rk.watches.suspended)
+}
@@ -0,0 +1,136 @@
+package repokeeper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Чтение заголовков блоков WavPack 4 (версии блоков 0x402..0x410).
+// Аудиоданные WavPack не декодируются.
+
+const wvHeaderSize = 32
+
+// Флаги заголовка блока WavPack.
+const (
+	wvBytesStored = 3
+	wvMonoFlag    = 4
+	wvSrateLSB    = 23
+	wvSrateMask   = 0xf << wvSrateLSB
+	wvDSDFlag     = 0x80000000
+)
+
+// Идентификаторы метаданных блока WavPack.
+const (
+	wvIDUnique         = 0x3f
+	wvIDOddSize        = 0x40
+	wvIDLarge          = 0x80
+	wvIDSampleRate     = 0x27
+	wvMinStreamVersion = 0x402
+	wvMaxStreamVersion = 0x410
+)
+
+var wvSampleRates = []int{
+	6000, 8000, 9600, 11025, 12000, 16000, 22050, 24000,
+	32000, 44100, 48000, 64000, 88200, 96000, 192000}
+
+type wvHeader struct {
+	CkID         [4]byte
+	CkSize       uint32
+	Version      uint16
+	TrackNo      uint8
+	IndexNo      uint8
+	TotalSamples uint32
+	BlockIndex   uint32
+	BlockSamples uint32
+	Flags        uint32
+	CRC          uint32
+}
+
+// readWavPackHeader возвращает заголовок и частоту дискретизации первого блока
+// файла с аудиоданными. Данные вне блоков (например, теги APEv2) пропускаются.
+func readWavPackHeader(path string) (*wvHeader, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		if err := wvSyncBlock(r); err != nil {
+			return nil, 0, err
+		}
+		var hdr wvHeader
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return nil, 0, err
+		}
+		if hdr.Version < wvMinStreamVersion || hdr.Version > wvMaxStreamVersion {
+			return nil, 0, fmt.Errorf("wavpack: unsupported stream version 0x%x", hdr.Version)
+		}
+		if hdr.CkSize < wvHeaderSize-8 {
+			return nil, 0, errors.New("wavpack: invalid block size")
+		}
+		data := make([]byte, hdr.CkSize-(wvHeaderSize-8))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, 0, err
+		}
+		if hdr.BlockSamples == 0 {
+			continue
+		}
+		if hdr.Flags&wvDSDFlag != 0 {
+			return nil, 0, errors.New("wavpack: DSD streams are not supported")
+		}
+		sampleRate, err := wvSampleRate(&hdr, data)
+		return &hdr, sampleRate, err
+	}
+}
+
+func wvSyncBlock(r *bufio.Reader) error {
+	for {
+		buf, err := r.Peek(4)
+		if err != nil {
+			return err
+		}
+		if string(buf) == "wvpk" {
+			return nil
+		}
+		if _, err := r.Discard(1); err != nil {
+			return err
+		}
+	}
+}
+
+// wvSampleRate возвращает частоту дискретизации блока по флагам заголовка или,
+// для нестандартной частоты, по метаданным блока `data`.
+func wvSampleRate(hdr *wvHeader, data []byte) (int, error) {
+	if idx := (hdr.Flags & wvSrateMask) >> wvSrateLSB; int(idx) < len(wvSampleRates) {
+		return wvSampleRates[idx], nil
+	}
+	for len(data) >= 2 {
+		id := data[0]
+		size := int(data[1]) << 1
+		data = data[2:]
+		if id&wvIDLarge != 0 {
+			if len(data) < 2 {
+				return 0, errors.New("wavpack: truncated metadata")
+			}
+			size += int(data[0])<<9 + int(data[1])<<17
+			data = data[2:]
+		}
+		if size > len(data) {
+			return 0, errors.New("wavpack: truncated metadata")
+		}
+		body := data[:size]
+		data = data[size:]
+		if id&wvIDOddSize != 0 && size > 0 {
+			body = body[:size-1]
+		}
+		if id&wvIDUnique == wvIDSampleRate && len(body) >= 3 {
+			return int(body[0]) | int(body[1])<<8 | int(body[2])<<16, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,69 @@
+package repokeeper
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Имена расширенных атрибутов каталога Album Entry с его идентификатором
+// и состоянием (см. EntryState). Признак нормализации не устанавливается сервисом
+// и в атрибутах не хранится.
+const (
+	EntryIDXattr       = "user.repokeeper.id"
+	EntryVerifiedXattr = "user.repokeeper.verified_at"
+	EntryReleaseXattr  = "user.repokeeper.release_id"
+)
+
+// ErrXattrUnsupported возвращается для ФС и платформ без поддержки расширенных атрибутов.
+var ErrXattrUnsupported = errors.New("extended attributes are not supported")
+
+// readEntryXattrs возвращает идентификатор и состояние Album Entry из расширенных
+// атрибутов каталога. Отсутствующие и некорректные значения пропускаются; при
+// отсутствии атрибутов состояния возвращается nil.
+func readEntryXattrs(dir string) (id string, state *EntryState) {
+	data, err := getXattr(dir, EntryIDXattr)
+	if errors.Is(err, ErrXattrUnsupported) {
+		return "", nil
+	}
+	if err == nil {
+		if u, err := uuid.FromString(string(data)); err == nil {
+			id = u.String()
+		}
+	}
+	var st EntryState
+	found := false
+	if data, err := getXattr(dir, EntryVerifiedXattr); err == nil {
+		st.VerifiedAt, _ = time.Parse(time.RFC3339, string(data))
+		found = true
+	}
+	if data, err := getXattr(dir, EntryReleaseXattr); err == nil {
+		st.ReleaseID = string(data)
+		found = true
+	}
+	if found {
+		state = &st
+	}
+	return id, state
+}
+
+// writeEntryXattrs сохраняет непустые идентификатор и состояние Album Entry
+// в расширенных атрибутах каталога. Ошибки записи (ФС без поддержки атрибутов, ФС
+// только для чтения) не препятствуют работе с кешем и пропускаются.
+func writeEntryXattrs(dir, id string, state *EntryState) {
+	if id != "" {
+		if err := setXattr(dir, EntryIDXattr, []byte(id)); err != nil {
+			return
+		}
+	}
+	if state == nil {
+		return
+	}
+	if !state.VerifiedAt.IsZero() {
+		setXattr(dir, EntryVerifiedXattr, []byte(state.VerifiedAt.UTC().Format(time.RFC3339)))
+	}
+	if state.ReleaseID != "" {
+		setXattr(dir, EntryReleaseXattr, []byte(state.ReleaseID))
+	}
+}
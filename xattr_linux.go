@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package repokeeper
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// getXattr возвращает значение расширенного атрибута `name` файла `path`.
+// Для отсутствующего атрибута возвращается ошибка os.ErrNotExist.
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, xattrError(path, name, err)
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			// значение изменилось между вызовами
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(path, name, err)
+		}
+		return buf[:n], nil
+	}
+}
+
+// setXattr устанавливает значение расширенного атрибута `name` файла `path`.
+func setXattr(path, name string, value []byte) error {
+	if err := syscall.Setxattr(path, name, value, 0); err != nil {
+		return xattrError(path, name, err)
+	}
+	return nil
+}
+
+func xattrError(path, name string, err error) error {
+	switch err {
+	case syscall.ENODATA:
+		return fmt.Errorf("%s: %s: %w", path, name, os.ErrNotExist)
+	case syscall.ENOTSUP:
+		return fmt.Errorf("%s: %w", path, ErrXattrUnsupported)
+	}
+	return &os.PathError{Op: "xattr " + name, Path: path, Err: err}
+}
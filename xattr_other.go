@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package repokeeper
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, ErrXattrUnsupported
+}
+
+func setXattr(path, name string, value []byte) error {
+	return ErrXattrUnsupported
+}
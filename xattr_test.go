@@ -0,0 +1,129 @@
+package repokeeper
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntriesIDXattrs(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "album")
+	writeTestTracks(t, album, "01.flac")
+	if err := setXattr(album, EntryIDXattr, []byte("test")); errors.Is(err, ErrXattrUnsupported) {
+		t.Skip(err)
+	}
+
+	ent := NewEntries(root, DefaultFormats())
+	ent.Xattrs = true
+	// некорректное значение атрибута заменяется новым идентификатором
+	require.NoError(t, ent.Calculate(root))
+	id := ent.Cache[album].EntryID
+	require.NotEmpty(t, id)
+	data, err := getXattr(album, EntryIDXattr)
+	require.NoError(t, err)
+	assert.Equal(t, id, string(data))
+
+	// идентификатор восстанавливается по атрибуту без кеша
+	ent = NewEntries(root, DefaultFormats())
+	ent.Xattrs = true
+	require.NoError(t, ent.Calculate(root))
+	assert.Equal(t, id, ent.Cache[album].EntryID)
+
+	ent.SetEntryID(album, newEntryID(), nil)
+	data, err = getXattr(album, EntryIDXattr)
+	require.NoError(t, err)
+	assert.Equal(t, ent.Cache[album].EntryID, string(data))
+	assert.NotEqual(t, id, string(data))
+}
+
+func TestEntriesStateXattrs(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "album")
+	writeTestTracks(t, album, "01.flac")
+	if err := setXattr(album, EntryIDXattr, []byte(newEntryID())); errors.Is(err, ErrXattrUnsupported) {
+		t.Skip(err)
+	}
+
+	ent := NewEntries(root, DefaultFormats())
+	ent.Xattrs = true
+	require.NoError(t, ent.Calculate(root))
+	assert.Nil(t, ent.Cache[album].State)
+	verified := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, ent.UpdateEntryState(album, func(state *EntryState) {
+		state.VerifiedAt = verified
+		state.ReleaseID = "musicbrainz:123"
+	}))
+	require.Error(t, ent.UpdateEntryState(root, func(state *EntryState) {}))
+
+	// копия каталога с атрибутами опознается как переименованный Album Entry
+	// с сохранением состояния
+	copied := filepath.Join(root, "copy")
+	require.NoError(t, copyDir(album, copied))
+	id, state := readEntryXattrs(album)
+	writeEntryXattrs(copied, id, state)
+	require.NoError(t, os.RemoveAll(album))
+
+	cur := NewEntries(root, DefaultFormats())
+	cur.Xattrs = true
+	require.NoError(t, cur.Calculate(root))
+	require.NoError(t, cur.InheritEntryIDs(ent))
+	assert.Equal(t, id, cur.Cache[copied].EntryID)
+	assert.Equal(t, &EntryState{VerifiedAt: verified, ReleaseID: "musicbrainz:123"},
+		cur.Info(copied).State)
+	_, err := getXattr(copied, "user.repokeeper.normalized")
+	assert.Error(t, err)
+	changes, err := cur.Compare(ent)
+	require.NoError(t, err)
+	assert.Equal(t, RenamedFsChange, changes[album].Change)
+	assert.Equal(t, copied, changes[album].NewName)
+	assert.NotContains(t, changes, copied)
+}
+
+func TestEntriesCopiedIDXattr(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "album")
+	writeTestTracks(t, album, "01.flac")
+	id := newEntryID()
+	if err := setXattr(album, EntryIDXattr, []byte(id)); errors.Is(err, ErrXattrUnsupported) {
+		t.Skip(err)
+	}
+	ent := NewEntries(root, DefaultFormats())
+	ent.Xattrs = true
+	require.NoError(t, ent.Calculate(root))
+	require.Equal(t, id, ent.Cache[album].EntryID)
+
+	// копия каталога вместе с атрибутами при существующем оригинале
+	copied := filepath.Join(root, "copy")
+	require.NoError(t, copyDir(album, copied))
+	require.NoError(t, setXattr(copied, EntryIDXattr, []byte(id)))
+	require.NoError(t, ent.AddAlbumEntry(copied))
+	copyID := ent.Cache[copied].EntryID
+	assert.NotEqual(t, id, copyID)
+	assert.Equal(t, id, ent.Cache[album].EntryID)
+	data, err := getXattr(copied, EntryIDXattr)
+	require.NoError(t, err)
+	assert.Equal(t, copyID, string(data))
+
+	// копия, обнаруженная при запуске сервиса
+	require.NoError(t, setXattr(copied, EntryIDXattr, []byte(id)))
+	ent.Delete(copied)
+	cur := NewEntries(root, DefaultFormats())
+	cur.Xattrs = true
+	require.NoError(t, cur.Calculate(root))
+	require.NoError(t, cur.InheritEntryIDs(ent))
+	assert.Equal(t, id, cur.Cache[album].EntryID)
+	assert.NotEqual(t, id, cur.Cache[copied].EntryID)
+	data, err = getXattr(copied, EntryIDXattr)
+	require.NoError(t, err)
+	assert.Equal(t, cur.Cache[copied].EntryID, string(data))
+	changes, err := cur.Compare(ent)
+	require.NoError(t, err)
+	assert.Equal(t, CreatedFsChange, changes[copied].Change)
+	assert.NotContains(t, changes, album)
+}